@@ -0,0 +1,132 @@
+package FileDaemon
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/karrick/godirwalk"
+)
+
+//NFSv4 ACE flags that say how an entry is passed on to what's created in a directory (RFC 7530 6.2.1.4)
+const (
+	ACE_FLAG_FILE_INHERIT         = 0x1
+	ACE_FLAG_DIRECTORY_INHERIT    = 0x2
+	ACE_FLAG_NO_PROPAGATE_INHERIT = 0x4
+	ACE_FLAG_INHERIT_ONLY         = 0x8
+	ACE_FLAG_INHERITANCE          = ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT | ACE_FLAG_NO_PROPAGATE_INHERIT |
+		ACE_FLAG_INHERIT_ONLY
+)
+
+//aclXattr reads and writes the raw system.nfs4_acl of a path. Only NFSv4 mounts have it, so tests swap in a fake
+var aclXattr = struct {
+	get func(filePath string) []byte
+	set func(filePath string, raw []byte) error
+}{
+	get: readACLXattr,
+	set: func(filePath string, raw []byte) error {
+		return syscall.Setxattr(filePath, JOURNAL_ACL_XATTR, raw, 0)
+	},
+}
+
+//inheritACL gives a newly created filePath the ACL the directory it was created in passes on, as mkdir does for
+// new directories. Every command that creates something goes through here, so the result doesn't depend on how it
+// was made. recursive covers everything under a created directory as well, each entry inheriting from its new
+// parent. Symlinks are skipped, as setting an ACL on one would set it on whatever it points to
+func (worker *Worker) inheritACL(filePath string, recursive bool) error {
+	fi, err := os.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+	if !recursive || !fi.IsDir() {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return inheritParentACL(filePath, fi.IsDir())
+	}
+
+	//parents are visited before what's in them, so each has its inherited ACL by the time its entries ask for it
+	return godirwalk.Walk(filePath, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+			if de.IsSymlink() {
+				return nil
+			}
+			return inheritParentACL(subFilePath, de.IsDir())
+		},
+	})
+}
+
+//inheritParentACL sets the ACL the parent of filePath passes on. Nothing changes when the parent has no ACL, as off
+// NFSv4, or nothing to pass on, leaving filePath with the mode it was created with
+func inheritParentACL(filePath string, isDir bool) error {
+	raw := aclXattr.get(filepath.Dir(filePath))
+	if raw == nil {
+		return nil
+	}
+	parent, err := parseNFS4ACL(raw)
+	if err != nil {
+		return err
+	}
+	inherited := inheritedACEs(parent, isDir)
+	if len(inherited) == 0 {
+		return nil
+	}
+
+	return aclXattr.set(filePath, encodeNFS4ACL(inherited))
+}
+
+//inheritedACEs picks the entries of a directory's ACL that a new file or directory in it gets. A file gets the file
+// inherit entries as plain entries. A directory gets the directory inherit entries, still inheritable unless they
+// say not to propagate, and keeps file inherit entries as inherit only so they reach the files created in it
+func inheritedACEs(parent []nfs4ACE, isDir bool) []nfs4ACE {
+	var inherited []nfs4ACE
+	for _, ace := range parent {
+		child := ace
+		child.flags &^= ACE_FLAG_INHERITANCE
+		noPropagate := ace.flags&ACE_FLAG_NO_PROPAGATE_INHERIT != 0
+		switch {
+		case !isDir:
+			if ace.flags&ACE_FLAG_FILE_INHERIT == 0 {
+				continue
+			}
+		case ace.flags&ACE_FLAG_DIRECTORY_INHERIT != 0:
+			if !noPropagate {
+				child.flags |= ace.flags & (ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT)
+			}
+		case ace.flags&ACE_FLAG_FILE_INHERIT != 0:
+			if noPropagate {
+				continue
+			}
+			child.flags |= ACE_FLAG_FILE_INHERIT | ACE_FLAG_INHERIT_ONLY
+		default:
+			continue
+		}
+		inherited = append(inherited, child)
+	}
+
+	return inherited
+}
+
+//copyACLs gives each entry of a copy the NFSv4 ACL of its source, for requests that keep source ACLs rather than
+// inheriting. Sources without an ACL leave the copy as it is
+func copyACLs(srcPath, dstPath string) error {
+	return godirwalk.Walk(srcPath, &godirwalk.Options{
+		Unsorted:          true,
+		AllowNonDirectory: true,
+		Callback: func(subSrcPath string, de *godirwalk.Dirent) error {
+			if de.IsSymlink() {
+				return nil
+			}
+			acl := readACLXattr(subSrcPath)
+			if acl == nil {
+				return nil
+			}
+			relPath, err := filepath.Rel(srcPath, subSrcPath)
+			if err != nil {
+				return err
+			}
+			return syscall.Setxattr(filepath.Join(dstPath, relPath), JOURNAL_ACL_XATTR, acl, 0)
+		},
+	})
+}
@@ -0,0 +1,127 @@
+package FileDaemon
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//fakeACLs stands in for system.nfs4_acl, keeping each path's ACL in memory under its clean path, as the filesystem
+// doesn't mind how a path is spelt
+func fakeACLs(t *testing.T) map[string][]nfs4ACE {
+	t.Helper()
+	acls := map[string][]nfs4ACE{}
+	saved := aclXattr
+	aclXattr.get = func(filePath string) []byte {
+		if aces, ok := acls[filepath.Clean(filePath)]; ok {
+			return encodeNFS4ACL(aces)
+		}
+		return nil
+	}
+	aclXattr.set = func(filePath string, raw []byte) error {
+		aces, err := parseNFS4ACL(raw)
+		acls[filepath.Clean(filePath)] = aces
+		return err
+	}
+	t.Cleanup(func() { aclXattr = saved })
+	return acls
+}
+
+//withFlags is ace with its flags replaced
+func withFlags(ace nfs4ACE, flags uint32) nfs4ACE {
+	ace.flags = flags
+	return ace
+}
+
+func TestInheritedACEs(t *testing.T) {
+	plain := nfs4ACE{flags: 0, mask: 0x1, who: "plain@"}
+	file := nfs4ACE{flags: ACE_FLAG_FILE_INHERIT, mask: 0x2, who: "file@"}
+	dir := nfs4ACE{flags: ACE_FLAG_DIRECTORY_INHERIT, mask: 0x4, who: "dir@"}
+	both := nfs4ACE{flags: ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT | ACE_FLAG_INHERIT_ONLY | 0x40, mask: 0x8,
+		who: "both@"}
+	fileOnce := nfs4ACE{flags: ACE_FLAG_FILE_INHERIT | ACE_FLAG_NO_PROPAGATE_INHERIT, mask: 0x10, who: "fileonce@"}
+	bothOnce := nfs4ACE{flags: ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT | ACE_FLAG_NO_PROPAGATE_INHERIT,
+		mask: 0x20, who: "bothonce@"}
+	parent := []nfs4ACE{plain, file, dir, both, fileOnce, bothOnce}
+
+	wantFile := []nfs4ACE{withFlags(file, 0), withFlags(both, 0x40), withFlags(fileOnce, 0), withFlags(bothOnce, 0)}
+	wantDir := []nfs4ACE{
+		withFlags(file, ACE_FLAG_FILE_INHERIT|ACE_FLAG_INHERIT_ONLY),
+		withFlags(dir, ACE_FLAG_DIRECTORY_INHERIT),
+		withFlags(both, ACE_FLAG_FILE_INHERIT|ACE_FLAG_DIRECTORY_INHERIT|0x40),
+		withFlags(bothOnce, 0),
+	}
+
+	if got := inheritedACEs(parent, false); !reflect.DeepEqual(got, wantFile) {
+		t.Errorf("file inherits %+v, want %+v", got, wantFile)
+	}
+	if got := inheritedACEs(parent, true); !reflect.DeepEqual(got, wantDir) {
+		t.Errorf("directory inherits %+v, want %+v", got, wantDir)
+	}
+	if got := inheritedACEs([]nfs4ACE{plain}, false); got != nil {
+		t.Errorf("nothing to inherit gave %+v", got)
+	}
+}
+
+func TestInheritACLKeepsMode(t *testing.T) {
+	acls := fakeACLs(t)
+	root := t.TempDir()
+	dst := filepath.Join(root, "dst")
+	src := filepath.Join(root, "src")
+	for _, dir := range []string{dst, src, filepath.Join(src, "sub")} {
+		if err := os.Mkdir(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "f"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	owner := nfs4ACE{flags: ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT, mask: 0x1f01ff, who: "OWNER@"}
+	acls[dst] = []nfs4ACE{owner, {mask: 0x1, who: "EVERYONE@"}}
+	fileACL := []nfs4ACE{withFlags(owner, 0)}
+	dirACL := []nfs4ACE{owner}
+
+	worker := testWorker(t, root)
+	if _, err := worker.doMkdir([]string{"0750", filepath.Join(dst, "a", "b")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worker.doCopy([]string{"true", src, filepath.Join(dst, "copy")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range []struct {
+		path string
+		mode os.FileMode
+		acl  []nfs4ACE
+	}{
+		{"a", 0750 | os.ModeDir, dirACL},
+		{"a/b", 0750 | os.ModeDir, dirACL},
+		{"copy", 0750 | os.ModeDir, dirACL},
+		{"copy/sub", 0750 | os.ModeDir, dirACL},
+		{"copy/sub/f", 0640, fileACL},
+	} {
+		filePath := filepath.Join(dst, entry.path)
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != entry.mode {
+			t.Errorf("%s has mode %v, want %v", entry.path, fi.Mode(), entry.mode)
+		}
+		if !reflect.DeepEqual(acls[filePath], entry.acl) {
+			t.Errorf("%s has ACL %+v, want %+v", entry.path, acls[filePath], entry.acl)
+		}
+	}
+
+	//a directory without an ACL passes nothing on
+	if err := os.WriteFile(filepath.Join(src, "g"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.inheritACL(filepath.Join(src, "g"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := acls[filepath.Join(src, "g")]; ok {
+		t.Error("an ACL was set from a directory without one")
+	}
+}
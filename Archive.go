@@ -0,0 +1,312 @@
+package FileDaemon
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/karrick/godirwalk"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ARCHIVE_PARAM_COUNT       = 3
+	ARCHIVE_PARAM_FORMAT_IDX  = 0
+	ARCHIVE_PARAM_SRCPATH_IDX = 1
+	ARCHIVE_PARAM_DSTPATH_IDX = 2
+
+	EXTRACT_PARAM_COUNT_MIN   = 3
+	EXTRACT_PARAM_FORMAT_IDX  = 0
+	EXTRACT_PARAM_SRCPATH_IDX = 1
+	EXTRACT_PARAM_DSTPATH_IDX = 2
+	//everything after the destination is key=value options
+	EXTRACT_PARAM_OPTIONS_IDX = 3
+
+	ARCHIVE_FORMAT_TAR     = "tar"
+	ARCHIVE_FORMAT_TAR_GZ  = "tar.gz"
+	ARCHIVE_FORMAT_TAR_ZST = "tar.zst"
+	ARCHIVE_FORMAT_ZIP     = "zip"
+
+	//a zip stores a symlink's target as its content; anything longer than this isn't a target
+	ARCHIVE_MAX_LINK_LENGTH = 4096
+)
+
+//ArchiveResult is the reply to archive and extract: the entries written, the bytes of file content in them, and
+// the entries passed over because they aren't files, directories or links
+type ArchiveResult struct {
+	Entries int64 `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int64 `json:"skipped"`
+}
+
+//archiveUmask is the daemon's umask, read once at startup, as reading it means setting it and workers create files
+// concurrently
+var archiveUmask = func() os.FileMode {
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return os.FileMode(umask)
+}()
+
+//errArchiveSkip marks an entry of a type archives don't carry, such as a device or socket
+var errArchiveSkip = errors.New("entry skipped")
+
+//archiveWriter adds entries to an archive in one of the formats
+type archiveWriter interface {
+	//add writes one entry, reading a regular file's content from filePath, and returns the content's size
+	add(name, filePath string, fi os.FileInfo) (int64, error)
+	Close() error
+}
+
+//doArchive bundles a file or directory into a new archive: archive|format|src|dst, with format tar, tar.gz, tar.zst
+// or zip. Entries are named from src's base name down, and symlinks are stored as symlinks. The archive is written
+// to a temporary file and renamed into place once complete, with mode 0644 less the umask and the ACL of its
+// directory. Progress shows up in status while it runs. Replies with an ArchiveResult as JSON
+func (worker *Worker) doArchive(params []string) (reply []string, err error) {
+	if len(params) != ARCHIVE_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to archive. Expected " +
+			strconv.Itoa(ARCHIVE_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	format := params[ARCHIVE_PARAM_FORMAT_IDX]
+	srcPath := filepath.Clean(params[ARCHIVE_PARAM_SRCPATH_IDX])
+	dstPath := filepath.Clean(params[ARCHIVE_PARAM_DSTPATH_IDX])
+	if err = checkArchiveFormat(format); err != nil {
+		return
+	}
+	if err = worker.checkPaths(srcPath, dstPath); err != nil {
+		return
+	}
+	if _, err = os.Lstat(srcPath); err != nil {
+		return
+	}
+	if _, statErr := os.Lstat(dstPath); statErr == nil {
+		return nil, errors.New("destination FilePath already exists")
+	}
+	if resolvePath(dstPath) == resolvePath(srcPath) ||
+		strings.HasPrefix(resolvePath(dstPath), resolvePath(srcPath)+string(os.PathSeparator)) {
+		return nil, errors.New("can't write an archive inside what it archives: " + dstPath)
+	}
+
+	tempPath := worker.tempSibling(dstPath)
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+	writer, err := newArchiveWriter(format, file)
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	total, _ := treeSize(srcPath)
+	progress := WorkerProgress{TotalBytes: total}
+	var result ArchiveResult
+	job := worker.startJob("archive", params, false)
+	baseDir := filepath.Dir(srcPath)
+	err = godirwalk.Walk(srcPath, &godirwalk.Options{
+		AllowNonDirectory: true,
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			fi, err := os.Lstat(filePath)
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(baseDir, filePath)
+			if err != nil {
+				return err
+			}
+			size, err := writer.add(filepath.ToSlash(name), filePath, fi)
+			if err == errArchiveSkip {
+				result.Skipped++
+				return nil
+			} else if err != nil {
+				return err
+			}
+			result.Entries++
+			result.Bytes += size
+			progress.Entries, progress.Bytes = result.Entries, result.Bytes
+			worker.setProgress(progress)
+			job.checkpoint(filePath)
+			return nil
+		},
+	})
+	worker.finishJob(job)
+	worker.Server.metrics.addEntriesWalked("archive", int(result.Entries+result.Skipped))
+	if err != nil {
+		writer.Close()
+		file.Close()
+		return
+	}
+	if err = writer.Close(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+
+	//the temporary file is private while it's written; the archive gets the mode a new file would
+	if err = os.Chmod(tempPath, 0644&^archiveUmask); err != nil {
+		return
+	}
+	if err = worker.inheritACL(tempPath, false); err != nil {
+		return
+	}
+	if err = os.Rename(tempPath, dstPath); err != nil {
+		return
+	}
+	if dir, openErr := os.Open(filepath.Dir(dstPath)); openErr == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	encoded, err := worker.jsonReply(result)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//checkArchiveFormat returns an error unless format is one archive and extract understand
+func checkArchiveFormat(format string) error {
+	switch format {
+	case ARCHIVE_FORMAT_TAR, ARCHIVE_FORMAT_TAR_GZ, ARCHIVE_FORMAT_TAR_ZST, ARCHIVE_FORMAT_ZIP:
+		return nil
+	}
+	return errors.New("Unknown archive format " + format + ", expected " + ARCHIVE_FORMAT_TAR + ", " +
+		ARCHIVE_FORMAT_TAR_GZ + ", " + ARCHIVE_FORMAT_TAR_ZST + " or " + ARCHIVE_FORMAT_ZIP)
+}
+
+func newArchiveWriter(format string, file io.Writer) (archiveWriter, error) {
+	switch format {
+	case ARCHIVE_FORMAT_TAR:
+		return &tarArchiveWriter{tar: tar.NewWriter(file)}, nil
+	case ARCHIVE_FORMAT_TAR_GZ:
+		compressor := gzip.NewWriter(file)
+		return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+	case ARCHIVE_FORMAT_TAR_ZST:
+		compressor, err := zstd.NewWriter(file)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tar: tar.NewWriter(compressor), compressor: compressor}, nil
+	case ARCHIVE_FORMAT_ZIP:
+		return &zipArchiveWriter{zip: zip.NewWriter(file)}, nil
+	}
+	return nil, checkArchiveFormat(format)
+}
+
+type tarArchiveWriter struct {
+	tar *tar.Writer
+	//what the tar stream is compressed through, if anything
+	compressor io.WriteCloser
+}
+
+func (writer *tarArchiveWriter) add(name, filePath string, fi os.FileInfo) (int64, error) {
+	link := ""
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return 0, err
+		}
+		link = target
+	case !fi.Mode().IsRegular() && !fi.IsDir():
+		return 0, errArchiveSkip
+	}
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return 0, err
+	}
+	header.Name = name
+	if fi.IsDir() {
+		header.Name += "/"
+	}
+	if err = writer.tar.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, nil
+	}
+
+	return copyFileInto(writer.tar, filePath)
+}
+
+func (writer *tarArchiveWriter) Close() error {
+	err := writer.tar.Close()
+	if writer.compressor != nil {
+		if closeErr := writer.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type zipArchiveWriter struct {
+	zip *zip.Writer
+}
+
+func (writer *zipArchiveWriter) add(name, filePath string, fi os.FileInfo) (int64, error) {
+	if !fi.Mode().IsRegular() && !fi.IsDir() && fi.Mode()&os.ModeSymlink == 0 {
+		return 0, errArchiveSkip
+	}
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return 0, err
+	}
+	header.Name = name
+	if fi.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+	entry, err := writer.zip.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		//zip keeps a symlink's target as its content
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.WriteString(entry, target)
+		return 0, err
+	case fi.IsDir():
+		return 0, nil
+	}
+
+	return copyFileInto(entry, filePath)
+}
+
+func (writer *zipArchiveWriter) Close() error {
+	return writer.zip.Close()
+}
+
+//copyFileInto writes the content of filePath to writer
+func copyFileInto(writer io.Writer, filePath string) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(writer, file)
+}
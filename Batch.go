@@ -0,0 +1,358 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/karrick/godirwalk"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	BATCH_PARAM_COUNT_MIN    = 3
+	BATCH_PARAM_MODE_IDX     = 0
+	BATCH_PARAM_ROLLBACK_IDX = 1
+	//the operations are the rest of the message, so a delimiter inside the JSON survives
+	BATCH_PARAM_OPERATIONS_IDX = 2
+
+	BATCH_MODE_STOP     = "stop"
+	BATCH_MODE_CONTINUE = "continue"
+
+	//a batch is one request on one worker, so keep it from tying that worker up indefinitely
+	BATCH_MAX_OPERATIONS = 256
+)
+
+//BatchStep reports what happened to one operation in a batch
+type BatchStep struct {
+	Index         int      `json:"index"`
+	Command       string   `json:"command"`
+	OK            bool     `json:"ok"`
+	Skipped       bool     `json:"skipped,omitempty"`
+	Reply         []string `json:"reply,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	RolledBack    bool     `json:"rolled_back,omitempty"`
+	RollbackError string   `json:"rollback_error,omitempty"`
+}
+
+type BatchResult struct {
+	OK    bool        `json:"ok"`
+	Steps []BatchStep `json:"steps"`
+}
+
+//batchUndo reverses a completed step. A nil batchUndo means the step can't be reversed
+type batchUndo func() error
+
+//doBatch runs an ordered list of operations on this worker: batch|stop or continue|rollback|[["cmd","param",...],...].
+// With stop, the first failure skips everything after it; with continue every operation is tried. If anything failed
+// and rollback is set, the steps that succeeded are reversed, newest first, as far as they can be.
+// The reply is the per-step results as JSON; if any step failed the request fails with the results as its message
+func (worker *Worker) doBatch(params []string) (reply []string, err error) {
+	if len(params) < BATCH_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to batch. Expected " +
+			strconv.Itoa(BATCH_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	mode := params[BATCH_PARAM_MODE_IDX]
+	if mode != BATCH_MODE_STOP && mode != BATCH_MODE_CONTINUE {
+		err = errors.New("Unknown batch mode " + mode + ", expected " + BATCH_MODE_STOP + " or " + BATCH_MODE_CONTINUE)
+		return
+	}
+	rollback, err := strconv.ParseBool(params[BATCH_PARAM_ROLLBACK_IDX])
+	if err != nil {
+		return
+	}
+	var operations [][]string
+	delimiter := worker.Server.CurrentConfig().MessageDelimiter
+	if err = json.Unmarshal([]byte(strings.Join(params[BATCH_PARAM_OPERATIONS_IDX:], delimiter)), &operations); err != nil {
+		err = errors.New("Invalid batch operations: " + err.Error())
+		return
+	}
+	if len(operations) == 0 || len(operations) > BATCH_MAX_OPERATIONS {
+		err = errors.New("A batch needs between 1 and " + strconv.Itoa(BATCH_MAX_OPERATIONS) + " operations, got " +
+			strconv.Itoa(len(operations)))
+		return
+	}
+	//check the whole batch before touching anything
+	for i, operation := range operations {
+		if len(operation) == 0 || worker.batchHandler(operation[0]) == nil {
+			err = errors.New("Operation " + strconv.Itoa(i) + " is not a command that can be batched")
+			return
+		}
+	}
+
+	result := BatchResult{OK: true, Steps: make([]BatchStep, len(operations))}
+	undos := make([]batchUndo, len(operations))
+	for i, operation := range operations {
+		step := &result.Steps[i]
+		step.Index = i
+		step.Command = operation[0]
+		if !result.OK && mode == BATCH_MODE_STOP {
+			step.Skipped = true
+			continue
+		}
+
+		prepared := worker.prepareBatchUndo(operation[0], operation[1:])
+		var stepErr error
+		step.Reply, stepErr = worker.batchHandler(operation[0])(operation[1:])
+		if stepErr != nil {
+			step.Error = stepErr.Error()
+			result.OK = false
+			worker.logDebug("batch step failed", "step", i, "command", operation[0], "error", stepErr)
+			continue
+		}
+		step.OK = true
+		undos[i] = prepared(step.Reply)
+	}
+
+	if !result.OK && rollback {
+		for i := len(operations) - 1; i >= 0; i-- {
+			step := &result.Steps[i]
+			if !step.OK || step.Command == "checksum" {
+				continue
+			}
+			if undos[i] == nil {
+				step.RollbackError = step.Command + " cannot be rolled back"
+				continue
+			}
+			if undoErr := undos[i](); undoErr != nil {
+				step.RollbackError = undoErr.Error()
+				worker.logWarn("batch rollback failed", "step", i, "command", step.Command, "error", undoErr)
+				continue
+			}
+			step.RolledBack = true
+		}
+	}
+
+	encoded, err := worker.jsonReply(result)
+	if err != nil {
+		return
+	}
+	if !result.OK {
+		err = errors.New(encoded)
+		return
+	}
+	reply = []string{encoded}
+
+	return
+}
+
+//batchHandler returns the handler for the commands a batch may contain
+func (worker *Worker) batchHandler(cmd string) func(params []string) ([]string, error) {
+	switch cmd {
+	case "checksum":
+		return worker.doChecksum
+	case "chmod":
+		return worker.doChmod
+	case "chown":
+		return worker.doChown
+	case "cp":
+		return worker.doCopy
+	case "mkdir":
+		return worker.doMkdir
+	case "mv":
+		return worker.doMove
+	case "rm":
+		return worker.doRemove
+	case "ln":
+		return func(params []string) ([]string, error) { return worker.doLink(params, false) }
+	case "symlink":
+		return func(params []string) ([]string, error) { return worker.doLink(params, true) }
+	case "setxattr":
+		return worker.doSetxattr
+	case "removexattr":
+		return worker.doRemovexattr
+	}
+	return nil
+}
+
+//prepareBatchUndo captures whatever is needed to reverse an operation before it runs. The returned function is given
+// the operation's reply once it succeeds, and builds the undo from it
+func (worker *Worker) prepareBatchUndo(cmd string, params []string) func(reply []string) batchUndo {
+	none := func([]string) batchUndo { return nil }
+
+	//journaled steps recorded what they changed, however much that was
+	if worker.Server.CurrentConfig().JournalEnabled && (cmd == "chmod" || cmd == "chown" || cmd == "rm") {
+		return worker.journaledUndo()
+	}
+
+	switch cmd {
+	case "mkdir":
+		return func(reply []string) batchUndo {
+			//the reply names the first directory we had to create, if any
+			if len(reply) == 0 || reply[MKDIR_REPLY_SUBDIR_IDX] == "" {
+				return func() error { return nil }
+			}
+			return func() error { return os.RemoveAll(reply[MKDIR_REPLY_SUBDIR_IDX]) }
+		}
+
+	case "cp":
+		//cp refuses to overwrite, so anything at the destination is ours
+		if len(params) < COPY_PARAM_COUNT {
+			return none
+		}
+		dstFilePath := params[COPY_PARAM_DSTFILEPATH_IDX]
+		return func([]string) batchUndo {
+			return func() error { return os.RemoveAll(dstFilePath) }
+		}
+
+	case "mv":
+		if len(params) < MOVE_PARAM_COUNT {
+			return none
+		}
+		srcFilePath := params[MOVE_PARAM_SRCFILEPATH_IDX]
+		keepACL := false
+		if len(params) == MOVE_PARAM_COUNT_KEEP_ACL {
+			keepACL, _ = strconv.ParseBool(params[MOVE_PARAM_KEEP_ACL_IDX])
+		}
+		//a move that doesn't keep ACLs gives the tree those of its new directory, so remember the ones it had
+		var acls map[string][]byte
+		if !keepACL {
+			var err error
+			if acls, err = treeACLs(srcFilePath); err != nil {
+				return none
+			}
+		}
+		//moving back keeps the ACLs the tree has, then the remembered ones are put back over them
+		undoParams := []string{params[MOVE_PARAM_DSTFILEPATH_IDX], srcFilePath, "true"}
+		return func([]string) batchUndo {
+			return func() error {
+				if _, err := worker.doMove(undoParams); err != nil {
+					return err
+				}
+				for subPath, raw := range acls {
+					if err := aclXattr.set(filepath.Join(srcFilePath, subPath), raw); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+
+	case "ln", "symlink":
+		//a replaced link is gone, but a new one is ours to remove
+		if len(params) != LINK_PARAM_COUNT {
+			return none
+		}
+		if replace, _ := strconv.ParseBool(params[LINK_PARAM_REPLACE_IDX]); replace {
+			return none
+		}
+		linkPath := params[LINK_PARAM_LINKPATH_IDX]
+		return func([]string) batchUndo {
+			return func() error { return os.Remove(linkPath) }
+		}
+
+	case "setxattr", "removexattr":
+		//as with chown, only a single path's attribute is worth remembering
+		if len(params) < REMOVEXATTR_PARAM_COUNT {
+			return none
+		}
+		if recursive, _ := strconv.ParseBool(params[SETXATTR_PARAM_RECURSIVE_IDX]); recursive {
+			return none
+		}
+		filePath, name := params[SETXATTR_PARAM_FILEPATH_IDX], params[SETXATTR_PARAM_NAME_IDX]
+		previous, err := readXattr(filePath, name, false)
+		if err == unix.ENODATA {
+			return func([]string) batchUndo {
+				return func() error { return unix.Removexattr(filePath, name) }
+			}
+		} else if err != nil {
+			return none
+		}
+		return func([]string) batchUndo {
+			return func() error { return unix.Setxattr(filePath, name, previous, 0) }
+		}
+
+	case "chown":
+		//only a single path's ownership is cheap enough to remember
+		if len(params) != CHOWN_PARAM_COUNT {
+			return none
+		}
+		if recursive, _ := strconv.ParseBool(params[CHOWN_PARAM_RECURSIVE_IDX]); recursive {
+			return none
+		}
+		//chown follows symlinks, so it's the target's ownership to remember
+		filePath := params[CHOWN_PARAM_FILEPATH_IDX]
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			return none
+		}
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return none
+		}
+		return func([]string) batchUndo {
+			return func() error { return os.Chown(filePath, int(stat.Uid), int(stat.Gid)) }
+		}
+	}
+
+	//without the journal, chmod replaces ACLs and rm deletes outright; neither leaves anything to restore from
+	return none
+}
+
+//treeACLs records the raw ACLs of filePath and everything beneath it that has one, keyed by path relative to
+// filePath. Symlinks are skipped, as inheritACL skips them
+func treeACLs(filePath string) (acls map[string][]byte, err error) {
+	acls = make(map[string][]byte)
+	fi, err := os.Lstat(filePath)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	err = godirwalk.Walk(filePath, &godirwalk.Options{
+		Unsorted:          true,
+		AllowNonDirectory: true,
+		Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+			if de.IsSymlink() {
+				return nil
+			}
+			if raw := aclXattr.get(subFilePath); raw != nil {
+				subPath, err := filepath.Rel(filePath, subFilePath)
+				if err != nil {
+					return err
+				}
+				acls[subPath] = raw
+			}
+			return nil
+		},
+	})
+
+	return
+}
+
+//journaledUndo undoes a journaled step from its journal entries, newest first. A batch's steps share one request and
+// so one journal, so the step's entries are the ones written after the journal's current end
+func (worker *Worker) journaledUndo() func(reply []string) batchUndo {
+	file := journalFile(worker.Server.CurrentConfig(), worker.requestID)
+	var mark int64
+	if fi, err := os.Stat(file); err == nil {
+		mark = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return func([]string) batchUndo { return nil }
+	}
+
+	return func([]string) batchUndo {
+		return func() error {
+			journalLock.Lock()
+			defer journalLock.Unlock()
+
+			entries, err := readJournalFrom(file, mark)
+			if os.IsNotExist(err) {
+				//nothing was journaled, so nothing changed
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for i := len(entries) - 1; i >= 0; i-- {
+				if err = undoEntry(entries[i]); err != nil {
+					return errors.New(entries[i].Path + ": " + err.Error())
+				}
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//with the journal on, rolling back a batch puts back what each chmod journaled, even where steps touched the same path
+func TestBatchRollbackFromJournal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "d")
+	file := filepath.Join(dir, "f")
+	if err := os.Mkdir(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	worker := testWorker(t, root)
+	worker.Server.config.JournalEnabled = true
+	worker.Server.config.JournalDir = filepath.Join(t.TempDir(), "journal")
+
+	operations, err := json.Marshal([][]string{
+		{"chmod", "owrite", "true", dir},
+		{"chmod", "lock", "false", file},
+		{"chmod", "lock", "false", filepath.Join(root, "missing")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = worker.doBatch([]string{BATCH_MODE_CONTINUE, "true", string(operations)}); err == nil {
+		t.Fatal("a batch with a failing step succeeded")
+	}
+	var result BatchResult
+	if err = json.Unmarshal([]byte(err.Error()), &result); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range result.Steps[:2] {
+		if !step.RolledBack {
+			t.Errorf("step %d was not rolled back: %s", step.Index, step.RollbackError)
+		}
+	}
+
+	for filePath, want := range map[string]os.FileMode{dir: 0750 | os.ModeDir, file: 0640} {
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s has mode %v after rollback, want %v", filePath, fi.Mode(), want)
+		}
+	}
+}
+
+//a moved tree inherits the ACLs of its new directory, and rolling the move back gives it the ones it had before
+func TestBatchRollbackMoveRestoresACLs(t *testing.T) {
+	acls := fakeACLs(t)
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	for _, dir := range []string{src, dst, filepath.Join(src, "d")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "d", "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	inherit := uint32(ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT)
+	acls[dst] = []nfs4ACE{{flags: inherit, mask: 0x1, who: "new@"}}
+	dirACL := []nfs4ACE{{flags: inherit, mask: 0x2, who: "dir@"}}
+	fileACL := []nfs4ACE{{mask: 0x4, who: "file@"}}
+	acls[filepath.Join(src, "d")] = dirACL
+	acls[filepath.Join(src, "d", "f")] = fileACL
+
+	operations, err := json.Marshal([][]string{
+		{"mv", filepath.Join(src, "d"), filepath.Join(dst, "d")},
+		{"chmod", "lock", "false", filepath.Join(root, "missing")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := testWorker(t, root)
+	if _, err = worker.doBatch([]string{BATCH_MODE_STOP, "true", string(operations)}); err == nil {
+		t.Fatal("a batch with a failing step succeeded")
+	}
+	if acls[filepath.Join(dst, "d", "f")] == nil {
+		t.Fatal("the move didn't inherit its new directory's ACL")
+	}
+
+	if !reflect.DeepEqual(acls[filepath.Join(src, "d")], dirACL) {
+		t.Errorf("d has ACL %+v after rollback, want %+v", acls[filepath.Join(src, "d")], dirACL)
+	}
+	if !reflect.DeepEqual(acls[filepath.Join(src, "d", "f")], fileACL) {
+		t.Errorf("d/f has ACL %+v after rollback, want %+v", acls[filepath.Join(src, "d", "f")], fileACL)
+	}
+}
@@ -0,0 +1,167 @@
+package FileDaemon
+
+import (
+	"sync/atomic"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+const (
+	//how long the broker blocks on the sockets before checking whether it has been told to stop
+	brokerPollInterval = 250 * time.Millisecond
+	//the reply sent to clients whose request arrives while the server is shutting down
+	brokerRejectMessage = "server is shutting down"
+
+	//the first frame of everything between the broker and a worker, saying what the rest is
+	//worker to broker: idle and waiting for a request
+	brokerMsgReady = "ready"
+	//broker to worker: a request, starting with the client's envelope
+	brokerMsgRequest = "request"
+	//worker to broker: a reply, starting with the client's envelope. The worker is idle again
+	brokerMsgReply = "reply"
+	//worker to broker: the worker would like to leave the pool
+	brokerMsgRetire = "retire"
+	//broker to worker: nothing more will be routed to the worker, so it can close its socket
+	brokerMsgRetired = "retired"
+)
+
+//runBroker shuttles requests from the client facing ROUTER to idle workers through the worker facing ROUTER, and
+// replies back again. It stands in for zmq.Proxy so that we can count in-flight requests, turn new requests away
+// while draining, and only route requests to workers that are waiting for one. Requests wait here while every worker
+// is busy. A worker leaves the pool by asking, and only goes once it is idle and out of the rotation, so no request
+// is left queued on a closed socket.
+// Sockets are only ever touched from this goroutine, as ZMQ sockets are not thread safe
+func (server *Server) runBroker(frontend, backend *zmq.Socket) {
+	defer close(server.brokerDone)
+
+	poller := zmq.NewPoller()
+	poller.Add(frontend, zmq.POLLIN)
+	poller.Add(backend, zmq.POLLIN)
+
+	var queue workerQueue
+	send := func(workerID string, msg []string) error {
+		_, err := backend.SendMessage(workerID, brokerMsgRequest, msg)
+		if err != nil && zmq.AsErrno(err) != zmq.EHOSTUNREACH {
+			server.Logger.Error("broker", "failed to dispatch request", "worker", workerID, "error", err)
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-server.brokerStop:
+			return
+		default:
+		}
+
+		sockets, err := poller.Poll(brokerPollInterval)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return
+			}
+			server.Logger.Error("broker", "poll failed", "error", err)
+			continue
+		}
+
+		for _, polled := range sockets {
+			switch polled.Socket {
+			case frontend:
+				msg, err := frontend.RecvMessage(0)
+				if err != nil {
+					server.Logger.Error("broker", "failed to read request", "error", err)
+					continue
+				}
+				if server.IsDraining() {
+					//answer on the worker's behalf so the client isn't left waiting on a server going away
+					atomic.AddUint64(&server.requestsRejected, 1)
+					reply := server.CurrentConfig().MessageDelimiter + brokerRejectMessage
+					frontend.SendMessage(envelope(msg), "false"+reply)
+					continue
+				}
+				atomic.AddInt64(&server.requestsInFlight, 1)
+				queue.queued = append(queue.queued, msg)
+
+			case backend:
+				msg, err := backend.RecvMessage(0)
+				if err != nil {
+					server.Logger.Error("broker", "failed to read reply", "error", err)
+					continue
+				}
+				if len(msg) < 2 {
+					server.Logger.Error("broker", "malformed message from worker", "frames", len(msg))
+					continue
+				}
+				workerID, kind := msg[0], msg[1]
+				switch kind {
+				case brokerMsgReady:
+					queue.ready(workerID)
+				case brokerMsgReply:
+					atomic.AddInt64(&server.requestsInFlight, -1)
+					if _, err := frontend.SendMessage(msg[2:]); err != nil {
+						server.Logger.Error("broker", "failed to return reply", "error", err)
+					}
+					queue.ready(workerID)
+				case brokerMsgRetire:
+					if !queue.retire(workerID) {
+						break
+					}
+					if _, err := backend.SendMessage(workerID, brokerMsgRetired); err != nil {
+						server.Logger.Error("broker", "failed to retire worker", "worker", workerID, "error", err)
+					}
+				default:
+					server.Logger.Error("broker", "unknown message from worker", "worker", workerID, "kind", kind)
+				}
+			}
+		}
+		queue.dispatch(send)
+	}
+}
+
+//workerQueue is the broker's view of the pool: the workers waiting for a request, longest waiting first, and the
+// requests waiting for a worker, oldest first
+type workerQueue struct {
+	idle   []string
+	queued [][]string
+}
+
+//ready puts a worker at the back of the idle line
+func (queue *workerQueue) ready(workerID string) {
+	queue.idle = append(queue.idle, workerID)
+}
+
+//retire takes a worker out of the rotation if it is idle. One with a request on its way to it isn't, so it is left
+// alone and asks again once it has replied
+func (queue *workerQueue) retire(workerID string) bool {
+	for i, id := range queue.idle {
+		if id == workerID {
+			queue.idle = append(queue.idle[:i], queue.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//dispatch hands queued requests to idle workers until it runs out of one or the other. A worker that can't be sent
+// to has gone, e.g. died while idle, and its request waits for the next
+func (queue *workerQueue) dispatch(send func(workerID string, msg []string) error) {
+	for len(queue.idle) > 0 && len(queue.queued) > 0 {
+		workerID := queue.idle[0]
+		queue.idle = queue.idle[1:]
+		if send(workerID, queue.queued[0]) != nil {
+			continue
+		}
+		queue.queued = queue.queued[1:]
+	}
+}
+
+//envelope returns the routing frames of a ROUTER message, up to and including the empty delimiter frame
+func envelope(msg []string) []string {
+	for i, part := range msg {
+		if part == "" {
+			return msg[:i+1]
+		}
+	}
+
+	return msg[:0]
+}
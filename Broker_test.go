@@ -0,0 +1,55 @@
+package FileDaemon
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWorkerQueue(t *testing.T) {
+	var queue workerQueue
+	var sent []string
+	send := func(workerID string, msg []string) error {
+		if workerID == "dead" {
+			return errors.New("host unreachable")
+		}
+		sent = append(sent, workerID+":"+msg[0])
+		return nil
+	}
+
+	//requests wait for a worker
+	queue.queued = append(queue.queued, []string{"r1"}, []string{"r2"})
+	queue.dispatch(send)
+	if len(sent) != 0 {
+		t.Fatalf("dispatched %v with no idle workers", sent)
+	}
+
+	//a worker that has gone is dropped and its request goes to the next
+	queue.ready("dead")
+	queue.ready("1")
+	queue.dispatch(send)
+	if !reflect.DeepEqual(sent, []string{"1:r1"}) {
+		t.Fatalf("dispatched %v, want 1:r1", sent)
+	}
+
+	//a busy worker can't retire; it's left to ask again once idle
+	if queue.retire("1") {
+		t.Error("a worker with a request on its way retired")
+	}
+	queue.ready("1")
+	queue.ready("2")
+	queue.dispatch(send)
+	if !reflect.DeepEqual(sent, []string{"1:r1", "1:r2"}) {
+		t.Fatalf("dispatched %v, want 1:r1 then 1:r2", sent)
+	}
+
+	//an idle one can, and is never sent anything again
+	if !queue.retire("2") {
+		t.Fatal("an idle worker couldn't retire")
+	}
+	queue.queued = append(queue.queued, []string{"r3"})
+	queue.dispatch(send)
+	if len(sent) != 2 || len(queue.queued) != 1 {
+		t.Errorf("dispatched %v to a retired worker", sent[2:])
+	}
+}
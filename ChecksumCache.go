@@ -0,0 +1,243 @@
+package FileDaemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	checksumCacheBucket = "checksums"
+	//hits only refresh an entry's last use this often, so reads rarely need a write transaction
+	checksumCacheTouchInterval = time.Hour
+	//a file changed this recently may change again within the same timestamp, leaving nothing to tell the
+	// versions apart, so its digest isn't cached
+	checksumCacheSettleTime    = time.Second
+	checksumCachePruneInterval = time.Hour
+)
+
+//ChecksumCache remembers digests in a bbolt file, keyed by the file's device, inode and the range hashed. An entry
+// is only used while the file's size, mtime and ctime are what they were when it was hashed
+type ChecksumCache struct {
+	db *bolt.DB
+}
+
+type checksumCacheEntry struct {
+	Size   int64     `json:"size"`
+	Mtime  int64     `json:"mtime"`
+	Ctime  int64     `json:"ctime"`
+	Digest string    `json:"digest"`
+	Used   time.Time `json:"used"`
+}
+
+//fileIdentity is what has to match for a cached digest to still hold
+type fileIdentity struct {
+	dev, ino           uint64
+	size, mtime, ctime int64
+}
+
+func statIdentity(fi os.FileInfo) (identity fileIdentity, ok bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return fileIdentity{dev: uint64(stat.Dev), ino: uint64(stat.Ino), size: stat.Size,
+		mtime: stat.Mtim.Nano(), ctime: stat.Ctim.Nano()}, true
+}
+
+func (identity fileIdentity) key(algorithm string, offset, length int64) []byte {
+	return []byte(strconv.FormatUint(identity.dev, 10) + ":" + strconv.FormatUint(identity.ino, 10) + ":" +
+		algorithm + ":" + strconv.FormatInt(offset, 10) + ":" + strconv.FormatInt(length, 10))
+}
+
+func (identity fileIdentity) matches(entry checksumCacheEntry) bool {
+	return entry.Size == identity.size && entry.Mtime == identity.mtime && entry.Ctime == identity.ctime
+}
+
+//OpenChecksumCache opens, or creates, the cache file at path
+func OpenChecksumCache(path string) (cache *ChecksumCache, err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: jobStoreOpenTimeout})
+	if err != nil {
+		return nil, errors.New("Failed to open checksum cache " + path + ": " + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(checksumCacheBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.New("Failed to read checksum cache " + path + ": " + err.Error())
+	}
+
+	return &ChecksumCache{db: db}, nil
+}
+
+func (cache *ChecksumCache) Close() error {
+	if cache == nil {
+		return nil
+	}
+	return cache.db.Close()
+}
+
+//lookup returns the cached digest for the file, if there is one and the file hasn't changed since
+func (cache *ChecksumCache) lookup(identity fileIdentity, algorithm string, offset, length int64) (digest string, ok bool) {
+	key := identity.key(algorithm, offset, length)
+	var entry checksumCacheEntry
+	cache.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(checksumCacheBucket)).Get(key)
+		if value == nil {
+			return nil
+		}
+		if json.Unmarshal(value, &entry) == nil && identity.matches(entry) {
+			ok = true
+		}
+		return nil
+	})
+	if !ok {
+		return "", false
+	}
+	if time.Since(entry.Used) > checksumCacheTouchInterval {
+		entry.Used = time.Now()
+		cache.put(key, entry)
+	}
+
+	return entry.Digest, true
+}
+
+func (cache *ChecksumCache) store(identity fileIdentity, algorithm string, offset, length int64, digest string) error {
+	return cache.put(identity.key(algorithm, offset, length), checksumCacheEntry{Size: identity.size,
+		Mtime: identity.mtime, Ctime: identity.ctime, Digest: digest, Used: time.Now()})
+}
+
+func (cache *ChecksumCache) put(key []byte, entry checksumCacheEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return cache.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(checksumCacheBucket)).Put(key, encoded)
+	})
+}
+
+//prune drops entries that haven't been used for maxAge. Entries for deleted or rewritten files are never hit again,
+// so this is what keeps the cache from growing forever
+func (cache *ChecksumCache) prune(maxAge time.Duration) (pruned int, err error) {
+	cutoff := time.Now().Add(-maxAge)
+	err = cache.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(checksumCacheBucket)).Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var entry checksumCacheEntry
+			if json.Unmarshal(value, &entry) == nil && entry.Used.After(cutoff) {
+				continue
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return nil
+	})
+	return
+}
+
+//pruneChecksumCache drops cache entries past checksum.cache_expire_days. It runs in the background, once at a time
+func (server *Server) pruneChecksumCache() {
+	if !atomic.CompareAndSwapInt32(&server.pruningCache, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&server.pruningCache, 0)
+
+	pruned, err := server.checksumCache.prune(server.CurrentConfig().ChecksumCacheExpiry)
+	if err != nil {
+		server.Logger.Error("checksum", "failed to prune checksum cache", "error", err)
+	} else if pruned > 0 {
+		server.Logger.Info("checksum", "pruned checksum cache", "entries", pruned)
+	}
+}
+
+//checksumFile hashes filePath with each algorithm in a single read, returning hex digests in the same order.
+// With the cache enabled, digests of unchanged files come from it unless force is set, and only the algorithms it
+// is missing are computed
+func (worker *Worker) checksumFile(filePath string, algorithms []string, offset, length int64, force bool) (digests []string, err error) {
+	hashers := make([]hash.Hash, len(algorithms))
+	for i, algorithm := range algorithms {
+		if hashers[i], err = newChecksumHash(algorithm); err != nil {
+			return
+		}
+	}
+	digests = make([]string, len(algorithms))
+
+	cache := worker.Server.checksumCache
+	var identity fileIdentity
+	cacheable := false
+	if cache != nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(filePath); err != nil {
+			return
+		}
+		identity, cacheable = statIdentity(fi)
+		cacheable = cacheable && fi.Mode().IsRegular()
+	}
+
+	var writers []io.Writer
+	computed := make([]bool, len(algorithms))
+	for i, algorithm := range algorithms {
+		if cacheable && !force {
+			if digest, hit := cache.lookup(identity, algorithm, offset, length); hit {
+				digests[i] = digest
+				worker.Server.metrics.checksumCacheResult(true)
+				continue
+			}
+			worker.Server.metrics.checksumCacheResult(false)
+		}
+		writers = append(writers, hashers[i])
+		computed[i] = true
+	}
+	if len(writers) == 0 {
+		return
+	}
+	if err = hashFile(io.MultiWriter(writers...), filePath, offset, length); err != nil {
+		return
+	}
+	for i, hasher := range hashers {
+		if computed[i] {
+			digests[i] = hex.EncodeToString(hasher.Sum(nil))
+		}
+	}
+
+	if !cacheable || time.Since(time.Unix(0, identity.ctime)) < checksumCacheSettleTime {
+		return
+	}
+	//only remember the digests if the file stayed put while we read it
+	fi, statErr := os.Stat(filePath)
+	if statErr != nil {
+		return
+	}
+	if after, ok := statIdentity(fi); !ok || after != identity {
+		return
+	}
+	for i, algorithm := range algorithms {
+		if !computed[i] {
+			continue
+		}
+		if storeErr := cache.store(identity, algorithm, offset, length, digests[i]); storeErr != nil {
+			worker.logWarn("failed to cache checksum", "error", storeErr)
+			break
+		}
+	}
+
+	return
+}
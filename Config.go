@@ -0,0 +1,504 @@
+package FileDaemon
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	configPkg "github.com/zpatrick/go-config"
+)
+
+type Config struct {
+	//where the configuration was loaded from, so it can be reloaded. Empty when running on defaults
+	ConfigFile string
+
+	TimeStampFormat string
+	TimeZoneName string
+	TimeZone *time.Location
+
+	NumberOfWorkers int
+
+	RequestSocketFileName string
+	RequestSocketFile     string
+	WorkerSocketFileName  string
+	WorkerSocketFile      string
+
+	WorkerFailureTimeout int
+	WorkerFailureThreshold int
+
+	//seconds to wait for in-flight requests to finish when shutting down
+	ShutdownTimeout int
+
+	MessageDelimiter string
+	LogFile, ErrorLogFile string
+	//logfmt or json
+	LogFormat string
+	LogLevel LogLevel
+	//overrides of LogLevel for individual components, such as a command name or "worker"
+	LogComponentLevels map[string]LogLevel
+	//rotate log files once they pass this many megabytes, keeping LogMaxBackups old files. 0 disables rotation
+	LogMaxSize, LogMaxBackups int
+
+	//named permission sets accepted by chmod, keyed by name
+	ChmodProfiles map[string]ChmodProfile
+	//when set, every path a request touches must live beneath one of these directories
+	AllowedRoots []string
+	//extended attribute namespaces the xattr commands may read and change
+	XattrNamespaces []string
+
+	//where to serve Prometheus metrics: host:port, unix:/path, or empty for no listener
+	MetricsListen string
+
+	//when enabled, chmod and chown record what they change and rm moves things to a trash directory, so "undo" can
+	// put them back until TrashRetention has passed
+	JournalEnabled bool
+	JournalDir     string
+	//name of the trash directory made at the root of each volume we remove things from
+	TrashDirName   string
+	TrashRetention time.Duration
+
+	//bbolt file recording long-running jobs so ones cut short can be resumed. Empty disables it
+	JobsStateFile string
+	JobCheckpointInterval time.Duration
+	//carry on with interrupted jobs when the daemon starts
+	ResumeJobs bool
+
+	//the most an extract may write, so a compression bomb can't fill the volume. 0 is no limit
+	ExtractMaxBytes   int64
+	ExtractMaxEntries int
+
+	//bbolt file caching digests of unchanged files. Empty disables it
+	ChecksumCacheFile string
+	//entries not used for this long are dropped
+	ChecksumCacheExpiry time.Duration
+}
+
+const (
+	CONFIG_PROFILES_SECTION = "profiles."
+	CONFIG_LIST_SEP         = ","
+)
+
+func LoadConfiguration(configFile string) (*Config, error) {
+	defaultSettings := map[string]string{
+		"server.timezone": "America/Chicago",
+		"server.timestamp_format": "01/02/06 15:04:05.000",
+		"server.shutdown_timeout": "30",
+		"request.socket_file": "/tmp/fd_odc_ws.sock",
+		"request.message_delimiter": "|",
+		"workers.number": "5",
+		"workers.socket_name": "workers",
+		"workers.failure_timeout": "5",
+		"workers.failure_threshold": "5",
+		"log.file": "stdout",
+		"log.error_log": "stderr",
+		"log.format": LOG_FORMAT_LOGFMT,
+		"log.level": "info",
+		"log.levels": "",
+		"log.max_size": "0",
+		"log.max_backups": "5",
+		"policy.allowed_roots": "",
+		"policy.xattr_namespaces": XATTR_NAMESPACE_USER,
+		"metrics.listen": "",
+		"journal.enabled": "false",
+		"journal.dir": "/var/lib/filedaemon/journal",
+		"journal.trash_dir": ".filedaemon-trash",
+		"journal.retention_hours": "168",
+		"jobs.state_file": "",
+		"jobs.checkpoint_seconds": "5",
+		"jobs.resume": "false",
+		"extract.max_megabytes": "10240",
+		"extract.max_entries": "1000000",
+		"checksum.cache_file": "",
+		"checksum.cache_expire_days": "30",
+	}
+	defaults := configPkg.NewStatic(defaultSettings)
+	providers := []configPkg.Provider{defaults}//defaults first so they get overriden
+
+	var iniFile *configPkg.INIFile
+	if configFile != "" {
+		if _, err := os.Stat(configFile) ; os.IsNotExist(err) {
+			return nil, errors.New("Configuration File does not exist: " + configFile)
+		}
+		iniFile = configPkg.NewINIFile(configFile)
+		providers = append(providers, iniFile)
+	}
+
+	config := configPkg.NewConfig(providers)
+	if err := config.Load(); err != nil {
+		return nil, errors.New("Error loading config : " + err.Error())
+	}
+
+	var err error
+	var errs []string
+	sCon := Config{ConfigFile: configFile}
+
+	if sCon.TimeZoneName, err = config.String("server.timezone"); err != nil {
+		errs = append(errs, err.Error())
+	} else { //if timezone name is defined load it
+		tz, err := time.LoadLocation(sCon.TimeZoneName)
+		if err != nil { //alert on invalid timezones
+			errs = append(errs, err.Error())
+		} else {
+			sCon.TimeZone = tz
+		}
+	}
+	if sCon.TimeStampFormat, err = config.String("server.timestamp_format"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.ShutdownTimeout, err = config.Int("server.shutdown_timeout"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.ShutdownTimeout < 0 {
+		errs = append(errs, "server.shutdown_timeout cannot be negative")
+	}
+	if sCon.RequestSocketFileName, err = config.String("request.socket_file"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.MessageDelimiter, err = config.String("request.message_delimiter"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.NumberOfWorkers, err = config.Int("workers.number"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.NumberOfWorkers < 1 {
+		errs = append(errs, "workers.number must be at least 1")
+	}
+	if sCon.WorkerSocketFileName, err = config.String("workers.socket_name"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.WorkerFailureTimeout, err = config.Int("workers.failure_timeout"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.WorkerFailureThreshold, err = config.Int("workers.failure_threshold"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.LogFile, err = config.String("log.file"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.ErrorLogFile, err = config.String("log.error_log"); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if sCon.LogFormat, err = config.String("log.format"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.LogFormat != LOG_FORMAT_LOGFMT && sCon.LogFormat != LOG_FORMAT_JSON {
+		errs = append(errs, "log.format must be "+LOG_FORMAT_LOGFMT+" or "+LOG_FORMAT_JSON)
+	}
+	if level, err := config.String("log.level"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.LogLevel, err = ParseLogLevel(level); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if levels, err := config.String("log.levels"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.LogComponentLevels, err = parseComponentLevels(levels); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.LogMaxSize, err = config.Int("log.max_size"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.LogMaxBackups, err = config.Int("log.max_backups"); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if sCon.MetricsListen, err = config.String("metrics.listen"); err != nil {
+		errs = append(errs, err.Error())
+	} else if err = checkMetricsListen(sCon.MetricsListen); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if sCon.JournalEnabled, err = config.Bool("journal.enabled"); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if sCon.JournalDir, err = config.String("journal.dir"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.JournalEnabled && !filepath.IsAbs(sCon.JournalDir) {
+		errs = append(errs, "journal.dir must be an absolute path")
+	}
+	if sCon.TrashDirName, err = config.String("journal.trash_dir"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.TrashDirName == "" || strings.ContainsRune(sCon.TrashDirName, os.PathSeparator) {
+		errs = append(errs, "journal.trash_dir must be a plain directory name")
+	}
+	if retention, err := config.Int("journal.retention_hours"); err != nil {
+		errs = append(errs, err.Error())
+	} else if retention < 1 {
+		errs = append(errs, "journal.retention_hours must be at least 1")
+	} else {
+		sCon.TrashRetention = time.Duration(retention) * time.Hour
+	}
+
+	if sCon.JobsStateFile, err = config.String("jobs.state_file"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.JobsStateFile != "" && !filepath.IsAbs(sCon.JobsStateFile) {
+		errs = append(errs, "jobs.state_file must be an absolute path")
+	}
+	if seconds, err := config.Int("jobs.checkpoint_seconds"); err != nil {
+		errs = append(errs, err.Error())
+	} else if seconds < 1 {
+		errs = append(errs, "jobs.checkpoint_seconds must be at least 1")
+	} else {
+		sCon.JobCheckpointInterval = time.Duration(seconds) * time.Second
+	}
+	if sCon.ResumeJobs, err = config.Bool("jobs.resume"); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if megabytes, err := config.Int("extract.max_megabytes"); err != nil {
+		errs = append(errs, err.Error())
+	} else if megabytes < 0 {
+		errs = append(errs, "extract.max_megabytes can't be negative")
+	} else {
+		sCon.ExtractMaxBytes = int64(megabytes) << 20
+	}
+	if sCon.ExtractMaxEntries, err = config.Int("extract.max_entries"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.ExtractMaxEntries < 0 {
+		errs = append(errs, "extract.max_entries can't be negative")
+	}
+
+	if sCon.ChecksumCacheFile, err = config.String("checksum.cache_file"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.ChecksumCacheFile != "" && !filepath.IsAbs(sCon.ChecksumCacheFile) {
+		errs = append(errs, "checksum.cache_file must be an absolute path")
+	}
+	if days, err := config.Int("checksum.cache_expire_days"); err != nil {
+		errs = append(errs, err.Error())
+	} else if days < 1 {
+		errs = append(errs, "checksum.cache_expire_days must be at least 1")
+	} else {
+		sCon.ChecksumCacheExpiry = time.Duration(days) * 24 * time.Hour
+	}
+
+	if roots, err := config.String("policy.allowed_roots"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.AllowedRoots, err = parseAllowedRoots(roots); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if namespaces, err := config.String("policy.xattr_namespaces"); err != nil {
+		errs = append(errs, err.Error())
+	} else if sCon.XattrNamespaces, err = parseXattrNamespaces(namespaces); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	//profiles are free-form "name = mode" entries, so we read them straight from the file
+	profileSpecs := make(map[string]string)
+	if iniFile != nil {
+		settings, err := iniFile.Load()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for key, spec := range settings {
+			if strings.HasPrefix(key, CONFIG_PROFILES_SECTION) {
+				profileSpecs[strings.TrimPrefix(key, CONFIG_PROFILES_SECTION)] = spec
+			}
+		}
+	}
+	if sCon.ChmodProfiles, err = loadChmodProfiles(profileSpecs); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	//finish socket paths
+	//request socket is UDS
+	sCon.RequestSocketFile = "ipc://" + sCon.RequestSocketFileName
+	//worker socket is inproc
+	sCon.WorkerSocketFile = "inproc://" + sCon.WorkerSocketFileName
+
+	if len(errs) > 0 {
+		err = errors.New("invalid configuration:\n\t" +
+			strings.Join(errs, "\n\t"))
+	} else {
+		err = nil
+	}
+
+	return &sCon, err
+}
+
+//parseAllowedRoots splits the policy.allowed_roots list into clean, absolute, symlink-free directories
+func parseAllowedRoots(roots string) (allowed []string, err error) {
+	for _, root := range strings.Split(roots, CONFIG_LIST_SEP) {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			return nil, errors.New("policy.allowed_roots entry is not absolute: " + root)
+		}
+		allowed = append(allowed, resolvePath(root))
+	}
+
+	return
+}
+
+//checkMetricsListen catches a metrics.listen that could never be listened on. Whether it's free is only known once
+// the server tries
+func checkMetricsListen(address string) error {
+	if address == "" {
+		return nil
+	}
+	if strings.HasPrefix(address, METRICS_UNIX_PREFIX) {
+		if !filepath.IsAbs(strings.TrimPrefix(address, METRICS_UNIX_PREFIX)) {
+			return errors.New("metrics.listen unix socket must be an absolute path: " + address)
+		}
+		return nil
+	}
+	//without resolving the host, which can wait on DNS and may well be the only thing that's down
+	_, port, err := net.SplitHostPort(address)
+	if err == nil {
+		_, err = net.LookupPort("tcp", port)
+	}
+	if err != nil {
+		return errors.New("metrics.listen is not host:port or unix:/path: " + err.Error())
+	}
+
+	return nil
+}
+
+//parseXattrNamespaces reads the policy.xattr_namespaces list. system is never allowed, as it holds the ACLs that
+// chmod manages
+func parseXattrNamespaces(namespaces string) (allowed []string, err error) {
+	for _, namespace := range strings.Split(namespaces, CONFIG_LIST_SEP) {
+		namespace = strings.TrimSpace(namespace)
+		switch namespace {
+		case "":
+			continue
+		case XATTR_NAMESPACE_USER, XATTR_NAMESPACE_TRUSTED, XATTR_NAMESPACE_SECURITY:
+			allowed = append(allowed, namespace)
+		default:
+			return nil, errors.New("policy.xattr_namespaces entry is not user, trusted or security: " + namespace)
+		}
+	}
+
+	return
+}
+
+//parseComponentLevels reads the log.levels list, e.g. "worker=debug,chmod=warn"
+func parseComponentLevels(levels string) (map[string]LogLevel, error) {
+	componentLevels := make(map[string]LogLevel)
+	for _, entry := range strings.Split(levels, CONFIG_LIST_SEP) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, LOG_COMPONENT_LEVEL_SEP, 2)
+		if len(parts) != 2 {
+			return nil, errors.New("log.levels entry is not component=level: " + entry)
+		}
+		level, err := ParseLogLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		componentLevels[strings.TrimSpace(parts[0])] = level
+	}
+
+	return componentLevels, nil
+}
+
+//reloadChanges compares a freshly loaded configuration against the running one.
+// Settings that can only take effect on restart are copied back onto newConfig so the running values stay in force
+func (config *Config) reloadChanges(newConfig *Config) (applied, restart []string) {
+	if config.RequestSocketFileName != newConfig.RequestSocketFileName {
+		restart = append(restart, "request.socket_file")
+		newConfig.RequestSocketFileName = config.RequestSocketFileName
+		newConfig.RequestSocketFile = config.RequestSocketFile
+	}
+	if config.MessageDelimiter != newConfig.MessageDelimiter {
+		restart = append(restart, "request.message_delimiter")
+		newConfig.MessageDelimiter = config.MessageDelimiter
+	}
+	if config.WorkerSocketFileName != newConfig.WorkerSocketFileName {
+		restart = append(restart, "workers.socket_name")
+		newConfig.WorkerSocketFileName = config.WorkerSocketFileName
+		newConfig.WorkerSocketFile = config.WorkerSocketFile
+	}
+	if config.MetricsListen != newConfig.MetricsListen {
+		restart = append(restart, "metrics.listen")
+		newConfig.MetricsListen = config.MetricsListen
+	}
+	if config.JobsStateFile != newConfig.JobsStateFile {
+		restart = append(restart, "jobs.state_file")
+		newConfig.JobsStateFile = config.JobsStateFile
+	}
+	if config.JobCheckpointInterval != newConfig.JobCheckpointInterval {
+		restart = append(restart, "jobs.checkpoint_seconds")
+		newConfig.JobCheckpointInterval = config.JobCheckpointInterval
+	}
+	if config.ChecksumCacheFile != newConfig.ChecksumCacheFile {
+		restart = append(restart, "checksum.cache_file")
+		newConfig.ChecksumCacheFile = config.ChecksumCacheFile
+	}
+
+	if config.TimeZoneName != newConfig.TimeZoneName {
+		applied = append(applied, "server.timezone")
+	}
+	if config.TimeStampFormat != newConfig.TimeStampFormat {
+		applied = append(applied, "server.timestamp_format")
+	}
+	if config.ShutdownTimeout != newConfig.ShutdownTimeout {
+		applied = append(applied, "server.shutdown_timeout")
+	}
+	if config.NumberOfWorkers != newConfig.NumberOfWorkers {
+		applied = append(applied, "workers.number")
+	}
+	if config.WorkerFailureTimeout != newConfig.WorkerFailureTimeout {
+		applied = append(applied, "workers.failure_timeout")
+	}
+	if config.WorkerFailureThreshold != newConfig.WorkerFailureThreshold {
+		applied = append(applied, "workers.failure_threshold")
+	}
+	if config.LogFile != newConfig.LogFile {
+		applied = append(applied, "log.file")
+	}
+	if config.ErrorLogFile != newConfig.ErrorLogFile {
+		applied = append(applied, "log.error_log")
+	}
+	if config.LogFormat != newConfig.LogFormat {
+		applied = append(applied, "log.format")
+	}
+	if config.LogLevel != newConfig.LogLevel {
+		applied = append(applied, "log.level")
+	}
+	if !reflect.DeepEqual(config.LogComponentLevels, newConfig.LogComponentLevels) {
+		applied = append(applied, "log.levels")
+	}
+	if config.LogMaxSize != newConfig.LogMaxSize {
+		applied = append(applied, "log.max_size")
+	}
+	if config.LogMaxBackups != newConfig.LogMaxBackups {
+		applied = append(applied, "log.max_backups")
+	}
+	if !reflect.DeepEqual(config.ChmodProfiles, newConfig.ChmodProfiles) {
+		applied = append(applied, "profiles")
+	}
+	if !reflect.DeepEqual(config.AllowedRoots, newConfig.AllowedRoots) {
+		applied = append(applied, "policy.allowed_roots")
+	}
+	if !reflect.DeepEqual(config.XattrNamespaces, newConfig.XattrNamespaces) {
+		applied = append(applied, "policy.xattr_namespaces")
+	}
+	if config.JournalEnabled != newConfig.JournalEnabled {
+		applied = append(applied, "journal.enabled")
+	}
+	if config.JournalDir != newConfig.JournalDir {
+		applied = append(applied, "journal.dir")
+	}
+	if config.TrashDirName != newConfig.TrashDirName {
+		applied = append(applied, "journal.trash_dir")
+	}
+	if config.TrashRetention != newConfig.TrashRetention {
+		applied = append(applied, "journal.retention_hours")
+	}
+	if config.ExtractMaxBytes != newConfig.ExtractMaxBytes {
+		applied = append(applied, "extract.max_megabytes")
+	}
+	if config.ExtractMaxEntries != newConfig.ExtractMaxEntries {
+		applied = append(applied, "extract.max_entries")
+	}
+	if config.ChecksumCacheExpiry != newConfig.ChecksumCacheExpiry {
+		applied = append(applied, "checksum.cache_expire_days")
+	}
+
+	return
+}
@@ -0,0 +1,27 @@
+package FileDaemon
+
+import "testing"
+
+func TestCheckMetricsListen(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: ""},
+		{address: "127.0.0.1:9100"},
+		{address: "localhost:9100"},
+		{address: "[::1]:9100"},
+		{address: ":9100"},
+		{address: "unix:/run/filedaemon/metrics.sock"},
+		{address: "127.0.0.1", wantErr: true},
+		{address: "127.0.0.1:notaport", wantErr: true},
+		{address: "127.0.0.1:70000", wantErr: true},
+		{address: "unix:metrics.sock", wantErr: true},
+	}
+
+	for _, test := range tests {
+		if err := checkMetricsListen(test.address); (err != nil) != test.wantErr {
+			t.Errorf("checkMetricsListen(%q) = %v, want error %v", test.address, err, test.wantErr)
+		}
+	}
+}
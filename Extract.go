@@ -0,0 +1,422 @@
+package FileDaemon
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+//directories an archive has no entry for, but which its entries sit in, get this mode
+const EXTRACT_IMPLIED_DIR_MODE = 0755
+
+//archiveEntry is one entry read from an archive, whatever its format
+type archiveEntry struct {
+	name string
+	//the type and permission bits
+	mode os.FileMode
+	//a symlink's target, or the name of the entry a hard link shares its content with
+	link     string
+	hardLink bool
+	modTime  time.Time
+}
+
+//extractTarget is the directory an extract writes into, and what it does to everything it creates there
+type extractTarget struct {
+	worker *Worker
+	job    *Job
+	dir    string
+	//dir with its symlinks resolved, which every path created has to stay within
+	root     string
+	uid, gid int
+	profile  *ChmodProfile
+	result   ArchiveResult
+	progress WorkerProgress
+	//extract.max_megabytes and extract.max_entries as the extract started, and the entries read so far
+	maxBytes   int64
+	maxEntries int
+	read       int
+}
+
+//doExtract unpacks an archive into an existing directory: extract|format|src|dst[|owner=user[:group]][|profile=name],
+// with format tar, tar.gz, tar.zst or zip. Entries that would land outside dst, by an absolute or .. name or through
+// a symlink, fail the extract, as do symlinks pointing outside it and entries that already exist; directories are
+// merged. Everything created gets the ACL of its directory, then the archive's permissions without setuid, setgid or
+// sticky bits, then the profile and owner when given; otherwise the daemon owns it. Devices and other special files
+// are skipped. An archive past extract.max_megabytes of content or extract.max_entries entries fails the extract.
+// A failed extract leaves what it had extracted. Progress shows up in status while it runs.
+// Replies with an ArchiveResult as JSON
+func (worker *Worker) doExtract(params []string) (reply []string, err error) {
+	if len(params) < EXTRACT_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to extract. Expected at least " +
+			strconv.Itoa(EXTRACT_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	format := params[EXTRACT_PARAM_FORMAT_IDX]
+	srcPath := params[EXTRACT_PARAM_SRCPATH_IDX]
+	dstPath := filepath.Clean(params[EXTRACT_PARAM_DSTPATH_IDX])
+	if err = checkArchiveFormat(format); err != nil {
+		return
+	}
+	options, err := parseOptions("extract", params[EXTRACT_PARAM_OPTIONS_IDX:], "owner", "profile")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(srcPath, dstPath); err != nil {
+		return
+	}
+	if fi, statErr := os.Stat(dstPath); statErr != nil {
+		return nil, statErr
+	} else if !fi.IsDir() {
+		return nil, errors.New("extract destination must be a directory: " + dstPath)
+	}
+	config := worker.Server.CurrentConfig()
+	target := &extractTarget{worker: worker, dir: dstPath, root: resolvePath(dstPath), maxBytes: config.ExtractMaxBytes,
+		maxEntries: config.ExtractMaxEntries}
+	if target.uid, target.gid, target.profile, err = worker.ownerAndProfile(options); err != nil {
+		return
+	}
+
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	target.progress.TotalBytes = fi.Size()
+
+	target.job = worker.startJob("extract", params, false)
+	if format == ARCHIVE_FORMAT_ZIP {
+		err = target.extractZip(file, fi.Size())
+	} else {
+		err = target.extractTar(format, file)
+	}
+	worker.finishJob(target.job)
+	worker.Server.metrics.addEntriesWalked("extract", int(target.result.Entries+target.result.Skipped))
+	if err != nil {
+		return
+	}
+
+	encoded, err := worker.jsonReply(target.result)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//countingReader counts the bytes read through it, so progress through a compressed stream can be told
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+func (target *extractTarget) extractTar(format string, file io.Reader) error {
+	counter := &countingReader{reader: file}
+	var stream io.Reader = counter
+	switch format {
+	case ARCHIVE_FORMAT_TAR_GZ:
+		decompressor, err := gzip.NewReader(counter)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		stream = decompressor
+	case ARCHIVE_FORMAT_TAR_ZST:
+		decompressor, err := zstd.NewReader(counter)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		stream = decompressor
+	}
+
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		entry := archiveEntry{name: header.Name, mode: os.FileMode(header.Mode).Perm(), link: header.Linkname,
+			modTime: header.ModTime}
+		//the type flag decides what an entry is; anything else, like a device, is skipped
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeDir:
+			entry.mode |= os.ModeDir
+		case tar.TypeSymlink:
+			entry.mode |= os.ModeSymlink
+		case tar.TypeLink:
+			entry.hardLink = true
+		default:
+			entry.mode |= os.ModeIrregular
+		}
+		filePath, err := target.extract(entry, reader)
+		if err != nil {
+			return err
+		}
+		target.reportProgress(filePath, counter.count)
+	}
+}
+
+func (target *extractTarget) extractZip(file io.ReaderAt, size int64) error {
+	reader, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	var read int64
+	for _, zipFile := range reader.File {
+		entry := archiveEntry{name: zipFile.Name, mode: zipFile.Mode(), modTime: zipFile.Modified}
+		content, err := zipFile.Open()
+		if err != nil {
+			return err
+		}
+		if entry.mode&os.ModeSymlink != 0 {
+			//zip keeps a symlink's target as its content
+			link, readErr := io.ReadAll(io.LimitReader(content, ARCHIVE_MAX_LINK_LENGTH+1))
+			if readErr == nil && len(link) > ARCHIVE_MAX_LINK_LENGTH {
+				readErr = errors.New("symlink target of " + zipFile.Name + " is too long")
+			}
+			if readErr != nil {
+				content.Close()
+				return readErr
+			}
+			entry.link = string(link)
+		}
+		filePath, err := target.extract(entry, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+		read += int64(zipFile.CompressedSize64)
+		target.reportProgress(filePath, read)
+	}
+
+	return nil
+}
+
+//extract creates one entry, reading a regular file's content from content, and returns where it went
+func (target *extractTarget) extract(entry archiveEntry, content io.Reader) (filePath string, err error) {
+	target.read++
+	if target.maxEntries > 0 && target.read > target.maxEntries {
+		return "", errors.New("archive has more than extract.max_entries " + strconv.Itoa(target.maxEntries) +
+			" entries")
+	}
+	if filePath, err = target.path(entry.name); err != nil {
+		return
+	}
+	if filePath == target.dir {
+		//the ./ entry of an archive made from inside a directory
+		return
+	}
+	if err = target.makeParents(filePath); err != nil {
+		return
+	}
+
+	switch {
+	case entry.hardLink:
+		linkPath, pathErr := target.path(entry.link)
+		if pathErr != nil {
+			return "", pathErr
+		}
+		if err = os.Link(linkPath, filePath); err != nil {
+			return
+		}
+		//a hard link shares what its other name was given
+		target.result.Entries++
+		return
+	case entry.mode&os.ModeSymlink != 0:
+		refused := errors.New("refusing to extract " + entry.name + ", its link leads outside the destination")
+		if filepath.IsAbs(entry.link) {
+			return "", refused
+		}
+		//the link is judged by where it resolves on disk, so it is made under a temporary name first
+		tempPath := target.worker.tempSibling(filePath)
+		if err = os.Symlink(entry.link, tempPath); err != nil {
+			return
+		}
+		if !target.linkInside(tempPath, entry.link) {
+			os.Remove(tempPath)
+			return "", refused
+		}
+		if err = unix.Renameat2(unix.AT_FDCWD, tempPath, unix.AT_FDCWD, filePath, unix.RENAME_NOREPLACE); err != nil {
+			os.Remove(tempPath)
+			return
+		}
+		if target.uid != -1 {
+			if err = os.Lchown(filePath, target.uid, target.gid); err != nil {
+				return
+			}
+		}
+		target.result.Entries++
+		return
+	case entry.mode.IsDir():
+		if fi, statErr := os.Lstat(filePath); statErr == nil && fi.IsDir() {
+			return
+		}
+		if err = os.Mkdir(filePath, 0700); err != nil {
+			return
+		}
+	case entry.mode.IsRegular():
+		file, openErr := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if openErr != nil {
+			return "", openErr
+		}
+		if target.maxBytes > 0 {
+			//a byte past what's left is enough to tell the limit was hit
+			content = io.LimitReader(content, target.maxBytes-target.result.Bytes+1)
+		}
+		n, copyErr := io.Copy(file, content)
+		target.result.Bytes += n
+		if closeErr := file.Close(); copyErr == nil {
+			copyErr = closeErr
+		}
+		if copyErr == nil && target.maxBytes > 0 && target.result.Bytes > target.maxBytes {
+			//the entry that crossed the limit isn't all there, so don't leave it looking extracted
+			os.Remove(filePath)
+			copyErr = errors.New("archive holds more than extract.max_megabytes " +
+				strconv.FormatInt(target.maxBytes>>20, 10) + "MB of file content")
+		}
+		if copyErr != nil {
+			return "", copyErr
+		}
+	default:
+		target.result.Skipped++
+		return
+	}
+
+	if err = target.finish(filePath, entry.mode.Perm(), entry.mode.IsDir()); err != nil {
+		return
+	}
+	if !entry.mode.IsDir() && !entry.modTime.IsZero() {
+		if err = os.Chtimes(filePath, entry.modTime, entry.modTime); err != nil {
+			return
+		}
+	}
+	target.result.Entries++
+
+	return
+}
+
+//path turns an entry's name into where it goes, refusing names that climb out of the destination. Anything in the
+// way, such as an extracted symlink, is caught when the path is resolved
+func (target *extractTarget) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) {
+		return "", errors.New("refusing to extract " + name + ", it leads outside the destination")
+	}
+	filePath := filepath.Join(target.dir, clean)
+	if !target.inside(filePath) {
+		return "", errors.New("refusing to extract " + name + ", it leads outside the destination")
+	}
+
+	return filePath, nil
+}
+
+//inside reports whether filePath, with any symlinks in it resolved, stays within the destination and the policy
+func (target *extractTarget) inside(filePath string) bool {
+	resolved := resolvePath(filePath)
+	if resolved != target.root && !strings.HasPrefix(resolved, target.root+string(os.PathSeparator)) {
+		return false
+	}
+	return target.worker.Server.CurrentConfig().AllowsPath(filePath)
+}
+
+//linkInside reports whether the symlink at linkPath, holding link, resolves within the destination and the policy.
+// A link whose target doesn't exist yet can only be judged by its text, so it mustn't have .. in it: the kernel
+// applies .. after following whatever symlinks come before it, which the text can't show
+func (target *extractTarget) linkInside(linkPath, link string) bool {
+	resolved, err := filepath.EvalSymlinks(linkPath)
+	if err == nil {
+		if resolved != target.root && !strings.HasPrefix(resolved, target.root+string(os.PathSeparator)) {
+			return false
+		}
+		return target.worker.Server.CurrentConfig().AllowsPath(resolved)
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(link), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return target.inside(filepath.Join(filepath.Dir(linkPath), link))
+}
+
+//makeParents creates the directories above filePath that the archive has no entries for, the way it would have
+func (target *extractTarget) makeParents(filePath string) error {
+	var missing []string
+	for dir := filepath.Dir(filePath); dir != target.dir; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0700); err != nil {
+			return err
+		}
+		if err := target.finish(missing[i], EXTRACT_IMPLIED_DIR_MODE, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//finish gives something just created its directory's ACL, then its permissions, then the profile and owner. The
+// permissions go after the ACL, as setting an NFSv4 ACL rewrites the mode bits
+func (target *extractTarget) finish(filePath string, perms os.FileMode, isDir bool) error {
+	if err := target.worker.inheritACL(filePath, false); err != nil {
+		return err
+	}
+	if err := os.Chmod(filePath, perms); err != nil {
+		return err
+	}
+	if profile := target.profile; profile != nil {
+		notNFS4 := false
+		if _, err := target.worker.executeChmod(filePath, profile.Additive, profile.OctalPerms, profile.EveryoneMask,
+			profile.GroupMask, profile.OwnerMask, isDir, &notNFS4, nil); err != nil {
+			return err
+		}
+	}
+	if target.uid != -1 {
+		return os.Chown(filePath, target.uid, target.gid)
+	}
+
+	return nil
+}
+
+//reportProgress updates status, and the job record when there is one, after an entry
+func (target *extractTarget) reportProgress(filePath string, read int64) {
+	target.progress.Entries = target.result.Entries
+	target.progress.Bytes = read
+	target.worker.setProgress(target.progress)
+	if filePath != "" {
+		target.job.checkpoint(filePath)
+	}
+}
@@ -0,0 +1,293 @@
+package FileDaemon
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//testWorker gives tests a worker whose policy only allows root
+func testWorker(t *testing.T, root string) *Worker {
+	t.Helper()
+	profiles, err := loadChmodProfiles(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		config: &Config{MessageDelimiter: "|", AllowedRoots: []string{resolvePath(root)}, ChmodProfiles: profiles,
+			XattrNamespaces: []string{XATTR_NAMESPACE_USER}},
+		Logger: NewLogger(func() string { return "" }),
+	}
+	server.metrics = NewMetrics(server)
+	worker := &Worker{Server: server}
+	worker.setRequest("test", "t1")
+	return worker
+}
+
+//testEntry is an archive entry to build: a file with content, a directory (name ending in /), a symlink or a hard
+// link
+type testEntry struct {
+	name, content, symlink, hardLink string
+}
+
+func writeTestTar(t *testing.T, archivePath string, entries []testEntry) {
+	t.Helper()
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		switch {
+		case strings.HasSuffix(entry.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		case entry.symlink != "":
+			header.Typeflag, header.Linkname = tar.TypeSymlink, entry.symlink
+		case entry.hardLink != "":
+			header.Typeflag, header.Linkname = tar.TypeLink, entry.hardLink
+		}
+		if err = writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err = writer.Write([]byte(entry.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//writeTestZip builds a zip from entries, leaving out hard links, which zip has no way to store
+func writeTestZip(t *testing.T, archivePath string, entries []testEntry) {
+	t.Helper()
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	for _, entry := range entries {
+		if entry.hardLink != "" {
+			continue
+		}
+		header := &zip.FileHeader{Name: entry.name}
+		content := entry.content
+		switch {
+		case strings.HasSuffix(entry.name, "/"):
+			header.SetMode(os.ModeDir | 0755)
+		case entry.symlink != "":
+			header.SetMode(os.ModeSymlink | 0777)
+			content = entry.symlink
+		default:
+			header.SetMode(0644)
+		}
+		entryWriter, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = entryWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		//set up the destination before extracting into it
+		prepare func(t *testing.T, dst, outside string)
+		wantErr bool
+		//paths under dst that must not exist afterwards
+		absent  []string
+		tarOnly bool
+	}{
+		{name: "plain", entries: []testEntry{{name: "d/"}, {name: "d/f", content: "x"}, {name: "l", symlink: "d/f"}}},
+		{name: "absolute name", entries: []testEntry{{name: "/abs", content: "x"}}, wantErr: true},
+		{name: "dot dot name", entries: []testEntry{{name: "../escape", content: "x"}}, wantErr: true},
+		{name: "dot dot inside name", entries: []testEntry{{name: "d/../../escape", content: "x"}}, wantErr: true},
+		{name: "absolute symlink", entries: []testEntry{{name: "l", symlink: "/etc"}}, wantErr: true,
+			absent: []string{"l"}},
+		{name: "dot dot symlink", entries: []testEntry{{name: "l", symlink: "../outside"}}, wantErr: true,
+			absent: []string{"l"}},
+		{name: "symlink then dot dot through it", entries: []testEntry{{name: "s", symlink: "."},
+			{name: "t", symlink: "s/.."}}, wantErr: true, absent: []string{"t"}},
+		{name: "dangling symlink with dot dot", entries: []testEntry{{name: "l", symlink: "missing/../.."}},
+			wantErr: true, absent: []string{"l"}},
+		{name: "write through existing symlink",
+			prepare: func(t *testing.T, dst, outside string) {
+				if err := os.Symlink(outside, filepath.Join(dst, "pre")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: []testEntry{{name: "pre/x", content: "x"}}, wantErr: true},
+		{name: "hard link outside", entries: []testEntry{{name: "h", hardLink: "../outside/secret"}}, wantErr: true,
+			absent: []string{"h"}, tarOnly: true},
+		{name: "hard link through symlink", entries: []testEntry{{name: "s", symlink: "."},
+			{name: "h", hardLink: "s/../outside/secret"}}, wantErr: true, absent: []string{"h"}, tarOnly: true},
+		{name: "existing file",
+			prepare: func(t *testing.T, dst, outside string) {
+				if err := os.WriteFile(filepath.Join(dst, "f"), []byte("keep"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: []testEntry{{name: "f", content: "x"}}, wantErr: true},
+		{name: "existing directory merged",
+			prepare: func(t *testing.T, dst, outside string) {
+				if err := os.Mkdir(filepath.Join(dst, "d"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: []testEntry{{name: "d/"}, {name: "d/f", content: "x"}}},
+	}
+
+	for _, format := range []string{ARCHIVE_FORMAT_TAR, ARCHIVE_FORMAT_ZIP} {
+		for _, test := range tests {
+			if test.tarOnly && format != ARCHIVE_FORMAT_TAR {
+				continue
+			}
+			t.Run(format+"/"+test.name, func(t *testing.T) {
+				root := t.TempDir()
+				dst := filepath.Join(root, "dst")
+				outside := filepath.Join(root, "outside")
+				for _, dir := range []string{dst, outside} {
+					if err := os.Mkdir(dir, 0755); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if test.prepare != nil {
+					test.prepare(t, dst, outside)
+				}
+				archivePath := filepath.Join(root, "test."+format)
+				if format == ARCHIVE_FORMAT_ZIP {
+					writeTestZip(t, archivePath, test.entries)
+				} else {
+					writeTestTar(t, archivePath, test.entries)
+				}
+
+				//only dst is allowed, so anything landing beside it would break the policy too
+				worker := testWorker(t, root)
+				_, err := worker.doExtract([]string{format, archivePath, dst})
+				if (err != nil) != test.wantErr {
+					t.Fatalf("extract error = %v, want error %v", err, test.wantErr)
+				}
+				for _, name := range test.absent {
+					if _, statErr := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(statErr) {
+						t.Errorf("%s exists after a refused extract", name)
+					}
+				}
+				entries, err := os.ReadDir(outside)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != 1 {
+					t.Errorf("outside directory changed: %d entries", len(entries))
+				}
+				leftovers, _ := filepath.Glob(filepath.Join(dst, ".*.fd-*"))
+				if len(leftovers) != 0 {
+					t.Errorf("temporary links left behind: %v", leftovers)
+				}
+				if _, statErr := os.Stat(filepath.Join(root, "escape")); !os.IsNotExist(statErr) {
+					t.Error("an entry escaped the destination")
+				}
+			})
+		}
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	entries := []testEntry{{name: "d/"}, {name: "d/a", content: "12345"}, {name: "d/b", content: "67890"}}
+	tests := []struct {
+		name       string
+		maxBytes   int64
+		maxEntries int
+		wantErr    bool
+	}{
+		{name: "no limits"},
+		{name: "within both", maxBytes: 10, maxEntries: 3},
+		{name: "too many entries", maxEntries: 2, wantErr: true},
+		{name: "too many bytes", maxBytes: 9, wantErr: true},
+	}
+
+	for _, format := range []string{ARCHIVE_FORMAT_TAR, ARCHIVE_FORMAT_ZIP} {
+		for _, test := range tests {
+			t.Run(format+"/"+test.name, func(t *testing.T) {
+				root := t.TempDir()
+				dst := filepath.Join(root, "dst")
+				if err := os.Mkdir(dst, 0755); err != nil {
+					t.Fatal(err)
+				}
+				archivePath := filepath.Join(root, "test."+format)
+				if format == ARCHIVE_FORMAT_ZIP {
+					writeTestZip(t, archivePath, entries)
+				} else {
+					writeTestTar(t, archivePath, entries)
+				}
+
+				worker := testWorker(t, root)
+				worker.Server.config.ExtractMaxBytes = test.maxBytes
+				worker.Server.config.ExtractMaxEntries = test.maxEntries
+				_, err := worker.doExtract([]string{format, archivePath, dst})
+				if (err != nil) != test.wantErr {
+					t.Fatalf("extract error = %v, want error %v", err, test.wantErr)
+				}
+				//the extract stops at the entry that passes the limit, which isn't left behind
+				if _, statErr := os.Lstat(filepath.Join(dst, "d", "b")); test.wantErr && !os.IsNotExist(statErr) {
+					t.Error("d/b exists past the limit")
+				}
+			})
+		}
+	}
+}
+
+//on NFSv4, setting an ACL rewrites the mode, so the archive's permissions have to go on after the inherited ACL
+func TestExtractPermissionsAfterACL(t *testing.T) {
+	acls := fakeACLs(t)
+	set := aclXattr.set
+	aclXattr.set = func(filePath string, raw []byte) error {
+		if err := os.Chmod(filePath, 0); err != nil {
+			return err
+		}
+		return set(filePath, raw)
+	}
+	root := t.TempDir()
+	dst := filepath.Join(root, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	acls[dst] = []nfs4ACE{{flags: ACE_FLAG_FILE_INHERIT | ACE_FLAG_DIRECTORY_INHERIT, mask: 0x1f01ff, who: "OWNER@"}}
+	archivePath := filepath.Join(root, "test.tar")
+	writeTestTar(t, archivePath, []testEntry{{name: "d/"}, {name: "d/f", content: "x"}})
+
+	worker := testWorker(t, root)
+	if _, err := worker.doExtract([]string{ARCHIVE_FORMAT_TAR, archivePath, dst}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{"d": 0755 | os.ModeDir, "d/f": 0644} {
+		filePath := filepath.Join(dst, name)
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", name, fi.Mode(), want)
+		}
+		if acls[filePath] == nil {
+			t.Errorf("%s didn't inherit an ACL", name)
+		}
+	}
+}
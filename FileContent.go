@@ -0,0 +1,180 @@
+package FileDaemon
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	WRITE_PARAM_COUNT        = 3
+	WRITE_PARAM_PROFILE_IDX  = 0
+	WRITE_PARAM_OWNER_IDX    = 1
+	WRITE_PARAM_FILEPATH_IDX = 2
+
+	READ_PARAM_COUNT        = 3
+	READ_PARAM_FILEPATH_IDX = 0
+	READ_PARAM_OFFSET_IDX   = 1
+	READ_PARAM_LENGTH_IDX   = 2
+	READ_REPLY_SIZE_IDX     = 0
+	READ_REPLY_CONTENT_IDX  = 1
+	//the content is one reply string, so keep it to a size the socket handles comfortably
+	READ_MAX_LENGTH = 16 << 20
+)
+
+//doWrite replaces a file's content atomically: write|profile|owner[:group]|path, with the content as the frames
+// after the request. The content goes to a temporary file in the same directory, which is fsynced, given the chmod
+// profile and the owner, then renamed into place, so readers only ever see the old file or the whole new one.
+// An empty owner keeps the owner and group of the file being replaced. Replies with the number of bytes written
+func (worker *Worker) doWrite(params []string, content []string) (reply []string, err error) {
+	if len(params) != WRITE_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to write. Expected " +
+			strconv.Itoa(WRITE_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	filePath := filepath.Clean(params[WRITE_PARAM_FILEPATH_IDX])
+	ownerName := params[WRITE_PARAM_OWNER_IDX]
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	profile, ok := worker.Server.CurrentConfig().ChmodProfiles[params[WRITE_PARAM_PROFILE_IDX]]
+	if !ok {
+		err = errors.New("unsupported file mode " + params[WRITE_PARAM_PROFILE_IDX])
+		return
+	}
+
+	uid, gid := -1, -1
+	if ownerName != "" {
+		if uid, gid, err = lookupOwner(ownerName); err != nil {
+			return
+		}
+	}
+	if fi, statErr := os.Lstat(filePath); statErr == nil {
+		if !fi.Mode().IsRegular() {
+			return nil, errors.New("can only write over a regular file: " + filePath)
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && ownerName == "" {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+
+	tempPath := worker.tempSibling(filePath)
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	//from here on, a failure leaves the original untouched and takes the temporary file away
+	written := 0
+	defer func() {
+		if err != nil {
+			os.Remove(tempPath)
+		}
+	}()
+	for _, frame := range content {
+		n, writeErr := io.WriteString(file, frame)
+		written += n
+		if writeErr != nil {
+			file.Close()
+			return nil, writeErr
+		}
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+
+	//the profile is applied over what the directory passes on, which matters for additive profiles
+	if err = worker.inheritACL(tempPath, false); err != nil {
+		return
+	}
+	if uid != -1 || gid != -1 {
+		if err = os.Chown(tempPath, uid, gid); err != nil {
+			return
+		}
+	}
+	notNFS4 := false
+	if _, err = worker.executeChmod(tempPath, profile.Additive, profile.OctalPerms, profile.EveryoneMask,
+		profile.GroupMask, profile.OwnerMask, false, &notNFS4, nil); err != nil {
+		return
+	}
+	if err = os.Rename(tempPath, filePath); err != nil {
+		return
+	}
+	//the rename only survives a crash once the directory is on disk too
+	if dir, openErr := os.Open(filepath.Dir(filePath)); openErr == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return []string{strconv.Itoa(written)}, nil
+}
+
+//doRead returns part of a file: read|path|offset|length. A length of 0 reads to the end of the file. Either way at
+// most 16MiB comes back; larger reads have to be made in ranges. Replies with the file's size, then the content,
+// which may contain the delimiter and so runs to the end of the reply
+func (worker *Worker) doRead(params []string) (reply []string, err error) {
+	if len(params) != READ_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to read. Expected " +
+			strconv.Itoa(READ_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	filePath := params[READ_PARAM_FILEPATH_IDX]
+	offset, err := strconv.ParseInt(params[READ_PARAM_OFFSET_IDX], 10, 64)
+	if err != nil || offset < 0 {
+		return nil, errors.New("read offset must be a non-negative number of bytes")
+	}
+	length, err := strconv.ParseInt(params[READ_PARAM_LENGTH_IDX], 10, 64)
+	if err != nil || length < 0 || length > READ_MAX_LENGTH {
+		return nil, errors.New("read length must be between 0 and " + strconv.Itoa(READ_MAX_LENGTH) + " bytes")
+	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.New("can only read a regular file: " + filePath)
+	}
+	if length == 0 {
+		length = fi.Size() - offset
+		if length > READ_MAX_LENGTH {
+			return nil, errors.New("read of " + filePath + " would be over " + strconv.Itoa(READ_MAX_LENGTH) +
+				" bytes, read it in ranges")
+		}
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	content := make([]byte, length)
+	n, err := file.ReadAt(content, offset)
+	if err == io.EOF {
+		//a short read at the end of the file is what a range past the end gets
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	reply = make([]string, 2)
+	reply[READ_REPLY_SIZE_IDX] = strconv.FormatInt(fi.Size(), 10)
+	reply[READ_REPLY_CONTENT_IDX] = string(content[:n])
+
+	return
+}
@@ -2,15 +2,21 @@ package FileDaemon
 
 import (
 	"crypto/md5"
-	"encoding/hex"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/blake3"
+	"hash/crc32"
 	"errors"
 	nfs4 "github.com/cclose/libnfs4acl-go"
 	"golang.org/x/crypto/blake2b"
-	"io/ioutil"
+	"hash"
+	"io"
 	"os"
-	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"github.com/karrick/godirwalk"
 	"os/exec"
 	//"fmt"
@@ -20,50 +26,122 @@ import (
 )
 
 const ( //for doChecksum
-	CHKSUM_REPLY_COUNT        = 1
-	CHKSUM_REPLY_IDX          = 0
 	CHKSUM_PARAM_COUNT        = 2
+	//with a byte range: offset and length
+	CHKSUM_PARAM_COUNT_RANGE  = 4
+	//either form may end with a force flag, to recompute rather than use the cache
+	CHKSUM_PARAM_COUNT_FORCE       = 3
+	CHKSUM_PARAM_COUNT_RANGE_FORCE = 5
 	CHKSUM_PARAM_ALGOR_IDX    = 0
 	CHKSUM_PARAM_FILEPATH_IDX = 1
+	CHKSUM_PARAM_OFFSET_IDX   = 2
+	CHKSUM_PARAM_LENGTH_IDX   = 3
+	CHKSUM_ALGOR_SEP          = ","
+
+	//files are streamed through a buffer this size, however big they are
+	CHKSUM_BUFFER_SIZE = 1 << 20
 )
 
-func (worker *Worker) doChecksum(params []string) (reply []string, err error) {
-	reply = make([]string, CHKSUM_REPLY_COUNT, CHKSUM_REPLY_COUNT) //we return 1 message chunk... the checksum!
+//checksumBuffers are shared between workers, so memory use is bounded by the number of requests hashing at once
+var checksumBuffers = sync.Pool{New: func() interface{} {
+	buffer := make([]byte, CHKSUM_BUFFER_SIZE)
+	return &buffer
+}}
 
-	if len(params) != CHKSUM_PARAM_COUNT {
+//checksum|algorithm|path, or checksum|algorithm|path|offset|length to hash only part of the file.
+// A length of 0 hashes from offset to the end of the file. algorithm may be a comma separated list, in which case
+// the reply has one digest per algorithm, in the order asked for. A trailing true skips the checksum cache
+func (worker *Worker) doChecksum(params []string) (reply []string, err error) {
+	var force bool
+	switch len(params) {
+	case CHKSUM_PARAM_COUNT_FORCE, CHKSUM_PARAM_COUNT_RANGE_FORCE:
+		if force, err = strconv.ParseBool(params[len(params)-1]); err != nil {
+			return
+		}
+		params = params[:len(params)-1]
+	case CHKSUM_PARAM_COUNT, CHKSUM_PARAM_COUNT_RANGE:
+	default:
 		err = errors.New("Incorrect number of parameters to checksum. Expected " +
-			string(CHKSUM_PARAM_COUNT) + " Got " + string(len(params)))
+			strconv.Itoa(CHKSUM_PARAM_COUNT) + " to " + strconv.Itoa(CHKSUM_PARAM_COUNT_RANGE_FORCE) + " Got " +
+			strconv.Itoa(len(params)))
 		return
 	}
 
 	checkSumAlgor /*e*/ := params[CHKSUM_PARAM_ALGOR_IDX]
 	filePath := params[CHKSUM_PARAM_FILEPATH_IDX]
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	var offset, length int64
+	if len(params) == CHKSUM_PARAM_COUNT_RANGE {
+		offset, err = strconv.ParseInt(params[CHKSUM_PARAM_OFFSET_IDX], 10, 64)
+		if err != nil || offset < 0 {
+			err = errors.New("invalid checksum offset " + params[CHKSUM_PARAM_OFFSET_IDX])
+			return
+		}
+		length, err = strconv.ParseInt(params[CHKSUM_PARAM_LENGTH_IDX], 10, 64)
+		if err != nil || length < 0 {
+			err = errors.New("invalid checksum length " + params[CHKSUM_PARAM_LENGTH_IDX])
+			return
+		}
+	}
+
+	//several algorithms share a single read of the file
+	return worker.checksumFile(filePath, strings.Split(checkSumAlgor, CHKSUM_ALGOR_SEP), offset, length, force)
+}
 
-	// Get bytes from file
-	data, err := ioutil.ReadFile(filePath)
+//the checksum algorithms we support, by the name requests use
+var checksumAlgorithms = map[string]func() (hash.Hash, error){
+	"md5":         func() (hash.Hash, error) { return md5.New(), nil },
+	"sha1":        func() (hash.Hash, error) { return sha1.New(), nil },
+	"sha256":      func() (hash.Hash, error) { return sha256.New(), nil },
+	"sha512":      func() (hash.Hash, error) { return sha512.New(), nil },
+	"blake2b":     func() (hash.Hash, error) { return blake2b.New256(nil) },
+	"blake2b-512": func() (hash.Hash, error) { return blake2b.New512(nil) },
+	"blake3":      func() (hash.Hash, error) { return blake3.New(), nil },
+	"xxhash64":    func() (hash.Hash, error) { return xxhash.New(), nil },
+	"crc32c":      func() (hash.Hash, error) { return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil },
+}
+
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, errors.New("Unsupported checksum algorithm " + algorithm)
+	}
+
+	return newHash()
+}
+
+//hashFile streams length bytes of filePath from offset into hasher, or to the end of the file when length is 0
+func hashFile(hasher io.Writer, filePath string, offset, length int64) (err error) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		return
 	}
+	defer file.Close()
 
-	// Hash the file and output results
-	var checkSum string
-	switch checkSumAlgor {
-	case "md5":
-		chkSumBytes := md5.Sum(data)
-		checkSum = hex.EncodeToString(chkSumBytes[:])
-		break
-	case "blake2b":
-		chkSumBytes := blake2b.Sum256(data)
-		checkSum = hex.EncodeToString(chkSumBytes[:])
-		break
-
-	default:
-		err = errors.New("Unsupported checksum algorithm " + checkSumAlgor)
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file: " + filePath)
+	}
+	if offset > fi.Size() {
+		return errors.New("checksum offset is past the end of the file")
+	}
+	if length == 0 {
+		length = fi.Size() - offset
+	} else if offset+length > fi.Size() {
+		return errors.New("checksum range runs past the end of the file")
 	}
 
-	//if we have no error, then convert our byte stream into a string
-	if err == nil {
-		reply[CHKSUM_REPLY_IDX] = checkSum
+	buffer := checksumBuffers.Get().(*[]byte)
+	defer checksumBuffers.Put(buffer)
+	copied, err := io.CopyBuffer(hasher, io.NewSectionReader(file, offset, length), *buffer)
+	if err == nil && copied != length {
+		//the file shrank under us
+		err = errors.New("read " + strconv.FormatInt(copied, 10) + " of " + strconv.FormatInt(length, 10) + " bytes")
 	}
 
 	return
@@ -112,6 +190,87 @@ const (
 
 const ACL_DOMAINUSERS_WHONAME = "domain users@x-es.com"
 
+//ChmodProfile is a named set of permissions chmod can apply.
+// On NFSv4 the masks become the owner, group and everyone ACEs; elsewhere the octal permissions are used
+type ChmodProfile struct {
+	Name       string
+	OctalPerms os.FileMode
+	//additive profiles OR the read/execute bits into what's there rather than replacing it
+	Additive                             bool
+	OwnerMask, GroupMask, EveryoneMask uint32
+}
+
+//Built in profiles. Specs are octal permissions, with a leading + for additive profiles.
+// The [profiles] section of the configuration adds to or overrides these
+var defaultChmodProfiles = map[string]string{
+	"lock":    "0444",
+	"read":    "0555",
+	"owrite":  "0755",
+	"ogwrite": "0775",
+	"write":   "0777",
+	"aread":   "+0555",
+}
+
+const CHMOD_PROFILE_ADDITIVE_PREFIX = "+"
+
+//ParseChmodProfile builds a profile from its spec, deriving the ACL masks from the octal permissions:
+// r grants ACL_MASK_READ, x ACL_MASK_EXECUTE and w ACL_MASK_WRITE, with owner and group also granted delete rights
+func ParseChmodProfile(name, spec string) (profile ChmodProfile, err error) {
+	profile.Name = name
+	profile.Additive = strings.HasPrefix(spec, CHMOD_PROFILE_ADDITIVE_PREFIX)
+	perms, err := strconv.ParseUint(strings.TrimPrefix(spec, CHMOD_PROFILE_ADDITIVE_PREFIX), 8, 32)
+	if err != nil || perms > 0777 {
+		err = errors.New("invalid permissions for profile " + name + ": " + spec)
+		return
+	}
+	profile.OctalPerms = os.FileMode(perms)
+	profile.OwnerMask = aclMaskForPerms(profile.OctalPerms>>6, true)
+	profile.GroupMask = aclMaskForPerms(profile.OctalPerms>>3, true)
+	profile.EveryoneMask = aclMaskForPerms(profile.OctalPerms, false)
+
+	return
+}
+
+//aclMaskForPerms converts the low rwx bits of perms into an ACL access mask
+func aclMaskForPerms(perms os.FileMode, ownerOrGroup bool) uint32 {
+	mask := uint32(ACL_SET_BASE)
+	if perms&04 != 0 {
+		mask |= ACL_MASK_READ
+	}
+	if perms&01 != 0 {
+		mask |= ACL_MASK_EXECUTE
+	}
+	if perms&02 != 0 {
+		mask |= ACL_MASK_WRITE
+		if ownerOrGroup {
+			mask |= ACL_MASK_OGWRITE_PART
+		}
+	}
+
+	return mask
+}
+
+//loadChmodProfiles merges configured profile specs over the built in ones
+func loadChmodProfiles(specs map[string]string) (profiles map[string]ChmodProfile, err error) {
+	profiles = make(map[string]ChmodProfile)
+	var errs []string
+	for _, source := range []map[string]string{defaultChmodProfiles, specs} {
+		for name, spec := range source {
+			profile, parseErr := ParseChmodProfile(name, strings.TrimSpace(spec))
+			if parseErr != nil {
+				errs = append(errs, parseErr.Error())
+				continue
+			}
+			profiles[name] = profile
+		}
+	}
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "\n\t"))
+	}
+
+	return
+}
+
 const (
 	CHMOD_PARAM_COUNT = 3
 	//CHMOD_REPLY_COUNT  = 0
@@ -128,7 +287,6 @@ func (worker *Worker) doChmod(params []string) (reply []string, err error) {
 		return
 	}
 
-	worker.logMessage("doing chmod request")
 
 	filePath := params[CHMOD_PARAM_FILEPATH_IDX]
 	mode := params[CHMOD_PARAM_MODE_IDX]
@@ -136,6 +294,9 @@ func (worker *Worker) doChmod(params []string) (reply []string, err error) {
 	if err != nil {
 		return
 	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
 
 	//Check if file exists
 	fi, err := os.Stat(filePath)
@@ -143,87 +304,71 @@ func (worker *Worker) doChmod(params []string) (reply []string, err error) {
 		return
 	}
 
-	additiveMode := false
-	var octalPerms os.FileMode //these are just ints, but prefix a 0### so it's Octal
-	var ownerMask, groupMask, everyoneMask uint32
 	//determine ACL list or Octal permissions
-	//we use string modes to better control what permissions can be granted
-	switch mode {
-	case "lock":
-		everyoneMask = ACL_SET_LOCK
-		groupMask = ACL_SET_LOCK
-		ownerMask = ACL_SET_LOCK
-		octalPerms = 0444
-		break
-	case "read":
-		everyoneMask = ACL_SET_READ
-		groupMask = ACL_SET_READ
-		ownerMask = ACL_SET_READ
-		octalPerms = 0555
-		break
-	case "owrite":
-		everyoneMask = ACL_SET_READ
-		groupMask = ACL_SET_READ
-		ownerMask = ACL_SET_OGWRITE
-		octalPerms = 0755
-		break
-	case "ogwrite":
-		everyoneMask = ACL_SET_READ
-		groupMask = ACL_SET_OGWRITE
-		ownerMask = ACL_SET_OGWRITE
-		octalPerms = 0775
-		break
-	case "write":
-		everyoneMask = ACL_SET_EWRITE
-		groupMask = ACL_SET_OGWRITE
-		ownerMask = ACL_SET_OGWRITE
-		octalPerms = 0777
-		break
-	case "aread":
-		additiveMode = true
-		octalPerms = 0555 //Set up a bit mask we will apply
-		break
-
-	default:
+	//we use named profiles to better control what permissions can be granted
+	profile, ok := worker.Server.CurrentConfig().ChmodProfiles[mode]
+	if !ok {
 		err = errors.New("unsupported file mode " + mode)
 		return
 	}
+	additiveMode := profile.Additive
+	octalPerms := profile.OctalPerms
+	ownerMask, groupMask, everyoneMask := profile.OwnerMask, profile.GroupMask, profile.EveryoneMask
+
+	//chmod overwrites ACLs outright, so keep a copy to undo from
+	journaled, err := worker.journalAttributes("chmod", filePath, recursive && fi.IsDir())
+	if err != nil {
+		return
+	}
 
 	notNFS4 := false
 	if recursive && fi.IsDir() { //must be a dir to walk
-		worker.logMessage("recursive")
+		worker.logDebug("recursive chmod", "path", filePath, "profile", mode)
 		count := 0
 		//godirwalk will walk the directory tree in parallel, calling the below callback
 		//if WILL visit the root node, so no additional call is needed
 		var fileACL, dirACL *nfs4.NFS4ACL //containers for override ACLs
+		//recorded jobs walk in order, so a checkpoint marks everything before it as done
+		job := worker.startJob("chmod", params, true)
 		err = godirwalk.Walk(filePath, &godirwalk.Options{
-			Unsorted: true,
+			Unsorted: job == nil,
 			Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+				if done, skipErr := job.done(subFilePath, de.IsDir()); done {
+					return skipErr
+				}
 				count++
 				if de.IsDir() {
 					dirACL, err = worker.executeChmod(subFilePath, additiveMode, octalPerms, everyoneMask, groupMask, ownerMask, de.IsDir(), &notNFS4, dirACL)
 				} else {
 					fileACL, err = worker.executeChmod(subFilePath, additiveMode, octalPerms, everyoneMask, groupMask, ownerMask, de.IsDir(), &notNFS4, fileACL)
 				}
+				if err == nil {
+					job.checkpoint(subFilePath)
+				}
 
 				return err
 			},
 		})
+		worker.finishJob(job)
+		worker.Server.metrics.addEntriesWalked("chmod", count)
 	} else {
-		worker.logMessage("not recursive")
+		worker.logDebug("chmod", "path", filePath, "profile", mode)
 
 		//our function expects a Dirent
 		_, err = worker.executeChmod(filePath, additiveMode, octalPerms, everyoneMask, groupMask, ownerMask, fi.IsDir(), &notNFS4, nil)
+		worker.Server.metrics.addEntriesWalked("chmod", 1)
 	}
 
+	if err == nil && journaled {
+		reply = []string{worker.requestID}
+	}
 
 	return
 }
 
-func (worker Worker)executeChmod(filePath string, additiveMode bool, octalPerms os.FileMode, everyoneMask, groupMask, ownerMask uint32, isDir bool, notNFS4 *bool, overrideACL *nfs4.NFS4ACL) (acl *nfs4.NFS4ACL, err error) {
+func (worker *Worker) executeChmod(filePath string, additiveMode bool, octalPerms os.FileMode, everyoneMask, groupMask, ownerMask uint32, isDir bool, notNFS4 *bool, overrideACL *nfs4.NFS4ACL) (acl *nfs4.NFS4ACL, err error) {
 	//Attempt the Chmod using nfs4
 	if !*notNFS4 {
-		worker.logMessage("trying nfs4")
 		if overrideACL != nil {
 			acl = overrideACL
 		} else {
@@ -232,7 +377,6 @@ func (worker Worker)executeChmod(filePath string, additiveMode bool, octalPerms
 	}
 
 	if err == nil && !*notNFS4 {
-		worker.logMessage("nfs4")
 		if overrideACL == nil {
 			//update ACLs
 			if additiveMode {
@@ -260,27 +404,22 @@ func (worker Worker)executeChmod(filePath string, additiveMode bool, octalPerms
 		err = nfs4.SetACL(filePath, acl) //statless variant
 
 	} else {
-		worker.logMessage("not nfs4")
 		//we failed, see if it's because the filesystem is not nfs4
 		if err != nil && err.Error() == nfs4.ERROR_NFS4_NOT_SUPPORTED {
-			worker.logMessage("not nfs4 msg")
 			if !*notNFS4 {
-				worker.logMessage("unsetting nfs4")
+				worker.logDebug("filesystem is not nfs4, falling back to chmod", "path", filePath)
 				*notNFS4 = true
 			}
 		}
 		if *notNFS4 {
-			worker.logMessage("is not nfs4")
 			if additiveMode {
-				worker.logMessage("additive chmod")
 				//in additive mode, we bitwise OR our mask with the existing mode
 				fileStat, _ := os.Stat(filePath) //we must stat to get that mode
 				err = os.Chmod(filePath, fileStat.Mode()|octalPerms)
 			} else {
-				worker.logMessage("regular chmod: " + filePath + "|" + string(octalPerms))
 				err = os.Chmod(filePath, octalPerms)
 				if err != nil {
-					worker.logMessage("chmod errored " + err.Error())
+					worker.logDebug("chmod failed", "path", filePath, "mode", octalPerms, "error", err)
 				}
 			}
 		}
@@ -301,6 +440,29 @@ const (
 	CHOWN_OWNERSTRING_GROUP_IDX = 1
 )
 
+//lookupOwner resolves an owner[:group] string, by name or id, to ids for os.Chown. The group is -1, to leave it
+// alone, when there isn't one
+func lookupOwner(ownerName string) (uid, gid int, err error) {
+	ownerParts := strings.Split(ownerName, CHOWN_OWNER_SEP)
+	if len(ownerParts) > 2 || ownerParts[CHOWN_OWNERSTRING_OWNER_IDX] == "" {
+		return -1, -1, errors.New("invalid owner string: " + ownerName)
+	}
+	owner, err := lookupID(ownerParts[CHOWN_OWNERSTRING_OWNER_IDX], "user")
+	if err != nil {
+		return -1, -1, err
+	}
+	uid, gid = int(*owner), -1
+	if len(ownerParts) > 1 {
+		group, err := lookupID(ownerParts[CHOWN_OWNERSTRING_GROUP_IDX], "group")
+		if err != nil {
+			return -1, -1, err
+		}
+		gid = int(*group)
+	}
+
+	return uid, gid, nil
+}
+
 func (worker *Worker) doChown(params []string) (reply []string, err error) {
 	if len(params) != CHOWN_PARAM_COUNT {
 		err = errors.New("Incorrect number of parameters to chown. Expected " +
@@ -314,6 +476,9 @@ func (worker *Worker) doChown(params []string) (reply []string, err error) {
 	if err != nil {
 		return
 	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
 
 	//Check if file exists
 	fi, err := os.Stat(filePath)
@@ -321,45 +486,44 @@ func (worker *Worker) doChown(params []string) (reply []string, err error) {
 		return
 	}
 
-	ownerParts := strings.Split(ownerName, CHOWN_OWNER_SEP)
-	if 0 == len(ownerParts) || len(ownerParts) > 2 {
-		err = errors.New("invalid owner string: " + ownerName)
-		return
-	}
-
-	var groupUid int
-	owner, err := user.Lookup(ownerParts[CHOWN_OWNERSTRING_OWNER_IDX])
+	ownerUid, groupUid, err := lookupOwner(ownerName)
 	if err != nil {
 		return
 	}
-	ownerUid, err := strconv.Atoi(owner.Uid)
+
+	journaled, err := worker.journalAttributes("chown", filePath, recursive && fi.IsDir())
 	if err != nil {
 		return
 	}
 
-	if len(ownerParts) > 1 {
-		group, err := user.LookupGroup(ownerParts[CHOWN_OWNERSTRING_GROUP_IDX])
-		if err != nil {
-			return reply, err //naked return here trips "err is shadowed during return"
-		}
-		groupUid, err = strconv.Atoi(group.Gid)
-		if err != nil {
-			return reply, err //naked return here trips "err is shadowed during return"
-		}
-	}
-
 	if recursive && fi.IsDir() { //must be a dir to walk
 		//godirwalk will walk the directory tree in parallel, calling the below callback
 		//if WILL visit the root node, so no additional call is needed
+		count := 0
+		job := worker.startJob("chown", params, true)
 		err = godirwalk.Walk(filePath, &godirwalk.Options{
-			Unsorted: true,
+			Unsorted: job == nil,
 			Callback: func(subFilePath string, de *godirwalk.Dirent) error {
-				return os.Chown(subFilePath, ownerUid, groupUid)
+				if done, skipErr := job.done(subFilePath, de.IsDir()); done {
+					return skipErr
+				}
+				count++
+				if err := os.Chown(subFilePath, ownerUid, groupUid); err != nil {
+					return err
+				}
+				job.checkpoint(subFilePath)
+				return nil
 			},
 		})
+		worker.finishJob(job)
+		worker.Server.metrics.addEntriesWalked("chown", count)
 
 	} else {
 		err = os.Chown(filePath, ownerUid, groupUid)
+		worker.Server.metrics.addEntriesWalked("chown", 1)
+	}
+	if err == nil && journaled {
+		reply = []string{worker.requestID}
 	}
 
 	return
@@ -367,17 +531,37 @@ func (worker *Worker) doChown(params []string) (reply []string, err error) {
 
 const (
 	COPY_PARAM_COUNT = 3
+	//with a trailing flag to keep the source's ACLs rather than inherit the destination directory's
+	COPY_PARAM_COUNT_KEEP_ACL = 4
+	//and then one to copy the source's extended attributes, in the namespaces the policy allows
+	COPY_PARAM_COUNT_KEEP_XATTR = 5
 	//COPY_REPLY_COUNT  = 0
 	COPY_PARAM_RECURSIVE_IDX = 0
 	COPY_PARAM_SRCFILEPATH_IDX    = 1
 	COPY_PARAM_DSTFILEPATH_IDX    = 2
+	COPY_PARAM_KEEP_ACL_IDX       = 3
+	COPY_PARAM_KEEP_XATTR_IDX     = 4
 )
+//cp|recursive|src|dst[|keep_acl[|keep_xattr]]. The copy inherits the ACL of the directory it lands in unless
+// keep_acl is true, and only gets the source's extended attributes when keep_xattr is true
 func (worker *Worker) doCopy(params []string) (reply []string, err error) {
-	if len(params) != COPY_PARAM_COUNT {
+	if len(params) < COPY_PARAM_COUNT || len(params) > COPY_PARAM_COUNT_KEEP_XATTR {
 		err = errors.New("Incorrect number of parameters to copy. Expected " +
-			strconv.Itoa(COPY_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+			strconv.Itoa(COPY_PARAM_COUNT) + " to " + strconv.Itoa(COPY_PARAM_COUNT_KEEP_XATTR) + " Got " +
+			strconv.Itoa(len(params)))
 		return
 	}
+	keepACL, keepXattr := false, false
+	if len(params) >= COPY_PARAM_COUNT_KEEP_ACL {
+		if keepACL, err = strconv.ParseBool(params[COPY_PARAM_KEEP_ACL_IDX]); err != nil {
+			return
+		}
+	}
+	if len(params) == COPY_PARAM_COUNT_KEEP_XATTR {
+		if keepXattr, err = strconv.ParseBool(params[COPY_PARAM_KEEP_XATTR_IDX]); err != nil {
+			return
+		}
+	}
 
 	srcFilePath := params[COPY_PARAM_SRCFILEPATH_IDX]
 	dstFilePath := params[COPY_PARAM_DSTFILEPATH_IDX]
@@ -385,9 +569,12 @@ func (worker *Worker) doCopy(params []string) (reply []string, err error) {
 	if err != nil {
 		return
 	}
+	if err = worker.checkPaths(srcFilePath, dstFilePath); err != nil {
+		return
+	}
 
 	//Check if file exists
-	_, err = os.Stat(srcFilePath)
+	srcInfo, err := os.Stat(srcFilePath)
 	if err != nil {
 		return
 	}
@@ -412,33 +599,99 @@ func (worker *Worker) doCopy(params []string) (reply []string, err error) {
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
+	//cp doesn't tell us how much it copied, so measure the source. A single file follows symlinks, as cp does
+	copied, count := srcInfo.Size(), 1
+	if recursive {
+		copied, count = treeSize(srcFilePath)
+	}
+	//a half finished copy can be reported but not resumed, cp won't write into an existing destination
+	var job *Job
+	if recursive {
+		job = worker.startJob("cp", params, false)
+	}
 	err = cmd.Run()
+	worker.finishJob(job)
 	if err != nil {
 		err = errors.New(fmt.Sprint(err) + ": " + stderr.String() + "\n")
+		return
+	}
+
+	worker.Server.metrics.bytesCopied.Add(float64(copied))
+	worker.Server.metrics.addEntriesWalked("cp", count)
+
+	if keepACL {
+		err = copyACLs(srcFilePath, dstFilePath)
+	} else {
+		err = worker.inheritACL(dstFilePath, recursive)
 	}
+	if err == nil && keepXattr {
+		err = worker.copyXattrs(srcFilePath, dstFilePath)
+	}
+
+	return
+}
+
+//treeSize totals the size of the regular files at or beneath filePath, and counts the entries visited
+func treeSize(filePath string) (size int64, count int) {
+	godirwalk.Walk(filePath, &godirwalk.Options{
+		Unsorted:          true,
+		AllowNonDirectory: true, //a single copied file is a tree of one
+		Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+			count++
+			if de.IsRegular() {
+				if fi, err := os.Lstat(subFilePath); err == nil {
+					size += fi.Size()
+				}
+			}
+			return nil
+		},
+		ErrorCallback: func(string, error) godirwalk.ErrorAction {
+			return godirwalk.SkipNode
+		},
+	})
 
 	return
 }
 
 
 const (
-	MKDIR_PARAM_COUNT = 2
-	MKDIR_REPLY_COUNT  = 1
-	MKDIR_REPLY_SUBDIR_IDX = 0
-	MKDIR_PARAM_MODE_IDX    = 0
-	MKDIR_PARAM_FILEPATH_IDX    = 1
+	MKDIR_PARAM_COUNT_MIN    = 2
+	MKDIR_REPLY_SUBDIR_IDX   = 0
+	MKDIR_PARAM_MODE_IDX     = 0
+	MKDIR_PARAM_FILEPATH_IDX = 1
+	//everything after the path is key=value options
+	MKDIR_PARAM_OPTIONS_IDX = 2
 )
+//mkdir|mode|path[|owner=user[:group]][|profile=name]. The mode is octal, like 0755, or symbolic, like u=rwx,go=rx,
+// applied to 0777, and is set exactly rather than through the umask. An empty mode leaves it to the umask.
+// Every directory created gets the ACL of the one it's created in, then the mode, chmod profile and owner when given.
+// Replies with every directory created, top first, or a single empty string when the path already existed
 func (worker *Worker) doMkdir(params []string) (reply []string, err error) {
-	reply = make([]string, MKDIR_REPLY_COUNT, MKDIR_REPLY_COUNT) //we return 1 message chunk... the checksum!
-	if len(params) != MKDIR_PARAM_COUNT {
-		err = errors.New("Incorrect number of parameters to mkdir. Expected " +
-			strconv.Itoa(MKDIR_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+	if len(params) < MKDIR_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to mkdir. Expected at least " +
+			strconv.Itoa(MKDIR_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
 		return
 	}
 
-	modeInt, _ := strconv.Atoi(params[MKDIR_PARAM_MODE_IDX])
-	mode := os.FileMode(modeInt)
+	modeSpec := params[MKDIR_PARAM_MODE_IDX]
+	mode := os.FileMode(0777)
+	if modeSpec != "" {
+		if mode, err = parseFileMode(modeSpec, 0777); err != nil {
+			return
+		}
+	}
 	filePath := params[MKDIR_PARAM_FILEPATH_IDX]
+	options, err := parseOptions("mkdir", params[MKDIR_PARAM_OPTIONS_IDX:], "owner", "profile")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	uid, gid, profile, err := worker.ownerAndProfile(options)
+	if err != nil {
+		return
+	}
 
 	//Yes, os.MkdirAll can handle this but we want to know what subpaths actaully get made
 	// and verify their ACLs when done, so it's faster to do it this way
@@ -466,60 +719,97 @@ func (worker *Worker) doMkdir(params []string) (reply []string, err error) {
 	}
 
 	dirPath := ""
-	var acl *nfs4.NFS4ACL
-	isACL := true
-	//if we found a root, get the ACls from it so we can clone them
 	if rootFound {
 		dirPath = existingRoot
-		//if the root is existing, get the permissions of it
-		var getAclErr error
-		acl, getAclErr = nfs4.GetAcl(dirPath, true)
-		if getAclErr != nil && getAclErr.Error() == nfs4.ERROR_NFS4_NOT_SUPPORTED { //not nfs4, use regular chmod
-			isACL = false
-		}
 	}
 	//now work forwards from the existing root, adding new directories
-	var createdSubpath string
 	for j := len(newDirs) - 1; j >= 0; j-- {
 		//add the new
 		dirPath += string(os.PathSeparator) + newDirs[j]
-		mkdirerr := os.Mkdir(dirPath, mode)
-		if mkdirerr != nil {
-			err = mkdirerr
+		if err = os.Mkdir(dirPath, mode); err != nil {
 			return
 		}
-		//on the first iteration, remember the first subpath needing creation
-		if createdSubpath == "" {
-			createdSubpath = dirPath
+		reply = append(reply, dirPath)
+		//each level inherits from the one above it, so it passes on what it got
+		if err = worker.inheritACL(dirPath, false); err != nil {
+			return
 		}
-		if rootFound && acl != nil {
-			//TODO if we had a way to compare ACLs
-			//  get dirPath ACL and if dirpathACL != Acl
-			worker.executeChmod(dirPath, false, os.FileMode(0), uint32(0), uint32(0), uint32(0), true, &isACL, acl)
+		//mkdir goes through the umask, so a mode that was asked for is set again, after the ACL so it isn't lost
+		if modeSpec != "" {
+			if err = os.Chmod(dirPath, mode); err != nil {
+				return
+			}
+		}
+		if profile != nil {
+			notNFS4 := false
+			if _, err = worker.executeChmod(dirPath, profile.Additive, profile.OctalPerms, profile.EveryoneMask,
+				profile.GroupMask, profile.OwnerMask, true, &notNFS4, nil); err != nil {
+				return
+			}
+		}
+		if uid != -1 {
+			if err = os.Chown(dirPath, uid, gid); err != nil {
+				return
+			}
 		}
-
+	}
+	if len(reply) == 0 {
+		reply = []string{""}
 	}
 
-	reply[MKDIR_REPLY_SUBDIR_IDX] = createdSubpath
+	return
+}
+
+//ownerAndProfile reads the owner=user[:group] and profile=name options of commands that create things. The ids are
+// -1 and the profile nil when they aren't given
+func (worker *Worker) ownerAndProfile(options map[string]string) (uid, gid int, profile *ChmodProfile, err error) {
+	uid, gid = -1, -1
+	if ownerName, ok := options["owner"]; ok {
+		if uid, gid, err = lookupOwner(ownerName); err != nil {
+			return
+		}
+	}
+	if profileName, ok := options["profile"]; ok {
+		found, ok := worker.Server.CurrentConfig().ChmodProfiles[profileName]
+		if !ok {
+			err = errors.New("unsupported file mode " + profileName)
+			return
+		}
+		profile = &found
+	}
 
 	return
 }
 
 const (
 	MOVE_PARAM_COUNT = 2
+	//with a trailing flag to keep the moved tree's ACLs rather than inherit the destination directory's
+	MOVE_PARAM_COUNT_KEEP_ACL = 3
 	//MOVE_REPLY_COUNT  = 0
 	MOVE_PARAM_SRCFILEPATH_IDX    = 0
 	MOVE_PARAM_DSTFILEPATH_IDX    = 1
+	MOVE_PARAM_KEEP_ACL_IDX       = 2
 )
+//mv|src|dst[|keep_acl]. What's moved inherits the ACL of the directory it lands in unless keep_acl is true
 func (worker *Worker) doMove(params []string) (reply []string, err error) {
-	if len(params) != MOVE_PARAM_COUNT {
+	if len(params) != MOVE_PARAM_COUNT && len(params) != MOVE_PARAM_COUNT_KEEP_ACL {
 		err = errors.New("Incorrect number of parameters to move. Expected " +
-			strconv.Itoa(MOVE_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+			strconv.Itoa(MOVE_PARAM_COUNT) + " or " + strconv.Itoa(MOVE_PARAM_COUNT_KEEP_ACL) + " Got " +
+			strconv.Itoa(len(params)))
 		return
 	}
+	keepACL := false
+	if len(params) == MOVE_PARAM_COUNT_KEEP_ACL {
+		if keepACL, err = strconv.ParseBool(params[MOVE_PARAM_KEEP_ACL_IDX]); err != nil {
+			return
+		}
+	}
 
 	srcFilePath := params[MOVE_PARAM_SRCFILEPATH_IDX]
 	dstFilePath := params[MOVE_PARAM_DSTFILEPATH_IDX]
+	if err = worker.checkPaths(srcFilePath, dstFilePath); err != nil {
+		return
+	}
 
 	//Check if file exists
 	_, err = os.Stat(srcFilePath)
@@ -545,11 +835,34 @@ func (worker *Worker) doMove(params []string) (reply []string, err error) {
 	err = cmd.Run()
 	if err != nil {
 		err = errors.New(fmt.Sprint(err) + ": " + stderr.String() + "\n")
+		return
+	}
+	//a rename carries the ACLs along with it
+	if !keepACL {
+		err = worker.inheritACL(dstFilePath, true)
 	}
 
 	return
 }
 
+//checkRemovable refuses directories that still have something in them, as os.Remove would
+func checkRemovable(filePath string) error {
+	fi, err := os.Lstat(filePath)
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+	dir, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if names, _ := dir.Readdirnames(1); len(names) > 0 {
+		return errors.New("directory not empty: " + filePath)
+	}
+
+	return nil
+}
+
 const (
 	REMOVE_PARAM_COUNT = 3
 	//REMOVE_REPLY_COUNT  = 0
@@ -566,7 +879,16 @@ func (worker *Worker) doRemove(params []string) (reply []string, err error) {
 
 	filePath := params[REMOVE_PARAM_FILEPATH_IDX]
 	recursive, err := strconv.ParseBool(params[REMOVE_PARAM_RECURSIVE_IDX])
+	if err != nil {
+		return
+	}
 	ignoreMissing, err := strconv.ParseBool(params[REMOVE_PARAM_IGNORE_MISSING_IDX])
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
 
 	//Check if file exists
 	_, statErr := os.Stat(filePath)
@@ -579,8 +901,24 @@ func (worker *Worker) doRemove(params []string) (reply []string, err error) {
 		return
 	}
 
+	if worker.Server.CurrentConfig().JournalEnabled {
+		//moving to the trash takes the whole tree, so hold non-recursive removes to what os.Remove allows
+		if !recursive {
+			if err = checkRemovable(filePath); err != nil {
+				return
+			}
+		}
+		if err = worker.moveToTrash(filePath); err == nil {
+			reply = []string{worker.requestID}
+		}
+		return
+	}
+
 	if recursive {
+		//removing again picks up wherever it got to
+		job := worker.startJob("rm", params, true)
 		err = os.RemoveAll(filePath)
+		worker.finishJob(job)
 	} else {
 		err = os.Remove(filePath)
 	}
@@ -0,0 +1,409 @@
+package FileDaemon
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cclose/libnfs4acl-go"
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	FIND_PARAM_COUNT_MIN = 1
+	FIND_PARAM_DIR_IDX   = 0
+	//everything after the directory is key=value options
+	FIND_PARAM_OPTIONS_IDX = 1
+
+	FIND_DEFAULT_LIMIT = 1000
+	//a page is one reply string, so keep it to a size the socket handles comfortably
+	FIND_MAX_LIMIT = 10000
+	//only the first few errors are reported; the rest are just counted
+	FIND_MAX_ERRORS = 10
+
+	//NFSv4 values the ACL comparison needs, as the system.nfs4_acl xattr stores them (RFC 7530)
+	nfs4ACEDenied      = 1
+	nfs4ACEInheritOnly = 0x8
+)
+
+//FindMatch is one path that matched
+type FindMatch struct {
+	Path string `json:"path"`
+	EntryInfo
+}
+
+//FindPage is one chunk of matches. Next is the cursor to carry on walking from, empty once the walk is done
+type FindPage struct {
+	Matches    []FindMatch `json:"matches"`
+	Next       string      `json:"next,omitempty"`
+	ErrorCount int         `json:"error_count"`
+	Errors     []string    `json:"errors,omitempty"`
+}
+
+//findFilter holds the predicates a path has to pass. Unset ones match everything
+type findFilter struct {
+	name             string
+	regex            *regexp.Regexp
+	types            map[string]bool
+	minSize, maxSize int64
+	newer, older     time.Time
+	uid, gid         *uint32
+	modeNot          *os.FileMode
+	profile          *ChmodProfile
+}
+
+//errFindPageFull stops the walk once a page has all the matches it can take
+var errFindPageFull = errors.New("find page full")
+
+//doFind walks a tree for paths matching every predicate given: find|dir[|key=value...]. Options are
+//	name=PATTERN        base name matches the shell pattern
+//	regex=RE            path relative to dir matches the regular expression
+//	type=T[,T...]       file, directory, symlink or other
+//	min_size=N and max_size=N in bytes
+//	newer=T and older=T modified after or before T, in RFC 3339 or unix seconds
+//	owner=USER|UID and group=GROUP|GID
+//	mode_not=OCTAL      permission bits are anything other than these
+//	profile_mismatch=P  permissions or NFSv4 ACL differ from what chmod with profile P sets. Symlinks never match
+//	maxdepth=N          don't descend more than N levels below dir
+//	long=true           include each match's stat metadata
+//	limit=N             matches per chunk, 1000 by default
+//	cursor=C            carry on from the Next of the previous chunk
+// Symlinks aren't followed. Unreadable entries are skipped and reported, but don't fail the request
+func (worker *Worker) doFind(params []string) (reply []string, err error) {
+	if len(params) < FIND_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to find. Expected at least " +
+			strconv.Itoa(FIND_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	root := filepath.Clean(params[FIND_PARAM_DIR_IDX])
+	options, err := parseOptions("find", params[FIND_PARAM_OPTIONS_IDX:], "name", "regex", "type", "min_size",
+		"max_size", "newer", "older", "owner", "group", "mode_not", "profile_mismatch", "maxdepth", "long", "limit",
+		"cursor")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(root); err != nil {
+		return
+	}
+	filter, err := worker.parseFindFilter(options)
+	if err != nil {
+		return
+	}
+
+	limit := FIND_DEFAULT_LIMIT
+	if value, ok := options["limit"]; ok {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > FIND_MAX_LIMIT {
+			return nil, errors.New("find limit must be between 1 and " + strconv.Itoa(FIND_MAX_LIMIT))
+		}
+	}
+	maxDepth := -1
+	if value, ok := options["maxdepth"]; ok {
+		if maxDepth, err = strconv.Atoi(value); err != nil || maxDepth < 0 {
+			return nil, errors.New("find maxdepth must be a number of levels")
+		}
+	}
+	var long bool
+	if value, ok := options["long"]; ok {
+		if long, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+	//the cursor is the last path of the previous chunk, which the sorted walk picks up after
+	var resumeFrom string
+	if value, ok := options["cursor"]; ok && value != "" {
+		decoded, decodeErr := base64.RawURLEncoding.DecodeString(value)
+		resumeFrom = string(decoded)
+		relPath, relErr := filepath.Rel(root, resumeFrom)
+		if decodeErr != nil || relErr != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+			return nil, errors.New("invalid find cursor " + value)
+		}
+	}
+
+	page := FindPage{Matches: []FindMatch{}}
+	names := make(map[string]string)
+	walked := 0
+	var last string
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			if resumeFrom != "" {
+				done, skipErr := walkedPast(filePath, resumeFrom, de.IsDir())
+				if done {
+					return skipErr
+				}
+				resumeFrom = ""
+			}
+			walked++
+
+			relPath, _ := filepath.Rel(root, filePath)
+			depth := 0
+			if relPath != "." {
+				depth = strings.Count(relPath, string(os.PathSeparator)) + 1
+			}
+			if maxDepth >= 0 && depth > maxDepth {
+				//only reached when resuming after a directory at the depth limit
+				if de.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			match := FindMatch{Path: filePath, EntryInfo: EntryInfo{Type: direntTypeName(de)}}
+			matched, matchErr := filter.matches(filePath, relPath, match.Type)
+			if matchErr != nil {
+				page.record(matchErr)
+			} else if matched {
+				if long {
+					worker.statEntry(filePath, &match.EntryInfo, names)
+				}
+				page.Matches = append(page.Matches, match)
+				last = filePath
+			}
+
+			if len(page.Matches) == limit {
+				return errFindPageFull
+			}
+			if de.IsDir() && depth == maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		},
+		ErrorCallback: func(filePath string, walkErr error) godirwalk.ErrorAction {
+			//the callback's own errors come through here too
+			if walkErr == errFindPageFull {
+				return godirwalk.Halt
+			}
+			page.record(walkErr)
+			return godirwalk.SkipNode
+		},
+	})
+	worker.Server.metrics.addEntriesWalked("find", walked)
+	if err == errFindPageFull {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(last))
+	} else if err != nil {
+		return
+	}
+
+	encoded, err := worker.jsonReply(page)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+func (page *FindPage) record(err error) {
+	page.ErrorCount++
+	if len(page.Errors) < FIND_MAX_ERRORS {
+		page.Errors = append(page.Errors, err.Error())
+	}
+}
+
+//parseFindFilter reads the predicate options, resolving names and profiles up front so a bad one fails the
+// request rather than quietly matching nothing
+func (worker *Worker) parseFindFilter(options map[string]string) (filter findFilter, err error) {
+	filter.minSize, filter.maxSize = -1, -1
+	filter.name = options["name"]
+	if _, err = filepath.Match(filter.name, ""); err != nil {
+		return filter, errors.New("invalid find name pattern " + filter.name + ": " + err.Error())
+	}
+	if value, ok := options["regex"]; ok {
+		if filter.regex, err = regexp.Compile(value); err != nil {
+			return filter, errors.New("invalid find regex " + value + ": " + err.Error())
+		}
+	}
+	if value, ok := options["type"]; ok {
+		if filter.types, err = parseEntryTypes("find", value); err != nil {
+			return
+		}
+	}
+	for key, size := range map[string]*int64{"min_size": &filter.minSize, "max_size": &filter.maxSize} {
+		if value, ok := options[key]; ok {
+			if *size, err = strconv.ParseInt(value, 10, 64); err != nil || *size < 0 {
+				return filter, errors.New("find " + key + " must be a number of bytes")
+			}
+		}
+	}
+	for key, when := range map[string]*time.Time{"newer": &filter.newer, "older": &filter.older} {
+		if value, ok := options[key]; ok {
+			if *when, err = parseTimeOption(value); err != nil {
+				return filter, errors.New("find " + key + " must be an RFC 3339 time or unix seconds")
+			}
+		}
+	}
+	if value, ok := options["owner"]; ok {
+		if filter.uid, err = lookupID(value, "user"); err != nil {
+			return
+		}
+	}
+	if value, ok := options["group"]; ok {
+		if filter.gid, err = lookupID(value, "group"); err != nil {
+			return
+		}
+	}
+	if value, ok := options["mode_not"]; ok {
+		mode, parseErr := strconv.ParseUint(value, 8, 32)
+		if parseErr != nil || mode > 07777 {
+			return filter, errors.New("find mode_not must be octal permissions such as 0644")
+		}
+		perms := os.FileMode(mode)
+		filter.modeNot = &perms
+	}
+	if value, ok := options["profile_mismatch"]; ok {
+		profile, known := worker.Server.CurrentConfig().ChmodProfiles[value]
+		if !known {
+			return filter, errors.New("unsupported file mode " + value)
+		}
+		filter.profile = &profile
+	}
+
+	return filter, nil
+}
+
+//parseTimeOption accepts an RFC 3339 time or unix seconds
+func parseTimeOption(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+//lookupID resolves a user or group name to its id. Numbers are taken as ids as they are
+func lookupID(value, kind string) (*uint32, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		var found string
+		if kind == "user" {
+			var u *user.User
+			if u, err = user.Lookup(value); err == nil {
+				found = u.Uid
+			}
+		} else {
+			var g *user.Group
+			if g, err = user.LookupGroup(value); err == nil {
+				found = g.Gid
+			}
+		}
+		if err != nil {
+			return nil, errors.New("unknown " + kind + " " + value)
+		}
+		if id, err = strconv.ParseUint(found, 10, 32); err != nil {
+			return nil, err
+		}
+	}
+	resolved := uint32(id)
+
+	return &resolved, nil
+}
+
+//matches applies the filter to one path, only statting it if a predicate needs its metadata
+func (filter findFilter) matches(filePath, relPath, entryType string) (bool, error) {
+	if filter.types != nil && !filter.types[entryType] {
+		return false, nil
+	}
+	if filter.name != "" {
+		if matched, _ := filepath.Match(filter.name, filepath.Base(filePath)); !matched {
+			return false, nil
+		}
+	}
+	if filter.regex != nil && !filter.regex.MatchString(relPath) {
+		return false, nil
+	}
+	if filter.minSize < 0 && filter.maxSize < 0 && filter.newer.IsZero() && filter.older.IsZero() &&
+		filter.uid == nil && filter.gid == nil && filter.modeNot == nil && filter.profile == nil {
+		return true, nil
+	}
+
+	fi, err := os.Lstat(filePath)
+	if err != nil {
+		return false, err
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errors.New("no ownership information for " + filePath)
+	}
+	switch {
+	case filter.minSize >= 0 && fi.Size() < filter.minSize,
+		filter.maxSize >= 0 && fi.Size() > filter.maxSize,
+		!filter.newer.IsZero() && !fi.ModTime().After(filter.newer),
+		!filter.older.IsZero() && !fi.ModTime().Before(filter.older),
+		filter.uid != nil && stat.Uid != *filter.uid,
+		filter.gid != nil && stat.Gid != *filter.gid,
+		filter.modeNot != nil && os.FileMode(stat.Mode&07777) == *filter.modeNot:
+		return false, nil
+	}
+	if filter.profile != nil {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return false, nil
+		}
+		return profileMismatch(filePath, fi.Mode(), *filter.profile), nil
+	}
+
+	return true, nil
+}
+
+//profileMismatch reports whether a path's permissions differ from what chmod with profile would leave. With an
+// NFSv4 ACL, a replacing profile must have granted exactly its owner, group and everyone masks and nothing else,
+// while an additive one only needs its read and execute rights granted. Without one the mode bits are compared
+func profileMismatch(filePath string, mode os.FileMode, profile ChmodProfile) bool {
+	raw := readACLXattr(filePath)
+	if raw == nil {
+		if profile.Additive {
+			return mode.Perm()&profile.OctalPerms != profile.OctalPerms
+		}
+		return mode.Perm() != profile.OctalPerms
+	}
+	entries, err := parseNFS4ACL(raw)
+	if err != nil {
+		//a damaged ACL isn't what chmod writes
+		return true
+	}
+
+	//rights each principal is left with, ignoring entries that only pass on to children
+	granted := make(map[string]uint32)
+	for _, entry := range entries {
+		if entry.flags&nfs4ACEInheritOnly != 0 {
+			continue
+		}
+		switch entry.aceType {
+		case nfs4.NFS4_ACE_ACCESS_ALLOWED_ACE_TYPE:
+			granted[entry.who] |= entry.mask
+		case nfs4ACEDenied:
+			if !profile.Additive {
+				return true
+			}
+			granted[entry.who] &^= entry.mask
+		}
+	}
+	expected := map[string]uint32{
+		nfs4.NFS4_ACL_WHO_OWNER_STRING:    profile.OwnerMask,
+		nfs4.NFS4_ACL_WHO_GROUP_STRING:    profile.GroupMask,
+		nfs4.NFS4_ACL_WHO_EVERYONE_STRING: profile.EveryoneMask,
+	}
+	if profile.Additive {
+		for who, mask := range expected {
+			if needed := mask & ACL_MASK_RX; granted[who]&needed != needed {
+				return true
+			}
+		}
+		return false
+	}
+
+	expected[ACL_DOMAINUSERS_WHONAME] = profile.GroupMask
+	if len(granted) != len(expected) {
+		return true
+	}
+	for who, mask := range expected {
+		if granted[who] != mask {
+			return true
+		}
+	}
+
+	return false
+}
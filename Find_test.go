@@ -0,0 +1,77 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//findAll pages through a find of dir, calling between after each page but the last
+func findAll(t *testing.T, worker *Worker, dir string, limit string, between func()) (paths []string) {
+	t.Helper()
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("find paging never finished")
+		}
+		reply, err := worker.doFind([]string{dir, "type=file", "limit=" + limit, "cursor=" + cursor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page FindPage
+		if err = json.Unmarshal([]byte(reply[0]), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range page.Matches {
+			paths = append(paths, match.Path)
+		}
+		if page.Next == "" {
+			return
+		}
+		cursor = page.Next
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestFindPaging(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "a/z", "b"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a.txt", "a/y", "a/z/x", "a/z/y", "b/c", "c"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worker := testWorker(t, root)
+
+	want := findAll(t, worker, root, "100", nil)
+	if len(want) != 6 {
+		t.Fatalf("unpaged find matched %v", want)
+	}
+	for _, limit := range []string{"1", "2", "4"} {
+		if got := findAll(t, worker, root, limit, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("limit %s paged through %v, want %v", limit, got, want)
+		}
+	}
+
+	//the cursor is a path the walk goes past, so removing it, or the directory it's in, loses nothing after it
+	removed := false
+	got := findAll(t, worker, root, "3", func() {
+		if !removed {
+			removed = true
+			if err := os.RemoveAll(filepath.Join(root, "a", "z")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %v with the cursor's directory removed, want %v", got, want)
+	}
+}
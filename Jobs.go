@@ -0,0 +1,444 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	panicUtil "github.com/cclose/go-utils/panic"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	JOB_STATE_RUNNING     = "running"
+	JOB_STATE_INTERRUPTED = "interrupted"
+
+	jobsBucket = "jobs"
+	//how long to wait for another process to let go of the state file
+	jobStoreOpenTimeout = time.Second
+)
+
+//Job is a long-running operation recorded in the state file while it runs, so that one cut short by a crash can be
+// reported and picked up again. Finished jobs are removed; their outcome went back to the caller
+type Job struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Command   string    `json:"command"`
+	Params    []string  `json:"params"`
+	State     string    `json:"state"`
+	Resumable bool      `json:"resumable"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	//the last path finished, in walk order
+	Checkpoint string `json:"checkpoint,omitempty"`
+	Processed  int    `json:"processed"`
+	Error      string `json:"error,omitempty"`
+
+	store     *JobStore
+	lastSaved time.Time
+	//while resuming, the checkpoint we are still catching up to
+	resumeFrom string
+}
+
+//JobStore keeps jobs in a bbolt file
+type JobStore struct {
+	db *bolt.DB
+	//checkpoints are saved at most this often
+	checkpointInterval time.Duration
+	lock               sync.Mutex
+}
+
+//OpenJobStore opens, or creates, the state file at path. Any job still marked running was cut short by whatever
+// stopped the last process, so it is marked interrupted
+func OpenJobStore(path string, checkpointInterval time.Duration) (store *JobStore, interrupted []Job, err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: jobStoreOpenTimeout})
+	if err != nil {
+		return nil, nil, errors.New("Failed to open job state file " + path + ": " + err.Error())
+	}
+	store = &JobStore{db: db, checkpointInterval: checkpointInterval}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(jobsBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var job Job
+			if err := json.Unmarshal(value, &job); err != nil {
+				return err
+			}
+			if job.State == JOB_STATE_RUNNING {
+				job.State = JOB_STATE_INTERRUPTED
+				encoded, err := json.Marshal(job)
+				if err != nil {
+					return err
+				}
+				if err = bucket.Put(key, encoded); err != nil {
+					return err
+				}
+			}
+			interrupted = append(interrupted, job)
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, errors.New("Failed to read job state file " + path + ": " + err.Error())
+	}
+
+	return
+}
+
+func (store *JobStore) Close() error {
+	if store == nil {
+		return nil
+	}
+	return store.db.Close()
+}
+
+func (store *JobStore) save(job *Job) error {
+	job.Updated = time.Now()
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).Put([]byte(job.ID), encoded)
+	})
+}
+
+func (store *JobStore) remove(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).Delete([]byte(id))
+	})
+}
+
+func (store *JobStore) Get(id string) (job *Job, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(jobsBucket)).Get([]byte(id))
+		if value == nil {
+			return errors.New("no job " + id)
+		}
+		job = &Job{store: store}
+		return json.Unmarshal(value, job)
+	})
+	return
+}
+
+//List returns every recorded job, oldest first
+func (store *JobStore) List() (jobs []Job, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobsBucket)).ForEach(func(key, value []byte) error {
+			var job Job
+			if err := json.Unmarshal(value, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+	return
+}
+
+//claim marks an interrupted job as running again, failing if something else already has
+func (store *JobStore) claim(id string) (job *Job, err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if job, err = store.Get(id); err != nil {
+		return
+	}
+	if job.State != JOB_STATE_INTERRUPTED {
+		return nil, errors.New("job " + id + " is " + job.State + ", only interrupted jobs can be resumed")
+	}
+	if !job.Resumable {
+		return nil, errors.New("job " + id + " (" + job.Command + ") cannot be resumed")
+	}
+	job.State = JOB_STATE_RUNNING
+	return job, store.save(job)
+}
+
+//abandon marks a job interrupted for good, keeping it listed with reason but refusing to resume it
+func (store *JobStore) abandon(id, reason string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	job, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	job.State = JOB_STATE_INTERRUPTED
+	job.Resumable = false
+	job.Error = reason
+	return store.save(job)
+}
+
+//startJob records the start of a long-running operation. It returns nil when job persistence is off, and Job's
+// methods accept a nil Job, so callers need not check. When the worker is resuming a job, that job is carried on instead
+func (worker *Worker) startJob(cmd string, params []string, resumable bool) *Job {
+	store := worker.Server.jobs
+	if store == nil {
+		return nil
+	}
+	if worker.resuming != nil && worker.resuming.Command == cmd {
+		job := worker.resuming
+		worker.resuming = nil
+		job.RequestID = worker.requestID
+		job.resumeFrom = job.Checkpoint
+		worker.job = job
+		return job
+	}
+
+	job := &Job{
+		ID:        worker.Server.nextRequestID(),
+		RequestID: worker.requestID,
+		Command:   cmd,
+		Params:    params,
+		State:     JOB_STATE_RUNNING,
+		Resumable: resumable,
+		Started:   time.Now(),
+		store:     store,
+	}
+	job.lastSaved = job.Started
+	if err := store.save(job); err != nil {
+		//losing the record shouldn't stop the operation itself
+		worker.logWarn("failed to record job", "error", err)
+		return nil
+	}
+	worker.job = job
+
+	return job
+}
+
+//finishJob drops the record of a job that ran to the end, successfully or not
+func (worker *Worker) finishJob(job *Job) {
+	if job == nil {
+		return
+	}
+	worker.job = nil
+	if err := job.store.remove(job.ID); err != nil {
+		worker.logWarn("failed to remove finished job", "job", job.ID, "error", err)
+	}
+}
+
+//interruptJob records that the worker died part way through its job
+func (worker *Worker) interruptJob(reason string) {
+	job := worker.job
+	if job == nil {
+		return
+	}
+	worker.job = nil
+	job.State = JOB_STATE_INTERRUPTED
+	job.Error = reason
+	job.store.save(job)
+}
+
+//done reports whether a resumed job already finished filePath before it was interrupted, returning
+// filepath.SkipDir for directories it finished entirely
+func (job *Job) done(filePath string, isDir bool) (bool, error) {
+	if job == nil || job.resumeFrom == "" {
+		return false, nil
+	}
+	done, skipErr := walkedPast(filePath, job.resumeFrom, isDir)
+	if !done {
+		//caught up; everything from here on is new work
+		job.resumeFrom = ""
+	}
+
+	return done, skipErr
+}
+
+//walkedPast reports whether a sorted walk picking up after checkpoint has already been through filePath. Everything
+// before the checkpoint in walk order was, so whole directories of it can be skipped with the returned filepath.SkipDir
+func walkedPast(filePath, checkpoint string, isDir bool) (bool, error) {
+	if filePath == checkpoint {
+		return true, nil
+	}
+	if !walkOrderBefore(filePath, checkpoint) {
+		return false, nil
+	}
+	if isDir && !strings.HasPrefix(checkpoint, filePath+string(os.PathSeparator)) {
+		return true, filepath.SkipDir
+	}
+
+	return true, nil
+}
+
+//checkpoint records that filePath is finished, saving to the state file every so often
+func (job *Job) checkpoint(filePath string) {
+	if job == nil {
+		return
+	}
+	job.Checkpoint = filePath
+	job.Processed++
+	if time.Since(job.lastSaved) >= job.store.checkpointInterval {
+		job.lastSaved = time.Now()
+		job.store.save(job)
+	}
+}
+
+//walkOrderBefore compares paths the way a sorted godirwalk visits them: component by component, parents first
+func walkOrderBefore(a, b string) bool {
+	aParts := strings.Split(a, string(os.PathSeparator))
+	bParts := strings.Split(b, string(os.PathSeparator))
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i]
+		}
+	}
+
+	return len(aParts) < len(bParts)
+}
+
+//resumeJob runs an interrupted job again from its checkpoint on this worker
+func (worker *Worker) resumeJob(id string) (reply []string, err error) {
+	store := worker.Server.jobs
+	if store == nil {
+		return nil, errors.New("job persistence is not enabled")
+	}
+	job, err := store.claim(id)
+	if err != nil {
+		return
+	}
+	worker.logMessage("resuming job", "job", id, "command", job.Command, "checkpoint", job.Checkpoint)
+
+	params := append([]string(nil), job.Params...)
+	if job.Command == "rm" && len(params) == REMOVE_PARAM_COUNT {
+		//some or all of it is already gone
+		params[REMOVE_PARAM_IGNORE_MISSING_IDX] = "true"
+	}
+	handler := worker.batchHandler(job.Command)
+	if handler == nil {
+		store.remove(id)
+		return nil, errors.New("job " + id + " has an unknown command " + job.Command)
+	}
+
+	worker.resuming = job
+	reply, err = handler(params)
+	if worker.resuming != nil {
+		//the operation finished without getting as far as the walk, e.g. the path is gone now
+		worker.resuming = nil
+		store.remove(id)
+	}
+
+	return
+}
+
+//resumeInterruptedJobs carries on with every resumable interrupted job, one at a time, on a worker of its own
+// outside the pool
+func (server *Server) resumeInterruptedJobs(jobs []Job) {
+	worker := &Worker{ID: -1, Server: server}
+	for _, job := range jobs {
+		if !job.Resumable {
+			continue
+		}
+		worker.setRequest(job.Command, server.nextRequestID())
+		if err := worker.resumeRecovering(job.ID); err != nil {
+			worker.logWarn("resumed job failed", "job", job.ID, "error", err)
+		} else {
+			worker.logMessage("resumed job finished", "job", job.ID)
+		}
+		worker.setRequest("", "")
+		if server.IsDraining() {
+			return
+		}
+	}
+}
+
+//resumeRecovering resumes a job at startup, where there's no pool worker to recover from a panic. A job that panics
+// once resumed would do it again on every start, so it is left interrupted and no longer resumable
+func (worker *Worker) resumeRecovering(id string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			worker.logError("resumed job died", "job", id, "panic", fmt.Sprint(r), "location",
+				panicUtil.IdentifyPanic())
+			worker.job, worker.resuming = nil, nil
+			err = errors.New("resumed job died: " + fmt.Sprint(r))
+			if abandonErr := worker.Server.jobs.abandon(id, err.Error()); abandonErr != nil {
+				worker.logWarn("failed to record abandoned job", "job", id, "error", abandonErr)
+			}
+		}
+	}()
+	_, err = worker.resumeJob(id)
+
+	return
+}
+
+const (
+	JOB_PARAM_COUNT  = 1
+	JOB_PARAM_ID_IDX = 0
+)
+
+//doJobs replies with the recorded jobs as JSON
+func (worker *Worker) doJobs(params []string) (reply []string, err error) {
+	if len(params) != 0 {
+		err = errors.New("Incorrect number of parameters to jobs. Expected 0 Got " + strconv.Itoa(len(params)))
+		return
+	}
+	if worker.Server.jobs == nil {
+		return nil, errors.New("job persistence is not enabled")
+	}
+
+	jobs, err := worker.Server.jobs.List()
+	if err != nil {
+		return
+	}
+	if jobs == nil {
+		jobs = []Job{}
+	}
+	encoded, err := worker.jsonReply(jobs)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//doJobResume resumes an interrupted job: job-resume|id
+func (worker *Worker) doJobResume(params []string) (reply []string, err error) {
+	if len(params) != JOB_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to job-resume. Expected " +
+			strconv.Itoa(JOB_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	return worker.resumeJob(params[JOB_PARAM_ID_IDX])
+}
+
+//doJobForget drops the record of an interrupted job that won't be resumed: job-forget|id
+func (worker *Worker) doJobForget(params []string) (reply []string, err error) {
+	if len(params) != JOB_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to job-forget. Expected " +
+			strconv.Itoa(JOB_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	store := worker.Server.jobs
+	if store == nil {
+		return nil, errors.New("job persistence is not enabled")
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	job, err := store.Get(params[JOB_PARAM_ID_IDX])
+	if err != nil {
+		return
+	}
+	if job.State != JOB_STATE_INTERRUPTED {
+		return nil, errors.New("job " + job.ID + " is " + job.State + ", only interrupted jobs can be forgotten")
+	}
+
+	return nil, store.remove(job.ID)
+}
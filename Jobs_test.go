@@ -0,0 +1,121 @@
+package FileDaemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karrick/godirwalk"
+)
+
+func TestWalkOrderBefore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "/d", b: "/d", want: false},
+		{a: "/d", b: "/d/a", want: true},
+		{a: "/d/a", b: "/d", want: false},
+		{a: "/d/a", b: "/d/b", want: true},
+		{a: "/d/b", b: "/d/a", want: false},
+		//a directory's contents come before its later siblings, whatever their names
+		{a: "/d/a/z", b: "/d/a.txt", want: true},
+		{a: "/d/a.txt", b: "/d/a/z", want: false},
+		{a: "/d/B", b: "/d/a", want: true},
+		{a: "/d/a/b/c", b: "/d/b", want: true},
+	}
+
+	for _, test := range tests {
+		if got := walkOrderBefore(test.a, test.b); got != test.want {
+			t.Errorf("walkOrderBefore(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+//walkOrderBefore has to agree with the order a sorted walk really takes, or resumed jobs would skip or redo entries
+func TestWalkOrderMatchesGodirwalk(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a", "a/z", "a-b", "B", "b"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"a.txt", "a/y", "a/z/x", "a-b/c", "b0"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var visited []string
+	err := godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			visited = append(visited, filePath)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(visited); i++ {
+		if !walkOrderBefore(visited[i-1], visited[i]) {
+			t.Errorf("%s was walked before %s", visited[i-1], visited[i])
+		}
+	}
+}
+
+func TestWalkedPast(t *testing.T) {
+	tests := []struct {
+		filePath, checkpoint string
+		isDir                bool
+		want                 bool
+		wantSkip             bool
+	}{
+		{filePath: "/d/b", checkpoint: "/d/b", want: true},
+		{filePath: "/d/a", checkpoint: "/d/b", want: true},
+		{filePath: "/d/c", checkpoint: "/d/b", want: false},
+		//a finished directory is skipped whole
+		{filePath: "/d/a", checkpoint: "/d/b", isDir: true, want: true, wantSkip: true},
+		//but not one the checkpoint is inside, which still has entries to come
+		{filePath: "/d", checkpoint: "/d/b", isDir: true, want: true},
+		{filePath: "/d/b", checkpoint: "/d/b/x", isDir: true, want: true},
+		{filePath: "/d/b/y", checkpoint: "/d/b/x", want: false},
+		//a sibling sharing the checkpoint's prefix isn't its parent
+		{filePath: "/d/b", checkpoint: "/d/b.txt", isDir: true, want: true, wantSkip: true},
+	}
+
+	for _, test := range tests {
+		done, err := walkedPast(test.filePath, test.checkpoint, test.isDir)
+		if done != test.want || (err == filepath.SkipDir) != test.wantSkip {
+			t.Errorf("walkedPast(%q, %q, %v) = %v, %v, want %v, skip %v", test.filePath, test.checkpoint, test.isDir,
+				done, err, test.want, test.wantSkip)
+		}
+	}
+}
+
+//a job abandoned after dying on resume stays listed but isn't picked up again on the next start
+func TestAbandonedJobIsNotResumed(t *testing.T) {
+	store, _, err := OpenJobStore(filepath.Join(t.TempDir(), "jobs.db"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	job := &Job{ID: "j1", Command: "rm", State: JOB_STATE_RUNNING, Resumable: true, store: store}
+	if err = store.save(job); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.abandon("j1", "resumed job died: boom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.claim("j1"); err == nil {
+		t.Error("an abandoned job was claimed for resuming")
+	}
+	saved, err := store.Get("j1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.State != JOB_STATE_INTERRUPTED || saved.Resumable || saved.Error == "" {
+		t.Errorf("abandoned job saved as %+v", saved)
+	}
+}
@@ -0,0 +1,428 @@
+package FileDaemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	JOURNAL_FILE_SUFFIX = ".journal"
+	//the raw NFSv4 ACL, which we save and put back byte for byte
+	JOURNAL_ACL_XATTR = "system.nfs4_acl"
+
+	JOURNAL_ENTRY_ATTRS = "attrs"
+	JOURNAL_ENTRY_TRASH = "trash"
+
+	//how often the server clears out trash past its retention
+	journalPurgeInterval = time.Hour
+)
+
+//request ids are base36 start time and sequence, see nextRequestID. Anything else could walk out of the journal dir
+var journalRequestIDPattern = regexp.MustCompile(`^[0-9a-z]+-[0-9a-z]+$`)
+
+//journalLock keeps undo and purge from working on the same journal at once
+var journalLock sync.Mutex
+
+//journalEntry is one line of a request's journal: either the attributes a path had before chmod or chown changed
+// them, or where rm put something in the trash
+type journalEntry struct {
+	Kind    string `json:"kind"`
+	Command string `json:"command"`
+	Path    string `json:"path"`
+	Mode    uint32 `json:"mode,omitempty"`
+	UID     int    `json:"uid"`
+	GID     int    `json:"gid"`
+	ACL     []byte `json:"acl,omitempty"`
+	Trash   string `json:"trash,omitempty"`
+}
+
+func journalFile(config *Config, requestID string) string {
+	return filepath.Join(config.JournalDir, requestID+JOURNAL_FILE_SUFFIX)
+}
+
+//appendJournal writes entries to the current request's journal. Entries are written before the change they describe
+func (worker *Worker) appendJournal(entries ...journalEntry) (err error) {
+	config := worker.Server.CurrentConfig()
+	if err = os.MkdirAll(config.JournalDir, 0700); err != nil {
+		return
+	}
+	file, err := os.OpenFile(journalFile(config, worker.requestID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for i := range entries {
+		if err = encoder.Encode(&entries[i]); err != nil {
+			file.Close()
+			return
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return
+	}
+
+	return file.Close()
+}
+
+//journalAttributes records the owner, mode and ACL of filePath, and everything beneath it when recursive, ahead of
+// cmd changing them. It reports whether anything was journaled, which is only when journaling is enabled
+func (worker *Worker) journalAttributes(cmd, filePath string, recursive bool) (journaled bool, err error) {
+	if !worker.Server.CurrentConfig().JournalEnabled {
+		return
+	}
+
+	var entries []journalEntry
+	if recursive {
+		err = godirwalk.Walk(filePath, &godirwalk.Options{
+			Unsorted: true,
+			Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+				entry, err := attributesEntry(cmd, subFilePath)
+				entries = append(entries, entry)
+				return err
+			},
+		})
+	} else {
+		var entry journalEntry
+		entry, err = attributesEntry(cmd, filePath)
+		entries = append(entries, entry)
+	}
+	if err != nil {
+		return
+	}
+	if err = worker.appendJournal(entries...); err != nil {
+		err = errors.New("Failed to write journal: " + err.Error())
+		return
+	}
+
+	return true, nil
+}
+
+func attributesEntry(cmd, filePath string) (entry journalEntry, err error) {
+	//chmod and chown follow symlinks, so what's recorded is what they change
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		err = errors.New("cannot read ownership of " + filePath)
+		return
+	}
+	entry = journalEntry{Kind: JOURNAL_ENTRY_ATTRS, Command: cmd, Path: filePath, Mode: stat.Mode & 07777,
+		UID: int(stat.Uid), GID: int(stat.Gid)}
+	if cmd != "chown" {
+		entry.ACL = readACLXattr(filePath)
+	}
+
+	return
+}
+
+//readACLXattr returns the raw NFSv4 ACL of filePath, or nil if it hasn't got one
+func readACLXattr(filePath string) []byte {
+	size, err := syscall.Getxattr(filePath, JOURNAL_ACL_XATTR, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	acl := make([]byte, size)
+	size, err = syscall.Getxattr(filePath, JOURNAL_ACL_XATTR, acl)
+	if err != nil {
+		return nil
+	}
+
+	return acl[:size]
+}
+
+//moveToTrash moves filePath into the trash directory of the volume it lives on, journaling where it went.
+// Staying on the same volume keeps the move a cheap rename however big the tree is
+func (worker *Worker) moveToTrash(filePath string) (err error) {
+	config := worker.Server.CurrentConfig()
+	filePath, err = filepath.Abs(filePath)
+	if err != nil {
+		return
+	}
+	root, err := volumeRoot(filePath)
+	if err != nil {
+		return
+	}
+	if root == filePath {
+		return errors.New("cannot move the root of a volume to the trash: " + filePath)
+	}
+
+	trashRoot := filepath.Join(root, config.TrashDirName)
+	if strings.HasPrefix(filePath+string(os.PathSeparator), trashRoot+string(os.PathSeparator)) {
+		return errors.New("cannot move the trash to the trash: " + filePath)
+	}
+	trashDir := filepath.Join(trashRoot, worker.requestID)
+	if err = os.MkdirAll(trashDir, 0700); err != nil {
+		return errors.New("Failed to create trash directory: " + err.Error())
+	}
+	//a batch can remove several things in one request, so number them
+	existing, err := os.ReadDir(trashDir)
+	if err != nil {
+		return
+	}
+	trashPath := filepath.Join(trashDir, strconv.Itoa(len(existing)))
+
+	err = worker.appendJournal(journalEntry{Kind: JOURNAL_ENTRY_TRASH, Command: "rm", Path: filePath, Trash: trashPath})
+	if err != nil {
+		return errors.New("Failed to write journal: " + err.Error())
+	}
+
+	return os.Rename(filePath, trashPath)
+}
+
+//volumeRoot finds the top directory of the filesystem filePath is on
+func volumeRoot(filePath string) (root string, err error) {
+	root = filepath.Dir(filePath)
+	fi, err := os.Stat(root)
+	if err != nil {
+		return
+	}
+	device := fi.Sys().(*syscall.Stat_t).Dev
+	for root != string(os.PathSeparator) {
+		parent := filepath.Dir(root)
+		fi, err = os.Stat(parent)
+		if err != nil {
+			return
+		}
+		if fi.Sys().(*syscall.Stat_t).Dev != device {
+			break
+		}
+		root = parent
+	}
+
+	return root, nil
+}
+
+func readJournal(file string) (entries []journalEntry, err error) {
+	return readJournalFrom(file, 0)
+}
+
+//readJournalFrom reads the entries written after offset, which must fall between entries
+func readJournalFrom(file string, offset int64) (entries []journalEntry, err error) {
+	handle, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer handle.Close()
+	if _, err = handle.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+
+	decoder := json.NewDecoder(handle)
+	for decoder.More() {
+		var entry journalEntry
+		if err = decoder.Decode(&entry); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	return
+}
+
+const (
+	UNDO_PARAM_COUNT       = 1
+	UNDO_PARAM_REQUEST_IDX = 0
+)
+
+//doUndo reverses a journaled request: owners, modes and ACLs are put back and trashed paths are moved back where
+// they were, newest first. Entries that are already back in place are skipped, so a partly failed undo can be retried
+func (worker *Worker) doUndo(params []string) (reply []string, err error) {
+	if len(params) != UNDO_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to undo. Expected " +
+			strconv.Itoa(UNDO_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	requestID := params[UNDO_PARAM_REQUEST_IDX]
+	if !journalRequestIDPattern.MatchString(requestID) {
+		err = errors.New("invalid request id " + requestID)
+		return
+	}
+
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	file := journalFile(worker.Server.CurrentConfig(), requestID)
+	entries, err := readJournal(file)
+	if os.IsNotExist(err) {
+		err = errors.New("no journal for request " + requestID + "; it was not journaled, has expired or was already undone")
+		return
+	} else if err != nil {
+		return
+	}
+
+	var failures []string
+	restored := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entryErr := worker.checkPaths(entry.Path); entryErr != nil {
+			failures = append(failures, entryErr.Error())
+			continue
+		}
+		if entryErr := undoEntry(entry); entryErr != nil {
+			failures = append(failures, entry.Path+": "+entryErr.Error())
+			continue
+		}
+		restored++
+	}
+	worker.logDebug("undo", "undone_request", requestID, "restored", restored, "failed", len(failures))
+	if len(failures) > 0 {
+		err = errors.New("Restored " + strconv.Itoa(restored) + " of " + strconv.Itoa(len(entries)) +
+			" entries: " + strings.Join(failures, ", "))
+		return
+	}
+
+	//everything is back, so the journal and the request's trash directories are done with
+	removeJournal(file, entries)
+	reply = []string{"restored " + strconv.Itoa(restored) + " entries"}
+
+	return
+}
+
+func undoEntry(entry journalEntry) error {
+	switch entry.Kind {
+	case JOURNAL_ENTRY_ATTRS:
+		//through symlinks, as the entry was recorded
+		if entry.Command == "chown" {
+			return os.Chown(entry.Path, entry.UID, entry.GID)
+		}
+		//the mode first, as setting it rewrites the ACL on NFSv4
+		if err := syscall.Chmod(entry.Path, entry.Mode); err != nil {
+			return err
+		}
+		if entry.ACL != nil {
+			return syscall.Setxattr(entry.Path, JOURNAL_ACL_XATTR, entry.ACL, 0)
+		}
+		return nil
+
+	case JOURNAL_ENTRY_TRASH:
+		_, trashErr := os.Lstat(entry.Trash)
+		_, pathErr := os.Lstat(entry.Path)
+		if os.IsNotExist(trashErr) && pathErr == nil {
+			//put back by an earlier undo
+			return nil
+		}
+		if trashErr != nil {
+			return errors.New("no longer in the trash: " + trashErr.Error())
+		}
+		if pathErr == nil {
+			return errors.New("something else now exists at this path")
+		}
+		return os.Rename(entry.Trash, entry.Path)
+	}
+
+	return errors.New("unknown journal entry " + entry.Kind)
+}
+
+//removeJournal deletes a journal along with whatever its request left in the trash
+func removeJournal(file string, entries []journalEntry) {
+	trashDirs := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Kind == JOURNAL_ENTRY_TRASH {
+			os.RemoveAll(entry.Trash)
+			trashDirs[filepath.Dir(entry.Trash)] = true
+		}
+	}
+	for trashDir := range trashDirs {
+		os.Remove(trashDir)
+	}
+	os.Remove(file)
+}
+
+//purgeJournal drops journals, and the trash they refer to, that were last written more than maxAge ago
+func (server *Server) purgeJournal(maxAge time.Duration) (purged int, err error) {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	config := server.CurrentConfig()
+	journals, err := os.ReadDir(config.JournalDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, journal := range journals {
+		if journal.IsDir() || !strings.HasSuffix(journal.Name(), JOURNAL_FILE_SUFFIX) {
+			continue
+		}
+		info, infoErr := journal.Info()
+		if infoErr != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		file := filepath.Join(config.JournalDir, journal.Name())
+		entries, readErr := readJournal(file)
+		if readErr != nil {
+			server.Logger.Warn("journal", "unreadable journal", "file", file, "error", readErr)
+		}
+		removeJournal(file, entries)
+		purged++
+	}
+
+	return
+}
+
+//purgeExpiredJournal clears out journals past the configured retention. It runs in the background, once at a time
+func (server *Server) purgeExpiredJournal() {
+	if !atomic.CompareAndSwapInt32(&server.purging, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&server.purging, 0)
+
+	purged, err := server.purgeJournal(server.CurrentConfig().TrashRetention)
+	if err != nil {
+		server.Logger.Error("journal", "failed to purge journal", "error", err)
+	} else if purged > 0 {
+		server.Logger.Info("journal", "purged expired journal", "requests", purged)
+	}
+}
+
+const (
+	TRASH_PURGE_PARAM_COUNT_MAX = 1
+	TRASH_PURGE_PARAM_HOURS_IDX = 0
+)
+
+//doTrashPurge empties the trash of requests older than the given number of hours, journal.retention_hours by default.
+// 0 empties it completely. Purged requests can no longer be undone
+func (worker *Worker) doTrashPurge(params []string) (reply []string, err error) {
+	if len(params) > TRASH_PURGE_PARAM_COUNT_MAX {
+		err = errors.New("Incorrect number of parameters to trash-purge. Expected at most " +
+			strconv.Itoa(TRASH_PURGE_PARAM_COUNT_MAX) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	maxAge := worker.Server.CurrentConfig().TrashRetention
+	if len(params) > 0 {
+		hours, parseErr := strconv.Atoi(params[TRASH_PURGE_PARAM_HOURS_IDX])
+		if parseErr != nil || hours < 0 {
+			err = errors.New("invalid age in hours " + params[TRASH_PURGE_PARAM_HOURS_IDX])
+			return
+		}
+		maxAge = time.Duration(hours) * time.Hour
+	}
+
+	purged, err := worker.Server.purgeJournal(maxAge)
+	if err != nil {
+		return
+	}
+	reply = []string{"purged " + strconv.Itoa(purged) + " requests"}
+
+	return
+}
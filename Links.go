@@ -0,0 +1,139 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	LINK_PARAM_COUNT        = 3
+	LINK_PARAM_REPLACE_IDX  = 0
+	LINK_PARAM_TARGET_IDX   = 1
+	LINK_PARAM_LINKPATH_IDX = 2
+
+	READLINK_PARAM_COUNT        = 1
+	READLINK_PARAM_FILEPATH_IDX = 0
+)
+
+//doLink creates a hard link (ln) or a symlink: ln|replace|target|link and symlink|replace|target|link.
+// The target has to pass the policy as well as the link, and a relative symlink target is checked from the link's
+// directory, where it will be resolved; see symlinkTarget. With replace, an existing link or file at link is swapped
+// for the new one by a rename, so nothing ever sees it missing
+func (worker *Worker) doLink(params []string, symbolic bool) (reply []string, err error) {
+	cmd := "ln"
+	if symbolic {
+		cmd = "symlink"
+	}
+	if len(params) != LINK_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to " + cmd + ". Expected " +
+			strconv.Itoa(LINK_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	replace, err := strconv.ParseBool(params[LINK_PARAM_REPLACE_IDX])
+	if err != nil {
+		return
+	}
+	target := params[LINK_PARAM_TARGET_IDX]
+	linkPath := filepath.Clean(params[LINK_PARAM_LINKPATH_IDX])
+	resolvedTarget := target
+	if symbolic && !filepath.IsAbs(target) {
+		if resolvedTarget, err = symlinkTarget(linkPath, target); err != nil {
+			return
+		}
+	}
+	if err = worker.checkPaths(resolvedTarget); err != nil {
+		return
+	}
+	if err = worker.checkLinkLocation(linkPath); err != nil {
+		return
+	}
+	if target == "" {
+		return nil, errors.New(cmd + " target can't be empty")
+	}
+
+	existing, statErr := os.Lstat(linkPath)
+	if statErr == nil && !replace {
+		return nil, errors.New("destination FilePath already exists")
+	}
+	if statErr == nil && existing.IsDir() {
+		return nil, errors.New("can't replace a directory with a link: " + linkPath)
+	}
+
+	create := os.Link
+	if symbolic {
+		create = os.Symlink
+	}
+	if statErr != nil {
+		//nothing to replace; the link call itself refuses if something appears in the meantime
+		err = create(target, linkPath)
+		return
+	}
+
+	tempPath := worker.tempSibling(linkPath)
+	if err = create(target, tempPath); err != nil {
+		return
+	}
+	if err = os.Rename(tempPath, linkPath); err != nil {
+		os.Remove(tempPath)
+	}
+
+	return
+}
+
+//symlinkTarget is where a relative symlink target leads from the link's directory. Joining them textually would drop
+// .. before the symlinks ahead of it are followed, which the kernel doesn't, so an existing target is resolved the way
+// the kernel will. One that doesn't exist yet can only be judged by its text, so it mustn't have .. in it
+func symlinkTarget(linkPath, target string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Dir(linkPath) + string(os.PathSeparator) + target)
+	if err == nil {
+		return resolved, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		if part == ".." {
+			return "", errors.New("symlink target can't use .. before it exists: " + target)
+		}
+	}
+
+	return filepath.Join(filepath.Dir(linkPath), target), nil
+}
+
+//doReadlink returns where a symlink points, as stored: readlink|path
+func (worker *Worker) doReadlink(params []string) (reply []string, err error) {
+	if len(params) != READLINK_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to readlink. Expected " +
+			strconv.Itoa(READLINK_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	filePath := filepath.Clean(params[READLINK_PARAM_FILEPATH_IDX])
+	if err = worker.checkLinkLocation(filePath); err != nil {
+		return
+	}
+	target, err := os.Readlink(filePath)
+	if err != nil {
+		return
+	}
+
+	return []string{target}, nil
+}
+
+//checkLinkLocation applies the policy to a link itself. Checking the link's own path would resolve it, judging
+// wherever an existing link points instead, so its directory is checked
+func (worker *Worker) checkLinkLocation(linkPath string) error {
+	if err := worker.checkPaths(filepath.Dir(linkPath)); err != nil {
+		return errors.New("path not permitted by policy: " + linkPath)
+	}
+	return nil
+}
+
+//tempSibling names a temporary path next to filePath. Being in the same directory keeps it on the same filesystem,
+// so it can be renamed over filePath atomically
+func (worker *Worker) tempSibling(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".fd-"+worker.requestID)
+}
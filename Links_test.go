@@ -0,0 +1,52 @@
+package FileDaemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//a relative target is judged where the kernel will take it, which .. after a symlink can put outside the allowed roots
+func TestSymlinkTargetFollowsSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{filepath.Join(root, "d"), filepath.Join(outside, "a")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "d", "x"), filepath.Join(root, "x"), filepath.Join(outside, "x")} {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "a"), filepath.Join(root, "d", "s")); err != nil {
+		t.Fatal(err)
+	}
+	worker := testWorker(t, root)
+
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "x"},
+		{target: "../x"},
+		{target: "missing"},
+		//textually d/x, but the kernel goes through s to outside/x
+		{target: "s/../x", wantErr: true},
+		{target: "s/x", wantErr: true},
+		//nothing to resolve yet, so .. can't be judged
+		{target: "../missing", wantErr: true},
+	}
+
+	for i, test := range tests {
+		linkPath := filepath.Join(root, "d", "link"+string(rune('a'+i)))
+		_, err := worker.doLink([]string{"false", test.target, linkPath}, true)
+		if (err != nil) != test.wantErr {
+			t.Errorf("symlink to %q: error = %v, want error %v", test.target, err, test.wantErr)
+		}
+		if _, lstatErr := os.Lstat(linkPath); (lstatErr == nil) == test.wantErr {
+			t.Errorf("symlink to %q: link exists = %v after error %v", test.target, lstatErr == nil, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package FileDaemon
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	LS_PARAM_COUNT_MIN = 1
+	LS_PARAM_DIR_IDX   = 0
+	//everything after the directory is key=value options
+	LS_PARAM_OPTIONS_IDX = 1
+
+	LS_DEFAULT_LIMIT = 1000
+	//a page is one reply string, so keep it to a size the socket handles comfortably
+	LS_MAX_LIMIT = 10000
+
+	LS_SORT_NAME  = "name"
+	LS_SORT_SIZE  = "size"
+	LS_SORT_MTIME = "mtime"
+)
+
+//EntryInfo is what ls and find report about an entry besides where it is. StatInfo is only filled in when asked for
+type EntryInfo struct {
+	//file, directory, symlink or other. This hides StatInfo's more detailed type in JSON
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+	*StatInfo
+}
+
+//ListEntry is one directory entry
+type ListEntry struct {
+	Name string `json:"name"`
+	EntryInfo
+}
+
+//ListPage is one page of a directory listing. Next is the cursor for the following page, empty on the last one
+type ListPage struct {
+	Entries []ListEntry `json:"entries"`
+	//entries matching the filters, across every page
+	Total int    `json:"total"`
+	Next  string `json:"next,omitempty"`
+}
+
+//listCursor marks the last entry of a page by its sort key and name, so the next page starts after it even if
+// entries were added or removed in between
+type listCursor struct {
+	sort    string
+	reverse bool
+	key     int64
+	name    string
+}
+
+//names can't contain /, which keeps the encoding unambiguous
+func (cursor listCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor.sort + "/" + strconv.FormatBool(cursor.reverse) + "/" +
+		strconv.FormatInt(cursor.key, 10) + "/" + cursor.name))
+}
+
+func decodeListCursor(encoded string) (cursor listCursor, err error) {
+	invalid := errors.New("invalid ls cursor " + encoded)
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, invalid
+	}
+	parts := strings.SplitN(string(decoded), "/", 4)
+	if len(parts) != 4 {
+		return cursor, invalid
+	}
+	cursor.sort, cursor.name = parts[0], parts[3]
+	if cursor.reverse, err = strconv.ParseBool(parts[1]); err != nil {
+		return cursor, invalid
+	}
+	if cursor.key, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return cursor, invalid
+	}
+
+	return cursor, nil
+}
+
+//listItem is an entry being sorted, with the key it sorts by
+type listItem struct {
+	entry ListEntry
+	key   int64
+}
+
+//doList lists a directory a page at a time: ls|dir[|key=value...]. Options are
+//	limit=N        entries per page, 1000 by default
+//	cursor=C       carry on from the Next of the previous page
+//	sort=name|size|mtime and reverse=true
+//	long=true      include each entry's stat metadata
+//	glob=PATTERN   only names matching the shell pattern
+//	type=T[,T...]  only file, directory, symlink or other entries
+// The directory is read in full for each page, so the cost of a page grows with the directory, but the reply doesn't
+func (worker *Worker) doList(params []string) (reply []string, err error) {
+	if len(params) < LS_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to ls. Expected at least " +
+			strconv.Itoa(LS_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	dirPath := params[LS_PARAM_DIR_IDX]
+	options, err := parseOptions("ls", params[LS_PARAM_OPTIONS_IDX:], "limit", "cursor", "sort", "reverse", "long",
+		"glob", "type")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(dirPath); err != nil {
+		return
+	}
+
+	limit := LS_DEFAULT_LIMIT
+	if value, ok := options["limit"]; ok {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > LS_MAX_LIMIT {
+			return nil, errors.New("ls limit must be between 1 and " + strconv.Itoa(LS_MAX_LIMIT))
+		}
+	}
+	sortBy := LS_SORT_NAME
+	if value, ok := options["sort"]; ok {
+		sortBy = value
+	}
+	if sortBy != LS_SORT_NAME && sortBy != LS_SORT_SIZE && sortBy != LS_SORT_MTIME {
+		return nil, errors.New("Unknown ls sort " + sortBy + ", expected " + LS_SORT_NAME + ", " + LS_SORT_SIZE +
+			" or " + LS_SORT_MTIME)
+	}
+	var reverse, long bool
+	if value, ok := options["reverse"]; ok {
+		if reverse, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+	if value, ok := options["long"]; ok {
+		if long, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+	glob := options["glob"]
+	if _, err = filepath.Match(glob, ""); err != nil {
+		return nil, errors.New("invalid ls glob " + glob + ": " + err.Error())
+	}
+	var types map[string]bool
+	if value, ok := options["type"]; ok {
+		if types, err = parseEntryTypes("ls", value); err != nil {
+			return
+		}
+	}
+	var cursor *listCursor
+	if value, ok := options["cursor"]; ok && value != "" {
+		decoded, decodeErr := decodeListCursor(value)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		if decoded.sort != sortBy || decoded.reverse != reverse {
+			return nil, errors.New("ls cursor was made with a different sort order")
+		}
+		cursor = &decoded
+	}
+
+	dirents, err := godirwalk.ReadDirents(dirPath, nil)
+	if err != nil {
+		return
+	}
+	worker.Server.metrics.addEntriesWalked("ls", len(dirents))
+
+	names := make(map[string]string)
+	items := make([]listItem, 0, len(dirents))
+	for _, de := range dirents {
+		entryType := direntTypeName(de)
+		if glob != "" {
+			if matched, _ := filepath.Match(glob, de.Name()); !matched {
+				continue
+			}
+		}
+		if types != nil && !types[entryType] {
+			continue
+		}
+		item := listItem{entry: ListEntry{Name: de.Name(), EntryInfo: EntryInfo{Type: entryType}}}
+		//sorting by metadata needs it for every entry, not just the ones on this page
+		if sortBy != LS_SORT_NAME {
+			worker.statEntry(filepath.Join(dirPath, item.entry.Name), &item.entry.EntryInfo, names)
+			if info := item.entry.StatInfo; info != nil && sortBy == LS_SORT_SIZE {
+				item.key = info.Size
+			} else if info != nil {
+				item.key = info.Mtime.UnixNano()
+			}
+		}
+		items = append(items, item)
+	}
+
+	before := func(a, b listItem) bool {
+		if a.key != b.key {
+			return (a.key < b.key) != reverse
+		}
+		if a.entry.Name == b.entry.Name {
+			return false
+		}
+		return (a.entry.Name < b.entry.Name) != reverse
+	}
+	sort.Slice(items, func(i, j int) bool { return before(items[i], items[j]) })
+
+	start := 0
+	if cursor != nil {
+		last := listItem{entry: ListEntry{Name: cursor.name}, key: cursor.key}
+		start = sort.Search(len(items), func(i int) bool { return before(last, items[i]) })
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := ListPage{Entries: make([]ListEntry, 0, end-start), Total: len(items)}
+	for _, item := range items[start:end] {
+		if long && item.entry.StatInfo == nil && item.entry.Error == "" {
+			worker.statEntry(filepath.Join(dirPath, item.entry.Name), &item.entry.EntryInfo, names)
+		}
+		if !long {
+			item.entry.StatInfo = nil
+		}
+		page.Entries = append(page.Entries, item.entry)
+	}
+	if end < len(items) {
+		last := items[end-1]
+		page.Next = listCursor{sort: sortBy, reverse: reverse, key: last.key, name: last.entry.Name}.encode()
+	}
+
+	encoded, err := worker.jsonReply(page)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//statEntry fills in the metadata of the entry at filePath, or the reason it couldn't be read
+func (worker *Worker) statEntry(filePath string, entry *EntryInfo, names map[string]string) {
+	info, err := worker.statInfo(filePath, false, names)
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	entry.StatInfo = info
+}
+
+//parseEntryTypes reads a comma separated type option of cmd into the set of types it allows
+func parseEntryTypes(cmd, value string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		if name != "file" && name != "directory" && name != "symlink" && name != "other" {
+			return nil, errors.New("Unknown " + cmd + " type " + name + ", expected file, directory, symlink or other")
+		}
+		types[name] = true
+	}
+
+	return types, nil
+}
+
+//direntTypeName sorts entries into the types ls and find can filter on
+func direntTypeName(de *godirwalk.Dirent) string {
+	switch {
+	case de.IsRegular():
+		return "file"
+	case de.IsDir():
+		return "directory"
+	case de.IsSymlink():
+		return "symlink"
+	}
+	return "other"
+}
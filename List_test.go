@@ -0,0 +1,80 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//listAll pages through dir, limit entries at a time, calling between after each page but the last
+func listAll(t *testing.T, worker *Worker, dir string, options []string, between func()) (names []string) {
+	t.Helper()
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("ls paging never finished")
+		}
+		reply, err := worker.doList(append([]string{dir, "limit=2", "cursor=" + cursor}, options...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page ListPage
+		if err = json.Unmarshal([]byte(reply[0]), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range page.Entries {
+			names = append(names, entry.Name)
+		}
+		if page.Next == "" {
+			return
+		}
+		cursor = page.Next
+		if between != nil {
+			between()
+		}
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	root := t.TempDir()
+	sizes := map[string]int{"a": 3, "b": 1, "c": 5, "d": 2, "e": 4}
+	for name, size := range sizes {
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worker := testWorker(t, root)
+
+	tests := []struct {
+		name    string
+		options []string
+		want    []string
+	}{
+		{name: "by name", want: []string{"a", "b", "c", "d", "e"}},
+		{name: "by name reversed", options: []string{"reverse=true"}, want: []string{"e", "d", "c", "b", "a"}},
+		{name: "by size", options: []string{"sort=size"}, want: []string{"b", "d", "a", "e", "c"}},
+		{name: "by size reversed", options: []string{"sort=size", "reverse=true"},
+			want: []string{"c", "e", "a", "d", "b"}},
+	}
+	for _, test := range tests {
+		if got := listAll(t, worker, root, test.options, nil); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: paged through %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	//the cursor names the last entry, so a page picks up after it even once that entry has gone
+	removed := false
+	got := listAll(t, worker, root, nil, func() {
+		if !removed {
+			removed = true
+			if err := os.Remove(filepath.Join(root, "b")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged through %v with the cursor's entry removed, want %v", got, want)
+	}
+}
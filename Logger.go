@@ -0,0 +1,341 @@
+package FileDaemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LOG_DEBUG || level > LOG_ERROR {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(level), nil
+		}
+	}
+	return LOG_INFO, errors.New("unknown log level " + name)
+}
+
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+
+	//component levels are configured as "component=level,component=level"
+	LOG_COMPONENT_LEVEL_SEP = "="
+
+	LOG_STDOUT = "stdout"
+	LOG_STDERR = "stderr"
+
+	bytesPerMegabyte = 1024 * 1024
+)
+
+//Logger writes leveled, structured records. Records at warn and above go to the error log, the rest to the main log.
+// Every record carries a timestamp, level, component and message, followed by any key/value fields given
+type Logger struct {
+	lock sync.Mutex
+
+	out, errorOut *logFile
+	format string
+	level LogLevel
+	componentLevels map[string]LogLevel
+	timeStamp func() string
+}
+
+func NewLogger(timeStamp func() string) *Logger {
+	return &Logger{
+		format:          LOG_FORMAT_LOGFMT,
+		level:           LOG_INFO,
+		componentLevels: make(map[string]LogLevel),
+		timeStamp:       timeStamp,
+		out:             &logFile{writer: os.Stdout},
+		errorOut:        &logFile{writer: os.Stderr},
+	}
+}
+
+//Configure applies the log settings from config, opening new log files where their names have changed.
+// It is used both at start up and on reload; on error the logger is left as it was
+func (logger *Logger) Configure(config *Config) error {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	maxSize := int64(config.LogMaxSize) * bytesPerMegabyte
+	out, err := logger.out.reconfigure(config.LogFile, LOG_STDOUT, os.Stdout, maxSize, config.LogMaxBackups)
+	if err != nil {
+		return err
+	}
+	errorOut, err := logger.errorOut.reconfigure(config.ErrorLogFile, LOG_STDERR, os.Stderr, maxSize, config.LogMaxBackups)
+	if err != nil {
+		if out != logger.out {
+			out.close()
+		}
+		return err
+	}
+
+	if out != logger.out {
+		logger.out.close()
+	}
+	if errorOut != logger.errorOut {
+		logger.errorOut.close()
+	}
+	logger.out, logger.errorOut = out, errorOut
+	logger.format = config.LogFormat
+	logger.level = config.LogLevel
+	logger.componentLevels = config.LogComponentLevels
+
+	return nil
+}
+
+//Reopen closes and reopens the log files in place, for use after logrotate has moved them
+func (logger *Logger) Reopen() error {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	if err := logger.out.reopen(); err != nil {
+		return err
+	}
+	return logger.errorOut.reopen()
+}
+
+//Enabled reports whether a record at level from component would be written
+func (logger *Logger) Enabled(level LogLevel, component string) bool {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	return level >= logger.threshold(component)
+}
+
+func (logger *Logger) threshold(component string) LogLevel {
+	if level, ok := logger.componentLevels[component]; ok {
+		return level
+	}
+	return logger.level
+}
+
+func (logger *Logger) Debug(component, message string, fields ...interface{}) {
+	logger.Log(LOG_DEBUG, component, message, fields...)
+}
+
+func (logger *Logger) Info(component, message string, fields ...interface{}) {
+	logger.Log(LOG_INFO, component, message, fields...)
+}
+
+func (logger *Logger) Warn(component, message string, fields ...interface{}) {
+	logger.Log(LOG_WARN, component, message, fields...)
+}
+
+func (logger *Logger) Error(component, message string, fields ...interface{}) {
+	logger.Log(LOG_ERROR, component, message, fields...)
+}
+
+//Log writes a record. fields are alternating keys and values
+func (logger *Logger) Log(level LogLevel, component, message string, fields ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+
+	if level < logger.threshold(component) {
+		return
+	}
+
+	record := append([]interface{}{
+		"ts", logger.timeStamp(),
+		"level", level.String(),
+		"component", component,
+		"msg", message,
+	}, fields...)
+
+	var line string
+	if logger.format == LOG_FORMAT_JSON {
+		line = encodeJSONRecord(record)
+	} else {
+		line = encodeLogfmtRecord(record)
+	}
+
+	out := logger.out
+	if level >= LOG_WARN {
+		out = logger.errorOut
+	}
+	out.write(line)
+}
+
+//encodeLogfmtRecord renders key/value pairs as key=value, quoting values that need it
+func encodeLogfmtRecord(record []interface{}) string {
+	var buffer strings.Builder
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(fmt.Sprint(record[i]))
+		buffer.WriteByte('=')
+		var value interface{}
+		if i+1 < len(record) {
+			value = record[i+1]
+		}
+		buffer.WriteString(logfmtValue(value))
+	}
+	buffer.WriteByte('\n')
+
+	return buffer.String()
+}
+
+func logfmtValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if err, ok := value.(error); ok {
+		text = err.Error()
+	}
+	if text == "" || strings.IndexFunc(text, func(r rune) bool {
+		return r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(text)
+	}
+
+	return text
+}
+
+//encodeJSONRecord renders key/value pairs as a JSON object, keeping them in the order given
+func encodeJSONRecord(record []interface{}) string {
+	var buffer strings.Builder
+	buffer.WriteByte('{')
+	for i := 0; i < len(record); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(record[i]))
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		var value interface{}
+		if i+1 < len(record) {
+			value = record[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buffer.Write(encoded)
+	}
+	buffer.WriteString("}\n")
+
+	return buffer.String()
+}
+
+//logFile is a log destination that can be reopened and rotates itself once it passes maxSize bytes
+type logFile struct {
+	path   string //empty for stdout and stderr
+	writer io.Writer
+	file   *os.File
+	size   int64
+
+	maxSize    int64 //0 disables rotation
+	maxBackups int
+}
+
+func openLogFile(path string, maxSize int64, maxBackups int) (*logFile, error) {
+	out := &logFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := out.open(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//reconfigure returns the logFile to use for name, reusing this one if it already points there
+func (out *logFile) reconfigure(name, stdName string, std io.Writer, maxSize int64, maxBackups int) (*logFile, error) {
+	if name == stdName {
+		if out.path == "" && out.writer == std {
+			return out, nil
+		}
+		return &logFile{writer: std}, nil
+	}
+	if out.path == name {
+		out.maxSize, out.maxBackups = maxSize, maxBackups
+		return out, nil
+	}
+
+	return openLogFile(name, maxSize, maxBackups)
+}
+
+func (out *logFile) open() error {
+	file, err := os.OpenFile(out.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return errors.New("Failed to open log file " + out.path + ":" + err.Error())
+	}
+	out.size = 0
+	if fi, err := file.Stat(); err == nil {
+		out.size = fi.Size()
+	}
+	out.file, out.writer = file, file
+
+	return nil
+}
+
+func (out *logFile) close() {
+	if out.file != nil {
+		out.file.Close()
+		out.file, out.writer = nil, nil
+	}
+}
+
+func (out *logFile) reopen() error {
+	if out.path == "" {
+		return nil
+	}
+	out.close()
+	return out.open()
+}
+
+func (out *logFile) write(line string) {
+	if out.path != "" && out.maxSize > 0 && out.size+int64(len(line)) > out.maxSize {
+		if err := out.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to rotate log file "+out.path+": "+err.Error())
+		}
+	}
+	if out.writer == nil {
+		return
+	}
+	written, _ := io.WriteString(out.writer, line)
+	out.size += int64(written)
+}
+
+//rotate shifts path.1 .. path.N-1 up one, moves the live file to path.1 and starts a fresh one
+func (out *logFile) rotate() error {
+	out.close()
+	if out.maxBackups > 0 {
+		os.Remove(out.path + "." + strconv.Itoa(out.maxBackups))
+		for backup := out.maxBackups - 1; backup >= 1; backup-- {
+			os.Rename(out.path+"."+strconv.Itoa(backup), out.path+"."+strconv.Itoa(backup+1))
+		}
+		if err := os.Rename(out.path, out.path+".1"); err != nil {
+			out.open()
+			return err
+		}
+	} else if err := os.Truncate(out.path, 0); err != nil {
+		out.open()
+		return err
+	}
+
+	return out.open()
+}
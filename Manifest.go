@@ -0,0 +1,375 @@
+package FileDaemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	MANIFEST_FORMAT_SUM  = "sum"
+	MANIFEST_FORMAT_JSON = "json"
+)
+
+//Manifest lists the digests of the regular files in a tree, with paths relative to its root
+type Manifest struct {
+	Algorithm string          `json:"algorithm"`
+	Root      string          `json:"root"`
+	Created   time.Time       `json:"created"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Digest string    `json:"digest"`
+}
+
+//buildManifest hashes every regular file under root with algorithm, in sorted order. Symlinks are not followed
+func (worker *Worker) buildManifest(algorithm, root string) (manifest Manifest, err error) {
+	if _, err = newChecksumHash(algorithm); err != nil {
+		return
+	}
+	manifest = Manifest{Algorithm: algorithm, Root: root, Created: time.Now().UTC(), Files: []ManifestEntry{}}
+
+	count := 0
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			count++
+			if !de.IsRegular() {
+				return nil
+			}
+			entry, err := worker.manifestEntry(algorithm, root, filePath, false)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, entry)
+			return nil
+		},
+	})
+	worker.Server.metrics.addEntriesWalked("manifest", count)
+
+	return
+}
+
+//manifestEntry hashes one file of a manifest, through the checksum cache unless force is set
+func (worker *Worker) manifestEntry(algorithm, root, filePath string, force bool) (entry ManifestEntry, err error) {
+	fi, err := os.Lstat(filePath)
+	if err != nil {
+		return
+	}
+	digests, err := worker.checksumFile(filePath, []string{algorithm}, 0, 0, force)
+	if err != nil {
+		return
+	}
+	relPath, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return
+	}
+
+	return ManifestEntry{Path: filepath.ToSlash(relPath), Size: fi.Size(), Mtime: fi.ModTime().UTC(),
+		Digest: digests[0]}, nil
+}
+
+//sumText writes the manifest the way sha256sum and friends do, so it can be checked with "sha256sum -c".
+// Names with a newline or backslash are escaped and the line marked with a leading backslash, as coreutils does
+func (manifest Manifest) sumText() string {
+	var text strings.Builder
+	for _, entry := range manifest.Files {
+		name := entry.Path
+		if strings.ContainsAny(name, "\\\n") {
+			name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+			text.WriteString("\\")
+		}
+		text.WriteString(entry.Digest + "  " + name + "\n")
+	}
+	return text.String()
+}
+
+//parseManifest reads a manifest in either format; anything starting with { is taken to be JSON.
+// Text manifests don't say which algorithm made them, so algorithm is used for those
+func parseManifest(content, algorithm string) (manifest Manifest, err error) {
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		err = json.Unmarshal([]byte(content), &manifest)
+		return
+	}
+
+	manifest.Algorithm = algorithm
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		//"digest  name" for text mode, "digest *name" for binary mode
+		space := strings.Index(line, " ")
+		if space < 0 || space+2 > len(line) || (line[space+1] != ' ' && line[space+1] != '*') {
+			return manifest, errors.New("manifest line " + strconv.Itoa(lineNumber) + " is not in checksum format")
+		}
+		name := line[space+2:]
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{Path: name, Digest: strings.ToLower(line[:space]), Size: -1})
+	}
+
+	return manifest, scanner.Err()
+}
+
+const (
+	MANIFEST_PARAM_COUNT_MIN  = 3
+	MANIFEST_PARAM_COUNT_MAX  = 4
+	MANIFEST_PARAM_ALGOR_IDX  = 0
+	MANIFEST_PARAM_DIR_IDX    = 1
+	MANIFEST_PARAM_FORMAT_IDX = 2
+	MANIFEST_PARAM_OUTPUT_IDX = 3
+)
+
+//doManifest hashes a tree: manifest|algorithm|dir|format[|output]. format is "sum", the sha256sum style text, or
+// "json", which adds sizes and mtimes. With output the manifest is written to that file, which must not exist and
+// gets the ACL of its directory, and the reply is the number of files; otherwise the manifest is the reply
+func (worker *Worker) doManifest(params []string) (reply []string, err error) {
+	if len(params) < MANIFEST_PARAM_COUNT_MIN || len(params) > MANIFEST_PARAM_COUNT_MAX {
+		err = errors.New("Incorrect number of parameters to manifest. Expected " +
+			strconv.Itoa(MANIFEST_PARAM_COUNT_MIN) + " or " + strconv.Itoa(MANIFEST_PARAM_COUNT_MAX) + " Got " +
+			strconv.Itoa(len(params)))
+		return
+	}
+
+	algorithm := params[MANIFEST_PARAM_ALGOR_IDX]
+	root := filepath.Clean(params[MANIFEST_PARAM_DIR_IDX])
+	format := params[MANIFEST_PARAM_FORMAT_IDX]
+	if format != MANIFEST_FORMAT_SUM && format != MANIFEST_FORMAT_JSON {
+		err = errors.New("Unknown manifest format " + format + ", expected " + MANIFEST_FORMAT_SUM + " or " +
+			MANIFEST_FORMAT_JSON)
+		return
+	}
+	var output string
+	if len(params) == MANIFEST_PARAM_COUNT_MAX {
+		output = params[MANIFEST_PARAM_OUTPUT_IDX]
+	}
+	if err = worker.checkPaths(root); err != nil {
+		return
+	}
+	if output != "" {
+		if err = worker.checkPaths(output); err != nil {
+			return
+		}
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("not a directory: " + root)
+	}
+
+	manifest, err := worker.buildManifest(algorithm, root)
+	if err != nil {
+		return
+	}
+
+	var content string
+	if format == MANIFEST_FORMAT_JSON {
+		var encoded []byte
+		if encoded, err = json.Marshal(manifest); err != nil {
+			return
+		}
+		content = string(encoded)
+	} else {
+		content = manifest.sumText()
+	}
+
+	if output != "" {
+		var file *os.File
+		if file, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+			return
+		}
+		if _, err = file.WriteString(content); err != nil {
+			file.Close()
+			return
+		}
+		if err = file.Close(); err != nil {
+			return
+		}
+		if err = worker.inheritACL(output, false); err != nil {
+			return
+		}
+		return []string{strconv.Itoa(len(manifest.Files))}, nil
+	}
+
+	if format == MANIFEST_FORMAT_JSON {
+		//re-encode so delimiters in names are escaped
+		content, err = worker.jsonReply(manifest)
+		return []string{content}, err
+	}
+	if strings.Contains(content, worker.Server.CurrentConfig().MessageDelimiter) {
+		return nil, errors.New("file names contain the message delimiter; use the json format or write to a file")
+	}
+
+	return []string{content}, nil
+}
+
+//VerifyResult reports how a tree compares to its manifest
+type VerifyResult struct {
+	OK         bool             `json:"ok"`
+	Checked    int              `json:"checked"`
+	Matched    int              `json:"matched"`
+	Missing    []string         `json:"missing"`
+	Extra      []string         `json:"extra"`
+	Mismatched []VerifyMismatch `json:"mismatched"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type VerifyMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	//set when the size alone showed the file had changed, so it wasn't hashed
+	Reason string `json:"reason,omitempty"`
+}
+
+const (
+	VERIFY_PARAM_COUNT_MIN    = 3
+	VERIFY_PARAM_ALGOR_IDX    = 0
+	VERIFY_PARAM_DIR_IDX      = 1
+	VERIFY_PARAM_MANIFEST_IDX = 2
+)
+
+//doVerify checks a tree against a manifest: verify|algorithm|dir|manifest. manifest is either the absolute path of
+// a manifest file or the manifest itself, as the rest of the message. algorithm is used for text manifests; JSON ones
+// name their own. The reply is the comparison as JSON, and the request fails, with the same JSON, if anything differs
+func (worker *Worker) doVerify(params []string) (reply []string, err error) {
+	if len(params) < VERIFY_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to verify. Expected " +
+			strconv.Itoa(VERIFY_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	algorithm := params[VERIFY_PARAM_ALGOR_IDX]
+	root := filepath.Clean(params[VERIFY_PARAM_DIR_IDX])
+	content := strings.Join(params[VERIFY_PARAM_MANIFEST_IDX:], worker.Server.CurrentConfig().MessageDelimiter)
+	if err = worker.checkPaths(root); err != nil {
+		return
+	}
+	if filepath.IsAbs(content) && len(params) == VERIFY_PARAM_COUNT_MIN {
+		if err = worker.checkPaths(content); err != nil {
+			return
+		}
+		var data []byte
+		if data, err = os.ReadFile(content); err != nil {
+			return
+		}
+		content = string(data)
+	}
+
+	manifest, err := parseManifest(content, algorithm)
+	if err != nil {
+		err = errors.New("Invalid manifest: " + err.Error())
+		return
+	}
+	if _, err = newChecksumHash(manifest.Algorithm); err != nil {
+		return
+	}
+
+	result := VerifyResult{Missing: []string{}, Extra: []string{}, Mismatched: []VerifyMismatch{}}
+	listed := make(map[string]bool, len(manifest.Files))
+	for _, expected := range manifest.Files {
+		listed[expected.Path] = true
+		filePath := filepath.Join(root, filepath.FromSlash(expected.Path))
+		//a manifest can't send us outside the tree we were asked to check
+		if rel, relErr := filepath.Rel(root, filePath); relErr != nil || strings.HasPrefix(rel, "..") {
+			result.Errors = append(result.Errors, expected.Path+": outside the tree")
+			continue
+		}
+		//nor through a symlink somewhere along the way
+		if policyErr := worker.checkPaths(filePath); policyErr != nil {
+			result.Errors = append(result.Errors, expected.Path+": "+policyErr.Error())
+			continue
+		}
+		result.Checked++
+
+		fi, statErr := os.Lstat(filePath)
+		if os.IsNotExist(statErr) {
+			result.Missing = append(result.Missing, expected.Path)
+			continue
+		} else if statErr != nil {
+			result.Errors = append(result.Errors, expected.Path+": "+statErr.Error())
+			continue
+		}
+		//manifests only list regular files, so a symlink or anything else in the way has changed, and isn't read
+		if !fi.Mode().IsRegular() {
+			result.Mismatched = append(result.Mismatched, VerifyMismatch{Path: expected.Path,
+				Expected: expected.Digest, Reason: "not a regular file"})
+			continue
+		}
+		if expected.Size >= 0 && fi.Size() != expected.Size {
+			result.Mismatched = append(result.Mismatched, VerifyMismatch{Path: expected.Path,
+				Expected: expected.Digest, Reason: "size changed from " + strconv.FormatInt(expected.Size, 10) +
+					" to " + strconv.FormatInt(fi.Size(), 10)})
+			continue
+		}
+
+		//verifying is about catching changes the metadata doesn't show, so it always reads the file
+		actual, hashErr := worker.manifestEntry(manifest.Algorithm, root, filePath, true)
+		if hashErr != nil {
+			result.Errors = append(result.Errors, expected.Path+": "+hashErr.Error())
+			continue
+		}
+		if actual.Digest != expected.Digest {
+			result.Mismatched = append(result.Mismatched, VerifyMismatch{Path: expected.Path,
+				Expected: expected.Digest, Actual: actual.Digest})
+			continue
+		}
+		result.Matched++
+	}
+
+	//anything on disk the manifest doesn't know about
+	count := 0
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			count++
+			if !de.IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, filePath)
+			if err != nil {
+				return err
+			}
+			if !listed[filepath.ToSlash(rel)] {
+				result.Extra = append(result.Extra, filepath.ToSlash(rel))
+			}
+			return nil
+		},
+	})
+	worker.Server.metrics.addEntriesWalked("verify", count)
+	if err != nil {
+		return
+	}
+	sort.Strings(result.Extra)
+
+	result.OK = len(result.Missing) == 0 && len(result.Extra) == 0 && len(result.Mismatched) == 0 &&
+		len(result.Errors) == 0
+	encoded, err := worker.jsonReply(result)
+	if err != nil {
+		return
+	}
+	if !result.OK {
+		return nil, errors.New(encoded)
+	}
+
+	return []string{encoded}, nil
+}
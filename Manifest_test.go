@@ -0,0 +1,115 @@
+package FileDaemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestSumTextRoundTrip(t *testing.T) {
+	digest := hex.EncodeToString(make([]byte, sha256.Size))
+	manifest := Manifest{Algorithm: "sha256"}
+	for _, name := range []string{"plain", "with space", "dir/nested", `back\slash`, "new\nline", `literal\n`, " lead"} {
+		manifest.Files = append(manifest.Files, ManifestEntry{Path: name, Digest: digest, Size: -1})
+	}
+
+	parsed, err := parseManifest(manifest.sumText(), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, manifest) {
+		t.Errorf("round trip gave %+v, want %+v", parsed, manifest)
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []ManifestEntry
+		wantErr bool
+	}{
+		{name: "text mode", content: "AB12  a\n", want: []ManifestEntry{{Path: "a", Digest: "ab12", Size: -1}}},
+		{name: "binary mode", content: "ab12 *a\n", want: []ManifestEntry{{Path: "a", Digest: "ab12", Size: -1}}},
+		{name: "blank lines", content: "\nab12  a\n\nab12  b",
+			want: []ManifestEntry{{Path: "a", Digest: "ab12", Size: -1}, {Path: "b", Digest: "ab12", Size: -1}}},
+		{name: "escaped", content: "\\ab12  a\\\\b\\nc\n",
+			want: []ManifestEntry{{Path: "a\\b\nc", Digest: "ab12", Size: -1}}},
+		{name: "json", content: `{"algorithm":"md5","files":[{"path":"a","size":3,"digest":"ab12"}]}`,
+			want: []ManifestEntry{{Path: "a", Digest: "ab12", Size: 3}}},
+		{name: "no separator", content: "ab12\n", wantErr: true},
+		{name: "one space", content: "ab12 a\n", wantErr: true},
+		{name: "no name", content: "ab12 \n", wantErr: true},
+		{name: "bad json", content: "{files", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, err := parseManifest(test.content, "sha256")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(manifest.Files, test.want) {
+				t.Errorf("files = %+v, want %+v", manifest.Files, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyDoesNotFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	tree := filepath.Join(root, "tree")
+	outside := filepath.Join(root, "outside")
+	for _, dir := range []string{tree, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secret := []byte("secret")
+	if err := os.WriteFile(filepath.Join(outside, "x"), secret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(tree, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "x"), filepath.Join(tree, "last")); err != nil {
+		t.Fatal(err)
+	}
+	//and one that stays inside, which is allowed but still isn't the regular file a manifest lists
+	if err := os.WriteFile(filepath.Join(tree, "a"), secret, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(tree, "inner")); err != nil {
+		t.Fatal(err)
+	}
+
+	//a wrong digest, so a file that was read would come back with its real one
+	wrong := hex.EncodeToString(make([]byte, sha256.Size))
+	manifest := wrong + "  link/x\n" + wrong + "  last\n" + wrong + "  inner\n"
+	worker := testWorker(t, tree)
+	_, err := worker.doVerify([]string{"sha256", tree, manifest})
+	if err == nil {
+		t.Fatal("verify passed a manifest reaching outside the tree")
+	}
+	var result VerifyResult
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &result); jsonErr != nil {
+		t.Fatalf("verify failed without a result: %v", err)
+	}
+
+	digest := sha256.Sum256(secret)
+	for _, mismatch := range result.Mismatched {
+		if mismatch.Actual == hex.EncodeToString(digest[:]) {
+			t.Errorf("%s was read through a symlink", mismatch.Path)
+		}
+	}
+	if len(result.Errors) != 2 {
+		t.Errorf("link/x and last should be refused by the policy, got errors %v", result.Errors)
+	}
+	if len(result.Mismatched) != 1 || result.Mismatched[0].Path != "inner" || result.Mismatched[0].Actual != "" {
+		t.Errorf("inner should be a mismatch that wasn't hashed, got %+v", result.Mismatched)
+	}
+}
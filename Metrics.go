@@ -0,0 +1,211 @@
+package FileDaemon
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE   = "filedaemon"
+	METRICS_PATH        = "/metrics"
+	METRICS_UNIX_PREFIX = "unix:"
+	//label used for commands we don't recognise, so junk requests can't blow up label cardinality
+	METRICS_UNKNOWN_COMMAND = "unknown"
+)
+
+//Metrics holds the Prometheus collectors the daemon reports through.
+// They are always collected; the listener serving them is optional
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests      *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	entriesWalked *prometheus.CounterVec
+	bytesCopied   prometheus.Counter
+	workerDeaths  prometheus.Counter
+	checksumCache *prometheus.CounterVec
+
+	listener   net.Listener
+	httpServer *http.Server
+
+	//a plain copy of the per-command figures, for the status command
+	commandLock sync.Mutex
+	commands    map[string]*CommandStats
+}
+
+//CommandStats summarises the requests seen for one command
+type CommandStats struct {
+	Requests     uint64  `json:"requests"`
+	Errors       uint64  `json:"errors"`
+	TotalSeconds float64 `json:"total_seconds"`
+}
+
+func NewMetrics(server *Server) *Metrics {
+	metrics := Metrics{registry: prometheus.NewRegistry(), commands: make(map[string]*CommandStats)}
+
+	metrics.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "requests_total",
+		Help:      "Requests handled by workers, by command.",
+	}, []string{"command"})
+	metrics.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "request_errors_total",
+		Help:      "Requests that replied false, by command.",
+	}, []string{"command"})
+	metrics.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "request_duration_seconds",
+		Help:      "Time spent handling requests, by command.",
+		//1ms up to ~4 minutes, recursive operations on big trees take a while
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"command"})
+	metrics.entriesWalked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "entries_walked_total",
+		Help:      "Filesystem entries visited, by command.",
+	}, []string{"command"})
+	metrics.bytesCopied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "bytes_copied_total",
+		Help:      "Bytes of file data copied by cp.",
+	})
+	metrics.workerDeaths = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "worker_deaths_total",
+		Help:      "Workers that exited unexpectedly and were replaced.",
+	})
+
+	metrics.checksumCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "checksum_cache_lookups_total",
+		Help:      "Checksum cache lookups, by result: hit or miss.",
+	}, []string{"result"})
+
+	metrics.registry.MustRegister(metrics.requests, metrics.errors, metrics.duration, metrics.entriesWalked,
+		metrics.bytesCopied, metrics.workerDeaths, metrics.checksumCache)
+
+	//point in time values are read straight off the server when scraped
+	metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "workers",
+		Help:      "Workers in the pool.",
+	}, func() float64 {
+		return float64(atomic.LoadInt32(&server.workerCount))
+	}))
+	metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "workers_active",
+		Help:      "Workers currently handling a request.",
+	}, func() float64 {
+		return float64(atomic.LoadInt32(&server.busyWorkers))
+	}))
+	metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "queue_depth",
+		Help:      "Requests accepted by the broker that no worker has picked up yet.",
+	}, func() float64 {
+		return float64(server.queueDepth())
+	}))
+	metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "requests_in_flight",
+		Help:      "Requests accepted by the broker and not yet replied to.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&server.requestsInFlight))
+	}))
+
+	return &metrics
+}
+
+//observeRequest records the outcome of one request
+func (metrics *Metrics) observeRequest(cmd string, err error, seconds float64) {
+	metrics.requests.WithLabelValues(cmd).Inc()
+	if err != nil {
+		metrics.errors.WithLabelValues(cmd).Inc()
+	}
+	metrics.duration.WithLabelValues(cmd).Observe(seconds)
+
+	metrics.commandLock.Lock()
+	defer metrics.commandLock.Unlock()
+	stats, ok := metrics.commands[cmd]
+	if !ok {
+		stats = &CommandStats{}
+		metrics.commands[cmd] = stats
+	}
+	stats.Requests++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.TotalSeconds += seconds
+}
+
+//CommandStats returns a copy of the per-command figures
+func (metrics *Metrics) CommandStats() map[string]CommandStats {
+	metrics.commandLock.Lock()
+	defer metrics.commandLock.Unlock()
+
+	commands := make(map[string]CommandStats, len(metrics.commands))
+	for cmd, stats := range metrics.commands {
+		commands[cmd] = *stats
+	}
+
+	return commands
+}
+
+//addEntriesWalked counts filesystem entries a command visited
+func (metrics *Metrics) addEntriesWalked(cmd string, count int) {
+	metrics.entriesWalked.WithLabelValues(cmd).Add(float64(count))
+}
+
+//checksumCacheResult counts a checksum cache lookup
+func (metrics *Metrics) checksumCacheResult(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.checksumCache.WithLabelValues(result).Inc()
+}
+
+//Listen starts serving the metrics on address, either host:port or unix:/path/to/socket
+func (metrics *Metrics) Listen(address string) (err error) {
+	network := "tcp"
+	if strings.HasPrefix(address, METRICS_UNIX_PREFIX) {
+		network = "unix"
+		address = strings.TrimPrefix(address, METRICS_UNIX_PREFIX)
+		//clear out a socket left behind by an unclean exit
+		if err = os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	metrics.listener, err = net.Listen(network, address)
+	if err != nil {
+		return errors.New("Failed to open metrics listener " + address + ": " + err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+	metrics.httpServer = &http.Server{Handler: mux}
+	go metrics.httpServer.Serve(metrics.listener)
+
+	return nil
+}
+
+//Close stops the metrics listener, if one was started. Unix listeners remove their socket file on close
+func (metrics *Metrics) Close() error {
+	if metrics.httpServer == nil {
+		return nil
+	}
+
+	return metrics.httpServer.Close()
+}
@@ -0,0 +1,64 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//who a symbolic mode clause applies to, each with the special bit that goes with it
+var symbolicModeWho = map[byte]uint32{'u': 04700, 'g': 02070, 'o': 01007, 'a': 07777}
+
+//and the bits each permission letter stands for, before being narrowed to who
+var symbolicModePerms = map[byte]uint32{'r': 0444, 'w': 0222, 'x': 0111, 's': 06000, 't': 01000}
+
+//parseFileMode reads permissions given in octal, such as 0755, or as chmod style symbolic clauses, such as
+// u=rwx,g+rx,o-w. Symbolic clauses are applied in order to base, raw permission bits like 0777. A clause without
+// u, g, o or a applies to everyone
+func parseFileMode(spec string, base uint32) (os.FileMode, error) {
+	invalid := errors.New("invalid mode " + spec + ", expected octal such as 0755 or symbolic such as u=rwx,go=rx")
+	if octal, err := strconv.ParseUint(spec, 8, 32); err == nil {
+		if octal > 07777 {
+			return 0, invalid
+		}
+		return fileModeOf(uint32(octal)), nil
+	}
+
+	mode := base
+	for _, clause := range strings.Split(spec, ",") {
+		i := 0
+		var who uint32
+		for ; i < len(clause) && symbolicModeWho[clause[i]] != 0; i++ {
+			who |= symbolicModeWho[clause[i]]
+		}
+		if who == 0 {
+			who = symbolicModeWho['a']
+		}
+		if i == len(clause) {
+			return 0, invalid
+		}
+		//each clause can hold several operations, like u+r-w
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return 0, invalid
+			}
+			var perms uint32
+			for i++; i < len(clause) && symbolicModePerms[clause[i]] != 0; i++ {
+				perms |= symbolicModePerms[clause[i]]
+			}
+			perms &= who
+			switch op {
+			case '+':
+				mode |= perms
+			case '-':
+				mode &^= perms
+			case '=':
+				mode = mode&^who | perms
+			}
+		}
+	}
+
+	return fileModeOf(mode), nil
+}
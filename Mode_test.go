@@ -0,0 +1,50 @@
+package FileDaemon
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		spec    string
+		base    uint32
+		want    os.FileMode
+		wantErr bool
+	}{
+		{spec: "755", base: 0777, want: 0755},
+		{spec: "0755", base: 0777, want: 0755},
+		{spec: "0", base: 0777, want: 0},
+		{spec: "4755", base: 0777, want: 0755 | os.ModeSetuid},
+		{spec: "1777", base: 0777, want: 0777 | os.ModeSticky},
+		{spec: "u=rwx,go=rx", base: 0777, want: 0755},
+		{spec: "u=rwx,go=rx", base: 0, want: 0755},
+		{spec: "a+x", base: 0644, want: 0755},
+		{spec: "+x", base: 0644, want: 0755},
+		{spec: "g-w", base: 0777, want: 0757},
+		{spec: "o=", base: 0777, want: 0770},
+		{spec: "u+r-w", base: 0333, want: 0533},
+		{spec: "ug+s", base: 0755, want: 0755 | os.ModeSetuid | os.ModeSetgid},
+		{spec: "10000", wantErr: true},
+		{spec: "77777", wantErr: true},
+		{spec: "0788", wantErr: true},
+		{spec: "", wantErr: true},
+		{spec: "u", wantErr: true},
+		{spec: "u=rwq", wantErr: true},
+		{spec: "u=rwx,", wantErr: true},
+		{spec: "z+x", wantErr: true},
+		{spec: "u*x", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			mode, err := parseFileMode(test.spec, test.base)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if mode != test.want {
+				t.Errorf("mode = %v, want %v", mode, test.want)
+			}
+		})
+	}
+}
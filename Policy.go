@@ -0,0 +1,87 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//resolvePath cleans a path and resolves symlinks in as much of it as exists,
+// so a link inside an allowed root can't be used to reach outside of it
+func resolvePath(filePath string) string {
+	filePath = filepath.Clean(filePath)
+	existing := filePath
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return filePath
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = parent
+	}
+}
+
+//AllowsPath reports whether the policy permits requests to touch filePath
+func (config *Config) AllowsPath(filePath string) bool {
+	if len(config.AllowedRoots) == 0 {
+		return true
+	}
+	//the server needs to manage its own socket regardless of where it lives
+	if filepath.Clean(filePath) == filepath.Clean(config.RequestSocketFileName) {
+		return true
+	}
+	if !filepath.IsAbs(filePath) {
+		return false
+	}
+
+	resolved := resolvePath(filePath)
+	for _, root := range config.AllowedRoots {
+		if resolved == root || root == string(os.PathSeparator) || strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//checkPaths returns an error naming the first path the policy does not allow
+func (worker *Worker) checkPaths(filePaths ...string) error {
+	config := worker.Server.CurrentConfig()
+	for _, filePath := range filePaths {
+		if !config.AllowsPath(filePath) {
+			return errors.New("path not permitted by policy: " + filePath)
+		}
+	}
+
+	return nil
+}
+
+//AllowsXattr reports whether the policy permits requests to read or change the extended attribute name
+func (config *Config) AllowsXattr(name string) bool {
+	namespace := strings.SplitN(name, ".", 2)
+	if len(namespace) != 2 || namespace[1] == "" {
+		return false
+	}
+	for _, allowed := range config.XattrNamespaces {
+		if namespace[0] == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+//checkXattr returns an error if the policy does not allow the extended attribute name
+func (worker *Worker) checkXattr(name string) error {
+	if !worker.Server.CurrentConfig().AllowsXattr(name) {
+		return errors.New("extended attribute not permitted by policy: " + name)
+	}
+
+	return nil
+}
@@ -1,87 +1,105 @@
 package FileDaemon
 
 import (
+	"errors"
 	"time"
 	"log"
 	"os"
 	zmq "github.com/pebbe/zmq4"
-	"io"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 type Server struct {
 	Active bool
-	Config *Config
 	ZMQContext *zmq.Context
+	StartTime time.Time
 
 	WorkerID int
-	Workers map[int]Worker
+	Workers map[int]*Worker
+	//guards Workers; only the server goroutine changes it, so it need only lock to write
+	workersLock sync.Mutex
+	workerRestarts uint64
 	Notify chan int
 
-	Log, ErrorLog *log.Logger
+	Logger *Logger
+
+	//the running configuration. Swapped wholesale on reload, so read it through CurrentConfig
+	config *Config
+	configLock sync.RWMutex
+	reloadRequests chan chan reloadResult
+	//how many workers should retire to bring the pool down to size after a reload
+	surplusWorkers int32
+
+	metrics *Metrics
+	//pool size and busy workers, kept atomically so metrics can read them from any goroutine
+	workerCount, busyWorkers int32
+
+	//shutdown bookkeeping. draining is flipped once and read by the broker and workers, so it is atomic
+	draining int32
+	shutdownRequests chan string
+	stopped chan struct{}
+	brokerStop, brokerDone chan struct{}
+
+	//request accounting, maintained with sync/atomic
+	requestsInFlight int64
+	requestsHandled, requestsFailed, requestsRejected uint64
+	requestSequence uint64
+
+	//set while a journal purge runs in the background, and when the last one started
+	purging int32
+	lastJournalPurge time.Time
+
+	//records long-running jobs, nil when jobs.state_file isn't set
+	jobs *JobStore
+
+	//digests of unchanged files, nil when checksum.cache_file isn't set. pruningCache is set while a prune runs
+	checksumCache *ChecksumCache
+	pruningCache int32
+	lastCachePrune time.Time
 }
 
 func NewServer(config *Config) (*Server) {
-	server := Server{ Active: false, Config: config, WorkerID: 0 }
+	server := Server{ Active: false, config: config, WorkerID: 0 }
 
-	server.Workers = make(map[int]Worker)
+	server.Workers = make(map[int]*Worker)
     server.Notify = make(chan int, config.NumberOfWorkers)
-
-    var logStream io.Writer
-    if server.Config.LogFile != "stdout" {
-		file, err := os.OpenFile(server.Config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
-		if err != nil {
-			log.Fatalln("Failed to open log file " + server.Config.LogFile + ":" + err.Error())
-		}
-		logStream = file
-
-	} else {
-		logStream = os.Stdout
+	server.shutdownRequests = make(chan string, 1)
+	server.reloadRequests = make(chan chan reloadResult)
+	server.stopped = make(chan struct{})
+	server.brokerStop = make(chan struct{})
+	server.brokerDone = make(chan struct{})
+
+	server.Logger = NewLogger(server.getTimeStamp)
+	if err := server.Logger.Configure(config); err != nil {
+		log.Fatalln(err)
 	}
-	server.Log = log.New(logStream, "", 0)
-
-	var errorLogStream io.Writer
-	if server.Config.ErrorLogFile != "stderr" {
-		file, err := os.OpenFile(server.Config.ErrorLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
-		if err != nil {
-			log.Fatalln("Failed to open log file " + server.Config.ErrorLogFile + ":" + err.Error())
-		}
-		errorLogStream = file
-
-	} else {
-		errorLogStream = os.Stderr
-	}
-	server.ErrorLog = log.New(errorLogStream, "", 0)
-
+	server.metrics = NewMetrics(&server)
 
 	return &server
 }
 
-type Config struct {
-	TimeStampFormat string
-	TimeZoneName string
-	TimeZone *time.Location
-
-	NumberOfWorkers int
-
-	RequestSocketFileName string
-	RequestSocketFile     string
-	WorkerSocketFileName  string
-	WorkerSocketFile      string
-
-	WorkerFailureTimeout int
-	WorkerFailureThreshold int
-
-	MessageDelimiter string
-	LogFile, ErrorLogFile string
+//CurrentConfig returns the configuration in force. It may be replaced by a reload at any time,
+// so callers needing several settings to agree should hold on to the returned pointer
+func (server *Server) CurrentConfig() *Config {
+	server.configLock.RLock()
+	defer server.configLock.RUnlock()
+	return server.config
 }
 
-func (server Server) getTimeStamp() string {
-	now := time.Now().In(server.Config.TimeZone)
-	return now.Format(server.Config.TimeStampFormat)
+func (server *Server) getTimeStamp() string {
+	config := server.CurrentConfig()
+	now := time.Now().In(config.TimeZone)
+	return now.Format(config.TimeStampFormat)
 }
 
 func (server *Server) RunServer() {
 	server.Active = true
+	server.StartTime = time.Now()
 	context, err := zmq.NewContext()
 	if err != nil {
 		log.Fatal(err)
@@ -92,75 +110,239 @@ func (server *Server) RunServer() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer router.Close()
-	socketFile := server.Config.RequestSocketFile
+	router.SetLinger(0) //don't hold up context termination on replies nobody is waiting for
+	config := server.CurrentConfig()
+	//before anything is bound or started, so a listener that can't open leaves nothing behind
+	if config.MetricsListen != "" {
+		if err := server.metrics.Listen(config.MetricsListen); err != nil {
+			log.Fatal(err)
+		}
+		server.Logger.Info("server", "metrics listening", "address", config.MetricsListen, "path", METRICS_PATH)
+	}
+
+	socketFile := config.RequestSocketFile
 	if err := router.Bind(socketFile); err != nil {
 		log.Fatal(err)
 	}
 
-	//Worker Master communication socket
-	workerDealer, err := context.NewSocket(zmq.DEALER)
+	//Worker Master communication socket. Workers are addressed by id, so a request only goes to one that is idle
+	workerRouter, err := context.NewSocket(zmq.ROUTER)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer workerDealer.Close()
-	workerDealer.Bind(server.Config.WorkerSocketFile)
+	workerRouter.SetLinger(0)
+	//fail sends to a worker that has gone rather than dropping them, so the request can go to another
+	workerRouter.SetRouterMandatory(1)
+	workerRouter.Bind(config.WorkerSocketFile)
+
 
 
+	//pick up the record of jobs, including any the last run didn't finish
+	var interruptedJobs []Job
+	if config.JobsStateFile != "" {
+		server.jobs, interruptedJobs, err = OpenJobStore(config.JobsStateFile, config.JobCheckpointInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, job := range interruptedJobs {
+			server.Logger.Warn("server", "interrupted job found", "job", job.ID, "command", job.Command,
+				"params", strings.Join(job.Params, config.MessageDelimiter), "checkpoint", job.Checkpoint,
+				"processed", job.Processed, "resumable", job.Resumable)
+		}
+	}
+
+	if config.ChecksumCacheFile != "" {
+		if server.checksumCache, err = OpenChecksumCache(config.ChecksumCacheFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Create the workers
-	for newWorker := 0; newWorker < server.Config.NumberOfWorkers; newWorker++ {
+	for newWorker := 0; newWorker < config.NumberOfWorkers; newWorker++ {
 		 server.NewWorker()
 	}
 
-	// Connect the worker threads to the request socket via a queue
+	if config.ResumeJobs && len(interruptedJobs) > 0 {
+		go server.resumeInterruptedJobs(interruptedJobs)
+	}
+
+	// Connect the worker threads to the request socket via our broker
 	// This is blocking, so run it in a thread
-	go func() {
-		err = zmq.Proxy(router, workerDealer, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+	go server.runBroker(router, workerRouter)
 
 	//make sure our request file is writable
 	server.verifyRequestSocketFile()
 
 	//notify about start up
-	server.Log.Printf("[%s] Server Online - %s - Loaded %d Workers\n", server.getTimeStamp(), socketFile, server.Config.NumberOfWorkers)
+	server.Logger.Info("server", "server online", "socket", socketFile, "workers", config.NumberOfWorkers)
 
 	// Make a timer for periodic tasks we want the main thread dealing with
-	tickChan := time.NewTicker(time.Second * 5).C
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	//SIGTERM comes from upstart on stop, SIGINT from a console
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	defer signal.Stop(reloadSignals)
+	//logrotate sends SIGUSR1 once it has moved our log files aside
+	reopenSignals := make(chan os.Signal, 1)
+	signal.Notify(reopenSignals, syscall.SIGUSR1)
+	defer signal.Stop(reopenSignals)
 
 	//Spin while the server is active, waiting for workers to quit
 	for server.Active {
-		//Use a select for future expansion
 		select {
 		case deadID := <-server.Notify :
+			server.workersLock.Lock()
 			delete(server.Workers, deadID) //delete the worker
-			server.NewWorker()
-
-		case <- tickChan :
+			server.workersLock.Unlock()
+			atomic.AddInt32(&server.workerCount, -1)
+			//replace it, unless it retired to shrink the pool
+			if len(server.Workers) < server.CurrentConfig().NumberOfWorkers {
+				server.metrics.workerDeaths.Inc()
+				atomic.AddUint64(&server.workerRestarts, 1)
+				server.NewWorker()
+			}
+
+		case <- ticker.C :
 			server.verifyRequestSocketFile()
+			if server.CurrentConfig().JournalEnabled && time.Since(server.lastJournalPurge) > journalPurgeInterval {
+				server.lastJournalPurge = time.Now()
+				go server.purgeExpiredJournal()
+			}
+			if server.checksumCache != nil && time.Since(server.lastCachePrune) > checksumCachePruneInterval {
+				server.lastCachePrune = time.Now()
+				go server.pruneChecksumCache()
+			}
+
+		case sig := <-signals :
+			server.Logger.Info("server", "received signal", "signal", sig)
+			server.Active = false
+
+		case <-reloadSignals :
+			server.Logger.Info("server", "received signal", "signal", "SIGHUP")
+			server.Reload()
+
+		case <-reopenSignals :
+			if err := server.Logger.Reopen(); err != nil {
+				//stderr is the one place we can still complain to
+				log.Println("Failed to reopen log files: " + err.Error())
+			} else {
+				server.Logger.Info("server", "log files reopened")
+			}
+
+		case result := <-server.reloadRequests :
+			applied, restart, err := server.Reload()
+			result <- reloadResult{applied, restart, err}
+
+		case reason := <-server.shutdownRequests :
+			server.Logger.Info("server", "shutdown requested", "reason", reason)
+			server.Active = false
 		}
-		//When a worker exits, we'll wake up and check that the server is active
-		//Useful to note that if a worker is told to shutdown the server, it will need to also exit to prompt
-		//us to check that the server is shutting down
 	}
 
-	server.Log.Printf("[%s] Server Shutdown Detected\n", server.getTimeStamp())
+	server.Logger.Info("server", "server shutdown detected")
+	server.shutdown(router, workerRouter)
+}
+
+const (
+	//how often we check on in-flight requests while draining
+	drainPollInterval = 100 * time.Millisecond
+	//how long we give workers to let go of their sockets once the context is terminated
+	contextTermTimeout = 5 * time.Second
+)
+
+//Shutdown asks the server to stop accepting requests and exit once in-flight work is done.
+// It is safe to call from any goroutine, and more than once
+func (server *Server) Shutdown(reason string) {
+	select {
+	case server.shutdownRequests <- reason:
+	default: //a shutdown is already pending
+	}
+}
+
+//IsDraining reports whether the server has stopped taking new requests
+func (server *Server) IsDraining() bool {
+	return atomic.LoadInt32(&server.draining) == 1
+}
+
+//shutdown drains in-flight requests, tears down the sockets and ZMQ context, and removes the request socket file
+func (server *Server) shutdown(router, workerRouter *zmq.Socket) {
+	atomic.StoreInt32(&server.draining, 1)
+	close(server.stopped)
+
+	timeout := time.Duration(server.CurrentConfig().ShutdownTimeout) * time.Second
+	server.Logger.Info("server", "draining in-flight requests",
+		"in_flight", atomic.LoadInt64(&server.requestsInFlight), "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&server.requestsInFlight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	abandoned := atomic.LoadInt64(&server.requestsInFlight)
+	if abandoned > 0 {
+		server.Logger.Warn("server", "drain timed out, abandoning in-flight requests", "abandoned", abandoned)
+	}
+
+	if err := server.metrics.Close(); err != nil {
+		server.Logger.Error("server", "failed to close metrics listener", "error", err)
+	}
+
+	//stop the broker before closing its sockets; it is the only goroutine allowed to touch them
+	close(server.brokerStop)
+	<-server.brokerDone
+	router.Close()
+	workerRouter.Close()
+
+	//terminating the context wakes every worker blocked on a receive with ETERM so they can close up
+	termDone := make(chan error, 1)
+	go func() {
+		termDone <- server.ZMQContext.Term()
+	}()
+	select {
+	case err := <-termDone:
+		if err != nil {
+			server.Logger.Error("server", "failed to terminate ZMQ context", "error", err)
+		}
+	case <-time.After(contextTermTimeout):
+		server.Logger.Warn("server", "workers still busy, exiting without them", "waited", contextTermTimeout)
+	}
+
+	//workers we gave up on leave their jobs marked running, so the next start reports them as interrupted
+	if err := server.jobs.Close(); err != nil {
+		server.Logger.Error("server", "failed to close job state file", "error", err)
+	}
+	if err := server.checksumCache.Close(); err != nil {
+		server.Logger.Error("server", "failed to close checksum cache", "error", err)
+	}
+
+	if err := os.Remove(server.CurrentConfig().RequestSocketFileName); err != nil && !os.IsNotExist(err) {
+		server.Logger.Error("server", "failed to remove request socket file", "error", err)
+	}
+
+	server.Logger.Info("server", "server offline",
+		"uptime", time.Since(server.StartTime).Round(time.Second),
+		"handled", atomic.LoadUint64(&server.requestsHandled), "failed", atomic.LoadUint64(&server.requestsFailed),
+		"rejected", atomic.LoadUint64(&server.requestsRejected), "abandoned", abandoned)
 }
 
 const (
 	fullWrite = 0777
 )
 func (server *Server) verifyRequestSocketFile() {
-	socketFile := server.Config.RequestSocketFileName
-	fi, _ := os.Stat(socketFile)
+	socketFile := server.CurrentConfig().RequestSocketFileName
+	fi, err := os.Stat(socketFile)
+	if err != nil {
+		server.Logger.Error("server", "unable to stat request socket file", "error", err)
+		return
+	}
 	if fi.Mode().Perm() != fullWrite {
-		server.ErrorLog.Printf("[%s] Request File not Globally Writable!\n", server.getTimeStamp())
-		_, err := SendCommand("chmod|write|false|" + socketFile, server.Config, 1, 10, false)
+		server.Logger.Warn("server", "request socket file not globally writable", "mode", fi.Mode().Perm())
+		_, err := SendCommand("chmod|write|false|" + socketFile, server.CurrentConfig(), 1, 10, false)
 		if err != nil {
-			server.ErrorLog.Printf("[%s] Unable to correct Request SocketFile permissions: %s\n", server.getTimeStamp(), err)
+			server.Logger.Error("server", "unable to correct request socket file permissions", "error", err)
 		}
 	}
 }
@@ -168,11 +350,101 @@ func (server *Server) verifyRequestSocketFile() {
 func (server *Server) NewWorker() {
 	nextWorker := server.WorkerID
 	server.WorkerID++
-	newWorker := Worker{
+	newWorker := &Worker{
 		ID:            nextWorker,
 		Server:        server,
 		Active:        true,
 	}
+	server.workersLock.Lock()
 	server.Workers[nextWorker] = newWorker
+	server.workersLock.Unlock()
+	atomic.AddInt32(&server.workerCount, 1)
 	go newWorker.Work()
 }
+
+//nextRequestID hands out an identifier for correlating a request's log records.
+// Prefixing the start time keeps them unique across restarts
+func (server *Server) nextRequestID() string {
+	sequence := atomic.AddUint64(&server.requestSequence, 1)
+	return strconv.FormatInt(server.StartTime.Unix(), 36) + "-" + strconv.FormatUint(sequence, 36)
+}
+
+//queueDepth is how many requests the broker has handed on that no worker has started on yet
+func (server *Server) queueDepth() int64 {
+	depth := atomic.LoadInt64(&server.requestsInFlight) - int64(atomic.LoadInt32(&server.busyWorkers))
+	if depth < 0 { //the two counters aren't read together, so don't report a transient negative
+		depth = 0
+	}
+
+	return depth
+}
+
+//claimRetirement lets an idle worker volunteer to leave a pool that is larger than configured
+func (server *Server) claimRetirement() bool {
+	for {
+		surplus := atomic.LoadInt32(&server.surplusWorkers)
+		if surplus <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&server.surplusWorkers, surplus, surplus-1) {
+			return true
+		}
+	}
+}
+
+type reloadResult struct {
+	applied, restart []string
+	err error
+}
+
+//RequestReload asks the server to reload its configuration and waits for the outcome.
+// It is used by the reload command; the server's own goroutine does the work
+func (server *Server) RequestReload() (applied, restart []string, err error) {
+	result := make(chan reloadResult, 1)
+	select {
+	case server.reloadRequests <- result:
+	case <-server.stopped:
+		return nil, nil, errors.New("server is shutting down")
+	}
+	reloaded := <-result
+
+	return reloaded.applied, reloaded.restart, reloaded.err
+}
+
+//Reload re-reads the configuration file and applies what can be changed on a running server.
+// An invalid configuration is rejected outright, leaving the running one untouched
+func (server *Server) Reload() (applied, restart []string, err error) {
+	config := server.CurrentConfig()
+	newConfig, err := LoadConfiguration(config.ConfigFile)
+	if err != nil {
+		server.Logger.Error("server", "reload rejected", "error", err)
+		return
+	}
+
+	applied, restart = config.reloadChanges(newConfig)
+
+	if err = server.Logger.Configure(newConfig); err != nil {
+		server.Logger.Error("server", "reload rejected", "error", err)
+		return nil, nil, err
+	}
+
+	server.configLock.Lock()
+	server.config = newConfig
+	server.configLock.Unlock()
+
+	//grow the pool now; shrinking happens as idle workers notice they're surplus
+	running := len(server.Workers)
+	atomic.StoreInt32(&server.surplusWorkers, 0)
+	if newConfig.NumberOfWorkers > running {
+		for newWorker := running; newWorker < newConfig.NumberOfWorkers; newWorker++ {
+			server.NewWorker()
+		}
+	} else if running > newConfig.NumberOfWorkers {
+		atomic.StoreInt32(&server.surplusWorkers, int32(running-newConfig.NumberOfWorkers))
+	}
+
+	server.Logger.Info("server", "configuration reloaded",
+		"applied", strings.Join(applied, ","), "requires_restart", strings.Join(restart, ","))
+
+	return
+}
@@ -0,0 +1,356 @@
+package FileDaemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	STAT_PARAM_COUNT_MIN = 1
+	//one request shouldn't be able to tie a worker up statting a whole directory's worth of paths
+	STAT_MAX_PATHS = 1024
+)
+
+//StatResult is what stat and lstat report about one path: its metadata, or why it couldn't be read
+type StatResult struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+	*StatInfo
+}
+
+type StatInfo struct {
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	//permission bits in octal, including setuid, setgid and sticky
+	Mode        string    `json:"mode"`
+	Permissions string    `json:"permissions"`
+	UID         uint32    `json:"uid"`
+	GID         uint32    `json:"gid"`
+	User        string    `json:"user,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	Atime       time.Time `json:"atime"`
+	Mtime       time.Time `json:"mtime"`
+	Ctime       time.Time `json:"ctime"`
+	//creation time, when the filesystem records it
+	Btime  *time.Time `json:"btime,omitempty"`
+	Inode  uint64     `json:"inode"`
+	Device uint64     `json:"device"`
+	Links  uint64     `json:"links"`
+	//where a symlink points, for lstat
+	Target string `json:"target,omitempty"`
+	//the NFSv4 ACL in nfs4_getfacl's type:flags:principal:permissions form, empty without one
+	ACL []string `json:"acl,omitempty"`
+}
+
+//doStat reports on one or more paths: stat|path[|path...] follows symlinks, lstat|path[|path...] doesn't.
+// The reply is a JSON list with an entry per path; if any path couldn't be read, the request fails with the same list
+func (worker *Worker) doStat(params []string, follow bool) (reply []string, err error) {
+	cmd := "lstat"
+	if follow {
+		cmd = "stat"
+	}
+	if len(params) < STAT_PARAM_COUNT_MIN || len(params) > STAT_MAX_PATHS {
+		err = errors.New("Incorrect number of parameters to " + cmd + ". Expected " +
+			strconv.Itoa(STAT_PARAM_COUNT_MIN) + " to " + strconv.Itoa(STAT_MAX_PATHS) + " Got " +
+			strconv.Itoa(len(params)))
+		return
+	}
+
+	names := make(map[string]string)
+	results := make([]StatResult, len(params))
+	failed := false
+	for i, filePath := range params {
+		results[i] = worker.statPath(filePath, follow, names)
+		failed = failed || results[i].Error != ""
+	}
+
+	encoded, err := worker.jsonReply(results)
+	if err != nil {
+		return
+	}
+	if failed {
+		return nil, errors.New(encoded)
+	}
+
+	return []string{encoded}, nil
+}
+
+//statPath fills in a StatResult, recording any failure in it. names caches user and group lookups
+func (worker *Worker) statPath(filePath string, follow bool, names map[string]string) (result StatResult) {
+	result.Path = filePath
+	if err := worker.checkPaths(filePath); err != nil {
+		result.Error = err.Error()
+		return
+	}
+	info, err := worker.statInfo(filePath, follow, names)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.StatInfo = info
+
+	return
+}
+
+//statInfo gathers the metadata of a path that has already passed the policy check
+func (worker *Worker) statInfo(filePath string, follow bool, names map[string]string) (result *StatInfo, err error) {
+	flags := unix.AT_STATX_SYNC_AS_STAT
+	if !follow {
+		flags |= unix.AT_SYMLINK_NOFOLLOW
+	}
+	stx, err := statx(filePath, flags)
+	if err != nil {
+		return
+	}
+
+	result = &StatInfo{}
+	mode := fileModeOf(uint32(stx.Mode))
+	result.Type = fileTypeName(mode)
+	result.Size = int64(stx.Size)
+	result.Mode = "0" + strconv.FormatUint(uint64(stx.Mode&07777), 8)
+	result.Permissions = mode.String()
+	result.UID, result.GID = stx.Uid, stx.Gid
+	result.User = lookupName(names, "u", stx.Uid)
+	result.Group = lookupName(names, "g", stx.Gid)
+	result.Atime = statxTime(stx.Atime)
+	result.Mtime = statxTime(stx.Mtime)
+	result.Ctime = statxTime(stx.Ctime)
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		btime := statxTime(stx.Btime)
+		result.Btime = &btime
+	}
+	result.Inode = stx.Ino
+	result.Device = unix.Mkdev(stx.Dev_major, stx.Dev_minor)
+	result.Links = uint64(stx.Nlink)
+
+	if mode&os.ModeSymlink != 0 {
+		result.Target, _ = os.Readlink(filePath)
+		//a symlink has no ACL of its own, and reading one would follow the link
+		return result, nil
+	}
+	if raw := readACLXattr(filePath); raw != nil {
+		acl, err := decodeNFS4ACL(raw)
+		if err != nil {
+			worker.logWarn("failed to decode ACL", "path", filePath, "error", err)
+		}
+		result.ACL = acl
+	}
+
+	return result, nil
+}
+
+//statx stats filePath, falling back to plain stat, without a birth time, on kernels older than statx
+func statx(filePath string, flags int) (stx unix.Statx_t, err error) {
+	err = unix.Statx(unix.AT_FDCWD, filePath, flags, unix.STATX_BASIC_STATS|unix.STATX_BTIME, &stx)
+	if err != unix.ENOSYS {
+		if err != nil {
+			err = &os.PathError{Op: "statx", Path: filePath, Err: err}
+		}
+		return
+	}
+
+	var st unix.Stat_t
+	if err = unix.Fstatat(unix.AT_FDCWD, filePath, &st, flags&unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return stx, &os.PathError{Op: "stat", Path: filePath, Err: err}
+	}
+	stx = unix.Statx_t{
+		Mask: unix.STATX_BASIC_STATS, Mode: uint16(st.Mode), Size: uint64(st.Size), Uid: st.Uid, Gid: st.Gid,
+		Ino: st.Ino, Nlink: uint32(st.Nlink), Dev_major: unix.Major(uint64(st.Dev)), Dev_minor: unix.Minor(uint64(st.Dev)),
+		Atime: unix.StatxTimestamp{Sec: int64(st.Atim.Sec), Nsec: uint32(st.Atim.Nsec)},
+		Mtime: unix.StatxTimestamp{Sec: int64(st.Mtim.Sec), Nsec: uint32(st.Mtim.Nsec)},
+		Ctime: unix.StatxTimestamp{Sec: int64(st.Ctim.Sec), Nsec: uint32(st.Ctim.Nsec)},
+	}
+
+	return stx, nil
+}
+
+func statxTime(ts unix.StatxTimestamp) time.Time {
+	return time.Unix(ts.Sec, int64(ts.Nsec)).UTC()
+}
+
+//fileModeOf converts a raw st_mode to an os.FileMode
+func fileModeOf(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0777)
+	switch raw & unix.S_IFMT {
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	}
+	if raw&unix.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&unix.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&unix.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char-device"
+	case mode&os.ModeDevice != 0:
+		return "block-device"
+	}
+	return "unknown"
+}
+
+//lookupName resolves a uid (kind "u") or gid (kind "g") to its name, leaving it empty if there isn't one
+func lookupName(names map[string]string, kind string, id uint32) string {
+	key := kind + strconv.FormatUint(uint64(id), 10)
+	if name, ok := names[key]; ok {
+		return name
+	}
+	var name string
+	if kind == "u" {
+		if found, err := user.LookupId(key[1:]); err == nil {
+			name = found.Username
+		}
+	} else if found, err := user.LookupGroupId(key[1:]); err == nil {
+		name = found.Name
+	}
+	names[key] = name
+
+	return name
+}
+
+//NFSv4 ACE values as the system.nfs4_acl xattr stores them (RFC 7530), with the letters nfs4_getfacl uses for them
+var (
+	nfs4ACETypes = []string{"A", "D", "U", "L"}
+	nfs4ACEFlags = []struct {
+		bit    uint32
+		letter string
+	}{
+		{0x1, "f"}, {0x2, "d"}, {0x4, "n"}, {0x8, "i"}, {0x10, "S"}, {0x20, "F"}, {0x40, "g"}, {0x80, "I"},
+	}
+	nfs4ACEPermissions = []struct {
+		bit    uint32
+		letter string
+	}{
+		{0x1, "r"}, {0x2, "w"}, {0x4, "a"}, {0x20, "x"}, {0x10000, "d"}, {0x40, "D"}, {0x80, "t"}, {0x100, "T"},
+		{0x8, "n"}, {0x10, "N"}, {0x20000, "c"}, {0x40000, "C"}, {0x80000, "o"}, {0x100000, "y"},
+	}
+)
+
+//nfs4ACE is one decoded entry of a system.nfs4_acl xattr
+type nfs4ACE struct {
+	aceType, flags, mask uint32
+	who                  string
+}
+
+//String formats the entry the way nfs4_getfacl does, such as A:fd:OWNER@:rwaxtcy
+func (entry nfs4ACE) String() string {
+	var ace strings.Builder
+	if int(entry.aceType) < len(nfs4ACETypes) {
+		ace.WriteString(nfs4ACETypes[entry.aceType])
+	} else {
+		ace.WriteString(strconv.FormatUint(uint64(entry.aceType), 10))
+	}
+	ace.WriteString(":")
+	for _, flag := range nfs4ACEFlags {
+		if entry.flags&flag.bit != 0 {
+			ace.WriteString(flag.letter)
+		}
+	}
+	ace.WriteString(":" + entry.who + ":")
+	for _, permission := range nfs4ACEPermissions {
+		if entry.mask&permission.bit != 0 {
+			ace.WriteString(permission.letter)
+		}
+	}
+
+	return ace.String()
+}
+
+//decodeNFS4ACL turns a raw system.nfs4_acl xattr into nfs4_getfacl style entries
+func decodeNFS4ACL(raw []byte) (aces []string, err error) {
+	entries, err := parseNFS4ACL(raw)
+	for _, entry := range entries {
+		aces = append(aces, entry.String())
+	}
+
+	return
+}
+
+//parseNFS4ACL decodes a raw system.nfs4_acl xattr, an XDR list of ACEs. A truncated ACL returns the entries before
+// the damage along with the error
+func parseNFS4ACL(raw []byte) (entries []nfs4ACE, err error) {
+	truncated := errors.New("truncated NFSv4 ACL")
+	next := func() (uint32, bool) {
+		if len(raw) < 4 {
+			return 0, false
+		}
+		value := binary.BigEndian.Uint32(raw)
+		raw = raw[4:]
+		return value, true
+	}
+
+	count, ok := next()
+	if !ok {
+		return nil, truncated
+	}
+	for i := uint32(0); i < count; i++ {
+		var fields [4]uint32
+		for f := range fields {
+			if fields[f], ok = next(); !ok {
+				return entries, truncated
+			}
+		}
+		//XDR pads strings to a multiple of 4 bytes. In 64 bits, so a huge length can't wrap round to a small one
+		whoLength := uint64(fields[3])
+		padded := (whoLength + 3) &^ 3
+		if uint64(len(raw)) < padded {
+			return entries, truncated
+		}
+		entries = append(entries, nfs4ACE{aceType: fields[0], flags: fields[1], mask: fields[2],
+			who: string(raw[:whoLength])})
+		raw = raw[padded:]
+	}
+
+	return
+}
+
+//encodeNFS4ACL is the reverse of parseNFS4ACL, giving the raw system.nfs4_acl value for entries
+func encodeNFS4ACL(entries []nfs4ACE) []byte {
+	raw := binary.BigEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, entry := range entries {
+		for _, field := range []uint32{entry.aceType, entry.flags, entry.mask, uint32(len(entry.who))} {
+			raw = binary.BigEndian.AppendUint32(raw, field)
+		}
+		raw = append(raw, entry.who...)
+		for len(raw)%4 != 0 {
+			raw = append(raw, 0)
+		}
+	}
+	return raw
+}
@@ -0,0 +1,52 @@
+package FileDaemon
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+//xdrACL encodes aces behind a count that needn't match them, to build broken ACLs as well
+func xdrACL(count uint32, aces ...nfs4ACE) []byte {
+	raw := encodeNFS4ACL(aces)
+	binary.BigEndian.PutUint32(raw, count)
+	return raw
+}
+
+func TestParseNFS4ACL(t *testing.T) {
+	owner := nfs4ACE{aceType: 0, flags: 0x3, mask: 0x1f01ff, who: "OWNER@"}
+	alice := nfs4ACE{aceType: 1, flags: 0, mask: 0x6, who: "alice@example.com"}
+	//the who length claims nearly 4GiB, which padding to 4 bytes would wrap to 0
+	wrapping := binary.BigEndian.AppendUint32(xdrACL(1)[:4], 0)
+	wrapping = binary.BigEndian.AppendUint32(wrapping, 0)
+	wrapping = binary.BigEndian.AppendUint32(wrapping, 0)
+	wrapping = binary.BigEndian.AppendUint32(wrapping, 0xfffffffd)
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    []nfs4ACE
+		wantErr bool
+	}{
+		{name: "empty ACL", raw: xdrACL(0)},
+		{name: "entries", raw: xdrACL(2, owner, alice), want: []nfs4ACE{owner, alice}},
+		{name: "who a multiple of 4", raw: xdrACL(1, nfs4ACE{who: "EVERYONE"}), want: []nfs4ACE{{who: "EVERYONE"}}},
+		{name: "no count", raw: []byte{0, 0}, wantErr: true},
+		{name: "fewer entries than counted", raw: xdrACL(2, owner), want: []nfs4ACE{owner}, wantErr: true},
+		{name: "short entry header", raw: xdrACL(1, owner)[:12], wantErr: true},
+		{name: "who cut short", raw: xdrACL(1, alice)[:24], wantErr: true},
+		{name: "who length wrapping round", raw: wrapping, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := parseNFS4ACL(test.raw)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("entries = %+v, want %+v", entries, test.want)
+			}
+		})
+	}
+}
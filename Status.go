@@ -0,0 +1,209 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//Version is stamped in at build time with -ldflags "-X FileDaemon.Version=..."
+var Version = "dev"
+
+const (
+	STATUS_PARAM_BRIEF = "brief"
+
+	WORKER_STATE_BUSY = "busy"
+	WORKER_STATE_IDLE = "idle"
+)
+
+type ServerStatus struct {
+	Version       string                  `json:"version"`
+	Healthy       bool                    `json:"healthy"`
+	Problems      []string                `json:"problems,omitempty"`
+	Draining      bool                    `json:"draining"`
+	Started       time.Time               `json:"started"`
+	UptimeSeconds float64                 `json:"uptime_seconds"`
+	ConfigFile    string                  `json:"config_file"`
+	Socket        SocketStatus            `json:"socket"`
+	Workers       PoolStatus              `json:"workers"`
+	Requests      RequestStatus           `json:"requests"`
+	Commands      map[string]CommandStats `json:"commands"`
+	//long-running jobs in progress or interrupted, when job persistence is on
+	Jobs []Job `json:"jobs,omitempty"`
+}
+
+type SocketStatus struct {
+	Path     string `json:"path"`
+	Mode     string `json:"mode,omitempty"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+}
+
+type PoolStatus struct {
+	Configured int            `json:"configured"`
+	Running    int            `json:"running"`
+	Busy       int            `json:"busy"`
+	Idle       int            `json:"idle"`
+	Restarts   uint64         `json:"restarts"`
+	Pool       []WorkerStatus `json:"pool"`
+}
+
+type WorkerStatus struct {
+	ID          int     `json:"id"`
+	State       string  `json:"state"`
+	Command     string  `json:"command,omitempty"`
+	RequestID   string  `json:"request_id,omitempty"`
+	BusySeconds float64 `json:"busy_seconds,omitempty"`
+	Handled     uint64  `json:"handled"`
+	//how far the request has got, for commands that report it
+	Progress *WorkerProgress `json:"progress,omitempty"`
+}
+
+//WorkerProgress is how far an archive or extract has got: entries done, and bytes of the input read out of
+// TotalBytes
+type WorkerProgress struct {
+	Entries    int64 `json:"entries"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+type RequestStatus struct {
+	InFlight int64  `json:"in_flight"`
+	Queued   int64  `json:"queued"`
+	Handled  uint64 `json:"handled"`
+	Failed   uint64 `json:"failed"`
+	Rejected uint64 `json:"rejected"`
+}
+
+//Status gathers a snapshot of the server's state. It is safe to call from any goroutine
+func (server *Server) Status() ServerStatus {
+	config := server.CurrentConfig()
+	now := time.Now()
+	status := ServerStatus{
+		Version:       Version,
+		Draining:      server.IsDraining(),
+		Started:       server.StartTime,
+		UptimeSeconds: now.Sub(server.StartTime).Seconds(),
+		ConfigFile:    config.ConfigFile,
+		Socket:        socketStatus(config.RequestSocketFileName),
+		Requests: RequestStatus{
+			InFlight: atomic.LoadInt64(&server.requestsInFlight),
+			Queued:   server.queueDepth(),
+			Handled:  atomic.LoadUint64(&server.requestsHandled),
+			Failed:   atomic.LoadUint64(&server.requestsFailed),
+			Rejected: atomic.LoadUint64(&server.requestsRejected),
+		},
+		Commands: server.metrics.CommandStats(),
+	}
+
+	status.Workers = PoolStatus{
+		Configured: config.NumberOfWorkers,
+		Restarts:   atomic.LoadUint64(&server.workerRestarts),
+	}
+	server.workersLock.Lock()
+	for _, worker := range server.Workers {
+		status.Workers.Pool = append(status.Workers.Pool, worker.status(now))
+	}
+	server.workersLock.Unlock()
+	sort.Slice(status.Workers.Pool, func(i, j int) bool {
+		return status.Workers.Pool[i].ID < status.Workers.Pool[j].ID
+	})
+	status.Workers.Running = len(status.Workers.Pool)
+	for _, workerStatus := range status.Workers.Pool {
+		if workerStatus.State == WORKER_STATE_BUSY {
+			status.Workers.Busy++
+		}
+	}
+	status.Workers.Idle = status.Workers.Running - status.Workers.Busy
+
+	if server.jobs != nil {
+		jobs, err := server.jobs.List()
+		if err != nil {
+			status.Problems = append(status.Problems, "job state file unreadable: "+err.Error())
+		}
+		status.Jobs = jobs
+	}
+
+	if status.Draining {
+		status.Problems = append(status.Problems, "server is shutting down")
+	}
+	if status.Workers.Running == 0 {
+		status.Problems = append(status.Problems, "no workers running")
+	}
+	if !status.Socket.Writable {
+		status.Problems = append(status.Problems, "request socket is not globally writable")
+	}
+	status.Healthy = len(status.Problems) == 0
+
+	return status
+}
+
+func (worker *Worker) status(now time.Time) WorkerStatus {
+	worker.stateLock.Lock()
+	defer worker.stateLock.Unlock()
+
+	workerStatus := WorkerStatus{ID: worker.ID, State: WORKER_STATE_IDLE, Handled: worker.handled}
+	if worker.command != "" {
+		workerStatus.State = WORKER_STATE_BUSY
+		workerStatus.Command = worker.command
+		workerStatus.RequestID = worker.requestID
+		workerStatus.BusySeconds = now.Sub(worker.busySince).Seconds()
+		workerStatus.Progress = worker.progress
+	}
+
+	return workerStatus
+}
+
+func socketStatus(socketFile string) SocketStatus {
+	status := SocketStatus{Path: socketFile}
+	fi, err := os.Stat(socketFile)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Mode = "0" + strconv.FormatUint(uint64(fi.Mode().Perm()), 8)
+	status.Writable = fi.Mode().Perm() == fullWrite
+
+	return status
+}
+
+const (
+	STATUS_PARAM_COUNT_MAX = 1
+	STATUS_PARAM_MODE_IDX  = 0
+)
+
+//doStatus replies with the server status as JSON, or just "true" when asked for a brief status.
+// An unhealthy server fails the request, with the status as the error message, so exit codes reflect health
+func (worker *Worker) doStatus(params []string) (reply []string, err error) {
+	if len(params) > STATUS_PARAM_COUNT_MAX {
+		err = errors.New("Incorrect number of parameters to status. Expected at most " +
+			strconv.Itoa(STATUS_PARAM_COUNT_MAX) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	status := worker.Server.Status()
+	if len(params) > 0 && params[STATUS_PARAM_MODE_IDX] == STATUS_PARAM_BRIEF {
+		if !status.Healthy {
+			err = errors.New(strings.Join(status.Problems, ", "))
+			return
+		}
+		reply = []string{"true"}
+		return
+	}
+
+	encoded, err := worker.jsonReply(status)
+	if err != nil {
+		return
+	}
+	if !status.Healthy {
+		err = errors.New(encoded)
+		return
+	}
+	reply = []string{encoded}
+
+	return
+}
@@ -0,0 +1,133 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/karrick/godirwalk"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	TOUCH_PARAM_COUNT_MIN    = 1
+	TOUCH_PARAM_FILEPATH_IDX = 0
+	//everything after the path is key=value options
+	TOUCH_PARAM_OPTIONS_IDX = 1
+	TOUCH_REPLY_CREATED_IDX = 0
+)
+
+//doTouch sets a path's access and modification times, creating an empty file if it is missing:
+// touch|path[|key=value...]. Options are
+//	atime=T and mtime=T  set just these times, in RFC 3339 or unix seconds
+//	reference=PATH       take both times from another file, before any atime or mtime is applied
+//	recursive=true       set the times of everything under a directory too, without following symlinks
+//	create=false         leave a missing file missing, without failing
+// Without atime, mtime or reference both times are set to now. A new file gets the ACL of its directory, as mkdir
+// gives new directories. Replies with whether the file was created
+func (worker *Worker) doTouch(params []string) (reply []string, err error) {
+	if len(params) < TOUCH_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to touch. Expected at least " +
+			strconv.Itoa(TOUCH_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	filePath := filepath.Clean(params[TOUCH_PARAM_FILEPATH_IDX])
+	options, err := parseOptions("touch", params[TOUCH_PARAM_OPTIONS_IDX:], "atime", "mtime", "reference",
+		"recursive", "create")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	recursive, create := false, true
+	if value, ok := options["recursive"]; ok {
+		if recursive, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+	if value, ok := options["create"]; ok {
+		if create, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+
+	//UTIME_NOW and UTIME_OMIT let the kernel fill in or leave alone whichever times aren't given
+	times := []unix.Timespec{{Nsec: unix.UTIME_NOW}, {Nsec: unix.UTIME_NOW}}
+	if reference, ok := options["reference"]; ok {
+		if err = worker.checkPaths(reference); err != nil {
+			return
+		}
+		var stat unix.Stat_t
+		if err = unix.Stat(reference, &stat); err != nil {
+			return
+		}
+		times[0], times[1] = stat.Atim, stat.Mtim
+	} else if options["atime"] != "" || options["mtime"] != "" {
+		times[0].Nsec, times[1].Nsec = unix.UTIME_OMIT, unix.UTIME_OMIT
+	}
+	for i, key := range []string{"atime", "mtime"} {
+		if value, ok := options[key]; ok {
+			when, parseErr := parseTimeOption(value)
+			if parseErr != nil {
+				return nil, errors.New("touch " + key + " must be an RFC 3339 time or unix seconds")
+			}
+			times[i] = unix.NsecToTimespec(when.UnixNano())
+		}
+	}
+
+	created := false
+	fi, err := os.Stat(filePath)
+	if os.IsNotExist(err) && !create {
+		//like touch -c, a missing file is left missing without complaint
+		return []string{strconv.FormatBool(false)}, nil
+	} else if os.IsNotExist(err) {
+		if err = worker.createEmptyFile(filePath); err != nil {
+			return
+		}
+		created = true
+	} else if err != nil {
+		return
+	}
+
+	//the path itself is touched the way touch does, through a symlink
+	if err = unix.UtimesNanoAt(unix.AT_FDCWD, filePath, times, 0); err != nil {
+		return
+	}
+	count := 1
+	if recursive && fi != nil && fi.IsDir() {
+		err = godirwalk.Walk(filePath, &godirwalk.Options{
+			Unsorted: true,
+			Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+				if subFilePath == filePath {
+					return nil
+				}
+				count++
+				return unix.UtimesNanoAt(unix.AT_FDCWD, subFilePath, times, unix.AT_SYMLINK_NOFOLLOW)
+			},
+		})
+	}
+	worker.Server.metrics.addEntriesWalked("touch", count)
+	if err != nil {
+		return
+	}
+
+	reply = make([]string, 1)
+	reply[TOUCH_REPLY_CREATED_IDX] = strconv.FormatBool(created)
+
+	return
+}
+
+//createEmptyFile creates filePath, which mustn't exist, and clones its directory's ACL onto it
+func (worker *Worker) createEmptyFile(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return worker.inheritACL(filePath, false)
+}
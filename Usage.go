@@ -0,0 +1,302 @@
+package FileDaemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	DU_PARAM_COUNT_MIN   = 1
+	DU_PARAM_DIR_IDX     = 0
+	DU_PARAM_OPTIONS_IDX = 1
+
+	//subdirectories walked at once
+	DU_PARALLELISM = 8
+	//only the first few errors are reported; the rest are just counted
+	DU_MAX_ERRORS = 10
+)
+
+//DiskUsage totals a tree. Hard linked files are only counted once
+type DiskUsage struct {
+	//sum of file sizes
+	ApparentSize int64 `json:"apparent_size"`
+	//bytes of disk actually allocated, which is less for sparse files and more for small ones
+	Allocated   int64 `json:"allocated"`
+	Files       int64 `json:"files"`
+	Directories int64 `json:"directories"`
+	//symlinks, devices, sockets and fifos
+	Other int64 `json:"other"`
+}
+
+func (usage *DiskUsage) add(other DiskUsage) {
+	usage.ApparentSize += other.ApparentSize
+	usage.Allocated += other.Allocated
+	usage.Files += other.Files
+	usage.Directories += other.Directories
+	usage.Other += other.Other
+}
+
+type DiskUsageReport struct {
+	Path string `json:"path"`
+	DiskUsage
+	//the largest subdirectories by allocated size, when asked for
+	Subdirectories []NamedDiskUsage `json:"subdirectories,omitempty"`
+	Owners         []OwnerDiskUsage `json:"owners,omitempty"`
+	//the extensions taking up the most space, when asked for. Files without one are under ""
+	Extensions []NamedDiskUsage `json:"extensions,omitempty"`
+	ErrorCount int              `json:"error_count"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type NamedDiskUsage struct {
+	Name string `json:"name"`
+	DiskUsage
+}
+
+type OwnerDiskUsage struct {
+	UID  uint32 `json:"uid"`
+	User string `json:"user,omitempty"`
+	DiskUsage
+}
+
+//usageWalk gathers usage from several walks at once
+type usageWalk struct {
+	owners     bool
+	extensions bool
+
+	lock         sync.Mutex
+	seenLinks    map[[2]uint64]bool
+	byOwner      map[uint32]*DiskUsage
+	byExtension  map[string]*DiskUsage
+	errorCount   int
+	errors       []string
+	entriesCount int
+}
+
+//walk totals the tree under root
+func (walk *usageWalk) walk(root string) (usage DiskUsage) {
+	count := 0
+	godirwalk.Walk(root, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(filePath string, de *godirwalk.Dirent) error {
+			count++
+			walk.count(&usage, filePath)
+			return nil
+		},
+		ErrorCallback: func(filePath string, err error) godirwalk.ErrorAction {
+			walk.recordError(err)
+			return godirwalk.SkipNode
+		},
+	})
+	walk.lock.Lock()
+	walk.entriesCount += count
+	walk.lock.Unlock()
+
+	return
+}
+
+//count adds one entry to usage and the breakdowns
+func (walk *usageWalk) count(usage *DiskUsage, filePath string) {
+	fi, err := os.Lstat(filePath)
+	if err != nil {
+		walk.recordError(err)
+		return
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	var entry DiskUsage
+	switch {
+	case fi.IsDir():
+		entry.Directories = 1
+	case fi.Mode().IsRegular():
+		entry.Files = 1
+	default:
+		entry.Other = 1
+	}
+
+	if !fi.IsDir() && stat.Nlink > 1 {
+		walk.lock.Lock()
+		key := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+		seen := walk.seenLinks[key]
+		walk.seenLinks[key] = true
+		walk.lock.Unlock()
+		if seen {
+			return
+		}
+	}
+	entry.ApparentSize = fi.Size()
+	entry.Allocated = stat.Blocks * 512
+	usage.add(entry)
+
+	if !walk.owners && !walk.extensions {
+		return
+	}
+	walk.lock.Lock()
+	defer walk.lock.Unlock()
+	if walk.owners {
+		owner, ok := walk.byOwner[stat.Uid]
+		if !ok {
+			owner = &DiskUsage{}
+			walk.byOwner[stat.Uid] = owner
+		}
+		owner.add(entry)
+	}
+	if walk.extensions && entry.Files == 1 {
+		extension := strings.ToLower(filepath.Ext(fi.Name()))
+		byExtension, ok := walk.byExtension[extension]
+		if !ok {
+			byExtension = &DiskUsage{}
+			walk.byExtension[extension] = byExtension
+		}
+		byExtension.add(entry)
+	}
+}
+
+func (walk *usageWalk) recordError(err error) {
+	walk.lock.Lock()
+	defer walk.lock.Unlock()
+	walk.errorCount++
+	if len(walk.errors) < DU_MAX_ERRORS {
+		walk.errors = append(walk.errors, err.Error())
+	}
+}
+
+//doDiskUsage totals the space a tree uses: du|dir[|key=value...]. Options are
+//	top=N          break the total down by the N largest subdirectories of dir
+//	owners=true    break it down by owner
+//	extensions=N   list the N file extensions taking the most space
+// The subdirectories of dir are walked in parallel. Symlinks aren't followed. Unreadable entries are skipped and
+// reported, but don't fail the request
+func (worker *Worker) doDiskUsage(params []string) (reply []string, err error) {
+	if len(params) < DU_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to du. Expected at least " +
+			strconv.Itoa(DU_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+	root := filepath.Clean(params[DU_PARAM_DIR_IDX])
+	options, err := parseOptions("du", params[DU_PARAM_OPTIONS_IDX:], "top", "owners", "extensions")
+	if err != nil {
+		return
+	}
+	if err = worker.checkPaths(root); err != nil {
+		return
+	}
+	var top, extensions int
+	var owners bool
+	if value, ok := options["top"]; ok {
+		if top, err = strconv.Atoi(value); err != nil || top < 0 {
+			return nil, errors.New("du top must be a number of subdirectories")
+		}
+	}
+	if value, ok := options["extensions"]; ok {
+		if extensions, err = strconv.Atoi(value); err != nil || extensions < 0 {
+			return nil, errors.New("du extensions must be a number of extensions")
+		}
+	}
+	if value, ok := options["owners"]; ok {
+		if owners, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+	}
+
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return
+	}
+	walk := &usageWalk{owners: owners, extensions: extensions > 0, seenLinks: make(map[[2]uint64]bool),
+		byOwner: make(map[uint32]*DiskUsage), byExtension: make(map[string]*DiskUsage)}
+	report := DiskUsageReport{Path: root}
+	walk.count(&report.DiskUsage, root)
+
+	if fi.IsDir() {
+		dirents, readErr := godirwalk.ReadDirents(root, nil)
+		if readErr != nil {
+			return nil, readErr
+		}
+		//entries directly in root are counted here, subdirectories by a pool of walkers
+		var subdirs []string
+		for _, de := range dirents {
+			if de.IsDir() {
+				subdirs = append(subdirs, de.Name())
+			} else {
+				walk.count(&report.DiskUsage, filepath.Join(root, de.Name()))
+			}
+		}
+
+		results := make([]DiskUsage, len(subdirs))
+		next := make(chan int)
+		var wait sync.WaitGroup
+		for i := 0; i < DU_PARALLELISM && i < len(subdirs); i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for index := range next {
+					results[index] = walk.walk(filepath.Join(root, subdirs[index]))
+				}
+			}()
+		}
+		for index := range subdirs {
+			next <- index
+		}
+		close(next)
+		wait.Wait()
+
+		for index, usage := range results {
+			report.DiskUsage.add(usage)
+			if top > 0 {
+				report.Subdirectories = append(report.Subdirectories, NamedDiskUsage{Name: subdirs[index], DiskUsage: usage})
+			}
+		}
+		report.Subdirectories = largestUsage(report.Subdirectories, top)
+	}
+	worker.Server.metrics.addEntriesWalked("du", walk.entriesCount+1)
+
+	if owners {
+		names := make(map[string]string)
+		for uid, usage := range walk.byOwner {
+			report.Owners = append(report.Owners, OwnerDiskUsage{UID: uid, User: lookupName(names, "u", uid),
+				DiskUsage: *usage})
+		}
+		sort.Slice(report.Owners, func(i, j int) bool {
+			return report.Owners[i].Allocated > report.Owners[j].Allocated
+		})
+	}
+	if extensions > 0 {
+		for extension, usage := range walk.byExtension {
+			report.Extensions = append(report.Extensions, NamedDiskUsage{Name: extension, DiskUsage: *usage})
+		}
+		report.Extensions = largestUsage(report.Extensions, extensions)
+	}
+	report.ErrorCount, report.Errors = walk.errorCount, walk.errors
+
+	encoded, err := worker.jsonReply(report)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//largestUsage returns the n largest by allocated space, then name
+func largestUsage(usages []NamedDiskUsage, n int) []NamedDiskUsage {
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Allocated != usages[j].Allocated {
+			return usages[i].Allocated > usages[j].Allocated
+		}
+		return usages[i].Name < usages[j].Name
+	})
+	if len(usages) > n {
+		usages = usages[:n]
+	}
+	return usages
+}
@@ -2,89 +2,224 @@ package FileDaemon
 
 import (
 	panicUtil "github.com/cclose/go-utils/panic"
+	"encoding/json"
 	"errors"
 	"fmt"
 	zmq "github.com/pebbe/zmq4"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	//how long an idle worker waits on its socket before checking whether it should retire
+	workerIdleCheckInterval = 5 * time.Second
+)
+
 type Worker struct {
 	ID            int
 	Server        *Server
 	requestSocket *zmq.Socket
 
 	Active bool
+
+	//the request being handled, for log correlation. Empty while idle.
+	// Only the worker's goroutine writes these, under stateLock so status can read them
+	command, requestID string
+	busySince time.Time
+	handled uint64
+	//how far an archive or extract has got, while one is running
+	progress *WorkerProgress
+	stateLock sync.Mutex
+
+	//the long-running job in progress, if it is being recorded, and one handed to us to resume
+	job, resuming *Job
+
+	//a request has been taken and not yet answered. Only the worker's goroutine touches it
+	outstanding bool
 }
 
-func (worker Worker) getTimeStamp() string {
-	now := time.Now().In(worker.Server.Config.TimeZone)
-	return now.Format(worker.Server.Config.TimeStampFormat)
+//setRequest records the request the worker has started on, or clears it when cmd is empty
+func (worker *Worker) setRequest(cmd, requestID string) {
+	worker.stateLock.Lock()
+	defer worker.stateLock.Unlock()
+
+	worker.command, worker.requestID = cmd, requestID
+	if cmd != "" {
+		worker.busySince = time.Now()
+	} else {
+		worker.busySince = time.Time{}
+		worker.progress = nil
+		worker.handled++
+	}
 }
 
-func (worker Worker) logMessage(message string) {
-	worker.Server.Log.Printf(" -- [%s] |Worker-%d| %s", worker.getTimeStamp(), worker.ID, message)
+//setProgress records how far the request being handled has got, for status to report
+func (worker *Worker) setProgress(progress WorkerProgress) {
+	worker.stateLock.Lock()
+	defer worker.stateLock.Unlock()
+
+	worker.progress = &progress
 }
 
-func (worker Worker) logError(message string) {
-	worker.Server.ErrorLog.Printf(" -!!- [%s] |Worker-%d| %s", worker.getTimeStamp(), worker.ID, message)
+const WORKER_LOG_COMPONENT = "worker"
+
+//logComponent names the component a worker logs as: the command it is running, or "worker" while idle
+func (worker *Worker) logComponent() string {
+	if worker.command != "" {
+		return worker.command
+	}
+	return WORKER_LOG_COMPONENT
+}
+
+//log writes a record tagged with the worker and, when handling one, the request
+func (worker *Worker) log(level LogLevel, message string, fields ...interface{}) {
+	tags := []interface{}{"worker", worker.ID}
+	if worker.requestID != "" {
+		tags = append(tags, "request_id", worker.requestID)
+	}
+	worker.Server.Logger.Log(level, worker.logComponent(), message, append(tags, fields...)...)
+}
+
+func (worker *Worker) logDebug(message string, fields ...interface{}) {
+	worker.log(LOG_DEBUG, message, fields...)
+}
+
+func (worker *Worker) logMessage(message string, fields ...interface{}) {
+	worker.log(LOG_INFO, message, fields...)
+}
+
+func (worker *Worker) logWarn(message string, fields ...interface{}) {
+	worker.log(LOG_WARN, message, fields...)
+}
+
+func (worker *Worker) logError(message string, fields ...interface{}) {
+	worker.log(LOG_ERROR, message, fields...)
 }
 
 func (worker *Worker) Work() {
 	defer func() {
 		//catch exceptions
 		if r := recover(); r != nil {
-			worker.logError(fmt.Sprintf("died: %v [%s]\n", r, panicUtil.IdentifyPanic()))
+			worker.logError("died", "panic", fmt.Sprint(r), "location", panicUtil.IdentifyPanic())
+			worker.interruptJob("worker died: " + fmt.Sprint(r))
+			if worker.outstanding {
+				//the request dies with us unanswered, so the broker will never see a reply to count it done
+				atomic.AddInt32(&worker.Server.busyWorkers, -1)
+				atomic.AddInt64(&worker.Server.requestsInFlight, -1)
+			}
 		}
-		worker.logMessage("retired!")
+		worker.stateLock.Lock()
+		worker.command, worker.requestID = "", ""
+		worker.stateLock.Unlock()
+		worker.logMessage("retired")
 
-		//Notify the Worker-Master that we're quitting
-		worker.Server.Notify <- worker.ID
+		//Notify the Worker-Master that we're quitting, unless it has stopped listening
+		select {
+		case worker.Server.Notify <- worker.ID:
+		case <-worker.Server.stopped:
+		}
 	}()
 
 	var err error = nil
-	//Create a Reply Socket for receiving orders and sending responses
-	worker.requestSocket, err = worker.Server.ZMQContext.NewSocket(zmq.REP)
+	//Create a Socket for receiving orders and sending responses. The broker addresses us by our id
+	worker.requestSocket, err = worker.Server.ZMQContext.NewSocket(zmq.DEALER)
 	if err != nil {
 		panic("failed to open Socket: " + err.Error())
 	}
 	defer worker.requestSocket.Close()
+	if err = worker.requestSocket.SetIdentity(strconv.Itoa(worker.ID)); err != nil {
+		panic("failed to set Socket identity: " + err.Error())
+	}
 
-	//Connect the worker to the Dealer via an inproc thread
-	err = worker.requestSocket.Connect(worker.Server.Config.WorkerSocketFile)
+	//Connect the worker to the broker via an inproc thread
+	err = worker.requestSocket.Connect(worker.Server.CurrentConfig().WorkerSocketFile)
 	if err != nil {
 		panic("failed to bind to worker Socket: " + err.Error())
 	}
+	//wake up periodically while idle, so we notice if the pool has been shrunk
+	worker.requestSocket.SetRcvtimeo(workerIdleCheckInterval)
 
 	//Worker online and read to receive!
+	if _, err = worker.requestSocket.SendMessage(brokerMsgReady); err != nil {
+		panic("failed to tell the broker we're ready: " + err.Error())
+	}
 	worker.logMessage("online and listening")
 
 	//Track consecutive errors
 	errorCount := 0
+	//we've asked the broker to let us go, and wait for it to take us out of the rotation
+	retiring := false
 	for worker.Active {
 		//listen for and receive a message
 		msg, err := worker.requestSocket.RecvMessage(0)
-		if err != nil {
-			worker.logError("error reading request: " + err.Error())
+		if err != nil && zmq.AsErrno(err) == zmq.ETERM {
+			//the context is being terminated; the server is shutting down
+			worker.Active = false
+
+		} else if err != nil && zmq.AsErrno(err) == zmq.EAGAIN {
+			//nothing arrived while we waited; a good time to retire if we're surplus. Requests may already be on
+			// their way to us, so we only go once the broker says nothing more is. Asking again is harmless
+			if retiring || worker.Server.claimRetirement() {
+				retiring = true
+				worker.askToRetire()
+			}
+
+		} else if err != nil {
+			worker.logError("error reading request", "error", err)
 			errorCount++
 			// if we have consecutive failures past our limit, abandon this worker
-			if errorCount > worker.Server.Config.WorkerFailureThreshold {
+			if errorCount > worker.Server.CurrentConfig().WorkerFailureThreshold {
 				panic("Consecutive Error Threshold Exceeded")
 
 			} else {
 				//we'll take a timeout for 5 seconds after any errors
-				time.Sleep(time.Duration(worker.Server.Config.WorkerFailureTimeout) * time.Second)
+				time.Sleep(time.Duration(worker.Server.CurrentConfig().WorkerFailureTimeout) * time.Second)
 			}
 
-		} else {
+		} else if len(msg) > 0 && msg[0] == brokerMsgRetired {
+			worker.Active = false
+
+		} else if len(msg) > 0 && msg[0] == brokerMsgRequest {
 
 			//Request received
-			worker.handleRequest(msg)
+			atomic.AddInt32(&worker.Server.busyWorkers, 1)
+			worker.outstanding = true
+			worker.handleRequest(msg[1:])
+			worker.outstanding = false
+			atomic.AddInt32(&worker.Server.busyWorkers, -1)
+			//the broker passed over our last ask while this was on its way, so ask again now we're idle
+			if retiring && worker.Active {
+				worker.askToRetire()
+			}
+
+		} else {
+			worker.logError("unexpected message from broker", "frames", len(msg))
 		}
 	}
 }
 
+//askToRetire asks the broker to take us out of the rotation. It answers with brokerMsgRetired if we're idle, and
+// passes over the ask if a request is already on its way to us
+func (worker *Worker) askToRetire() {
+	if _, err := worker.requestSocket.SendMessage(brokerMsgRetire); err != nil {
+		worker.logError("error asking to retire", "error", err)
+	}
+}
+
 func (worker *Worker) handleRequest(msg []string) {
+	delimiter := worker.Server.CurrentConfig().MessageDelimiter
+	//the client's envelope goes back with the reply so the broker can route it
+	replyTo := envelope(msg)
+	msg = msg[len(replyTo):]
+	//write sends its content as the frames after the request, which mustn't be split on the delimiter
+	var content []string
+	if len(msg) > 0 && strings.HasPrefix(msg[0], "write"+delimiter) {
+		msg, content = msg[:1], msg[1:]
+	}
+
 	//loop over the received message parts and join them into one
 	var buffer strings.Builder
 	for _, msgPart := range msg {
@@ -95,12 +230,19 @@ func (worker *Worker) handleRequest(msg []string) {
 	//we don't worry about message framing as ZMQ does this for us
 	// General format is "command|param1|param2|param3"
 	// Parameters will depend on the command issued
-	cmdParts := strings.Split(buffer.String(), worker.Server.Config.MessageDelimiter)
+	cmdParts := strings.Split(buffer.String(), delimiter)
 	cmd := cmdParts[0]
 	params := cmdParts[1:]
 
+	//tag everything logged while handling this request
+	worker.setRequest(cmd, worker.Server.nextRequestID())
+	defer worker.setRequest("", "")
+	worker.logDebug("request received", "params", strings.Join(params, delimiter))
+
 	var err error
 	var reply []string
+	started := time.Now()
+	metricsCmd := cmd
 	switch cmd {
 	case "checksum":
 		reply, err = worker.doChecksum(params)
@@ -123,17 +265,108 @@ func (worker *Worker) handleRequest(msg []string) {
 	case "rm":
 		reply, err = worker.doRemove(params)
 		break
-	case "status": //status is a fast command to see if the daemon is up
-		reply = []string{"true"}
-		err = nil
+	case "touch": //create a file or set its times
+		reply, err = worker.doTouch(params)
+		break
+	case "write": //replace a file's content atomically
+		reply, err = worker.doWrite(params, content)
+		break
+	case "read": //a range of a file's content
+		reply, err = worker.doRead(params)
+		break
+	case "ln": //hard link
+		reply, err = worker.doLink(params, false)
+		break
+	case "symlink":
+		reply, err = worker.doLink(params, true)
+		break
+	case "readlink":
+		reply, err = worker.doReadlink(params)
+		break
+	case "getxattr": //extended attributes
+		reply, err = worker.doGetxattr(params)
+		break
+	case "setxattr":
+		reply, err = worker.doSetxattr(params)
+		break
+	case "listxattr":
+		reply, err = worker.doListxattr(params)
+		break
+	case "removexattr":
+		reply, err = worker.doRemovexattr(params)
+		break
+	case "archive": //bundle a tree into a tar, tar.gz, tar.zst or zip
+		reply, err = worker.doArchive(params)
+		break
+	case "extract":
+		reply, err = worker.doExtract(params)
+		break
+	case "manifest": //checksum every file in a tree
+		reply, err = worker.doManifest(params)
+		break
+	case "verify": //check a tree against a manifest
+		reply, err = worker.doVerify(params)
+		break
+	case "stat": //metadata of one or more paths, following symlinks
+		reply, err = worker.doStat(params, true)
+		break
+	case "lstat":
+		reply, err = worker.doStat(params, false)
+		break
+	case "ls": //a page of a directory listing
+		reply, err = worker.doList(params)
+		break
+	case "du": //space used by a tree
+		reply, err = worker.doDiskUsage(params)
+		break
+	case "find": //paths in a tree matching predicates, a chunk at a time
+		reply, err = worker.doFind(params)
+		break
+	case "batch": //several operations in one request, run in order
+		reply, err = worker.doBatch(params)
+		break
+	case "undo": //reverse a journaled chmod, chown or rm
+		reply, err = worker.doUndo(params)
+		break
+	case "trash-purge": //empty trash past its retention
+		reply, err = worker.doTrashPurge(params)
+		break
+	case "jobs": //list recorded long-running jobs
+		reply, err = worker.doJobs(params)
+		break
+	case "job-resume":
+		reply, err = worker.doJobResume(params)
+		break
+	case "job-forget":
+		reply, err = worker.doJobForget(params)
+		break
+	case "status": //status reports on the daemon's health, and fails if it is unhealthy
+		reply, err = worker.doStatus(params)
+		break
+	case "reload": //command to re-read the configuration file
+		reply, err = worker.doReload(params)
 		break
 	case "shutdown": //command to turn off the server
-		worker.Active = false
-		worker.Server.Active = false
+		//the server drains in-flight requests, including this one, before stopping us
+		worker.Server.Shutdown("shutdown command")
 		break
 
 	default:
 		err = errors.New("Unsupport command '" + cmd + "'")
+		metricsCmd = METRICS_UNKNOWN_COMMAND
+		worker.setRequest(WORKER_LOG_COMPONENT, worker.requestID)
+	}
+	elapsed := time.Since(started)
+	worker.Server.metrics.observeRequest(metricsCmd, err, elapsed.Seconds())
+	if err != nil {
+		worker.logWarn("request failed", "duration", elapsed, "error", err)
+	} else {
+		worker.logMessage("request handled", "duration", elapsed)
+	}
+
+	atomic.AddUint64(&worker.Server.requestsHandled, 1)
+	if err != nil {
+		atomic.AddUint64(&worker.Server.requestsFailed, 1)
 	}
 
 	//clear our string buffer
@@ -143,7 +376,7 @@ func (worker *Worker) handleRequest(msg []string) {
 		buffer.WriteString("true")
 		//If there is additional items for the reply, concatenate them with pipes
 		for _, replyChunk := range reply {
-			buffer.WriteString(worker.Server.Config.MessageDelimiter)
+			buffer.WriteString(delimiter)
 			buffer.WriteString(replyChunk)
 		} //Loop and Buffer is much faster than join
 
@@ -151,7 +384,7 @@ func (worker *Worker) handleRequest(msg []string) {
 		//If we failed, note this as the first part of the reply
 		buffer.WriteString("false")
 		//now concatenate the error message on with a pipe
-		buffer.WriteRune('|')
+		buffer.WriteString(delimiter)
 		buffer.WriteString(err.Error())
 	}
 
@@ -159,17 +392,90 @@ func (worker *Worker) handleRequest(msg []string) {
 	replyErr := errors.New("") //Placeholder to start the loop
 	for replyErr != nil {
 		//we send first so that we can disregard the initial error >.>
-		_, replyErr = worker.requestSocket.Send(buffer.String(), 0)
+		_, replyErr = worker.requestSocket.SendMessage(brokerMsgReply, replyTo, buffer.String())
 		//now we handle any errors and loop
+		if replyErr != nil && zmq.AsErrno(replyErr) == zmq.ETERM {
+			//shutdown gave up waiting on us; there's nobody left to reply to
+			worker.logWarn("abandoned reply, server shut down")
+			worker.Active = false
+			return
+		}
 		if replyErr != nil { //If we fail, loop a few times
-			worker.logError("error sending reply: " + replyErr.Error())
+			worker.logError("error sending reply", "error", replyErr)
 			errorCount++
 			// if we have consecutive failures past our limit, abandon this worker
-			if errorCount > worker.Server.Config.WorkerFailureThreshold {
+			if errorCount > worker.Server.CurrentConfig().WorkerFailureThreshold {
 				panic("Consecutive Error Threshold Exceeded")
 				//this panic will be handled in work
 			}
 		}
 	}
 	//and we're done
-}
\ No newline at end of file
+}
+
+//jsonReply encodes v as a single reply chunk. Any delimiter characters inside JSON strings are written as
+// \u escapes, so the chunk survives being split on the delimiter and still decodes to the same value.
+// This relies on the delimiter being punctuation JSON itself doesn't use, like the default |
+func (worker *Worker) jsonReply(v interface{}) (string, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	reply := string(encoded)
+	for _, r := range worker.Server.CurrentConfig().MessageDelimiter {
+		reply = strings.Replace(reply, string(r), fmt.Sprintf("\\u%04x", r), -1)
+	}
+
+	return reply, nil
+}
+
+//parseOptions reads key=value parameters, for commands with too many optional settings to take them by position.
+// Unknown or repeated keys are an error, so a typo doesn't silently do something else
+func parseOptions(cmd string, params []string, allowed ...string) (map[string]string, error) {
+	options := make(map[string]string, len(params))
+	for _, param := range params {
+		i := strings.Index(param, "=")
+		if i <= 0 {
+			return nil, errors.New("Invalid option to " + cmd + " '" + param + "', expected key=value")
+		}
+		key, value := param[:i], param[i+1:]
+		known := false
+		for _, name := range allowed {
+			known = known || name == key
+		}
+		if !known {
+			return nil, errors.New("Unknown option to " + cmd + " '" + key + "', expected one of " +
+				strings.Join(allowed, ", "))
+		}
+		if _, repeated := options[key]; repeated {
+			return nil, errors.New("Option " + key + " given twice to " + cmd)
+		}
+		options[key] = value
+	}
+
+	return options, nil
+}
+
+func (worker *Worker) doReload(params []string) (reply []string, err error) {
+	if len(params) != 0 {
+		err = errors.New("Incorrect number of parameters to reload. Expected 0 Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	applied, restart, err := worker.Server.RequestReload()
+	if err != nil {
+		return
+	}
+	//one chunk per changed setting, so callers can see exactly what took effect
+	for _, setting := range applied {
+		reply = append(reply, setting+": applied")
+	}
+	for _, setting := range restart {
+		reply = append(reply, setting+": requires restart")
+	}
+	if len(reply) == 0 {
+		reply = []string{"no changes"}
+	}
+
+	return
+}
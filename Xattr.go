@@ -0,0 +1,275 @@
+package FileDaemon
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/karrick/godirwalk"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	GETXATTR_PARAM_COUNT        = 2
+	GETXATTR_PARAM_FILEPATH_IDX = 0
+	GETXATTR_PARAM_NAME_IDX     = 1
+
+	SETXATTR_PARAM_COUNT_MIN     = 3
+	SETXATTR_PARAM_RECURSIVE_IDX = 0
+	SETXATTR_PARAM_FILEPATH_IDX  = 1
+	SETXATTR_PARAM_NAME_IDX      = 2
+	//the value is the rest of the message, so a delimiter inside it survives. Without one the value is empty
+	SETXATTR_PARAM_VALUE_IDX = 3
+
+	LISTXATTR_PARAM_COUNT        = 1
+	LISTXATTR_PARAM_FILEPATH_IDX = 0
+
+	REMOVEXATTR_PARAM_COUNT         = 3
+	REMOVEXATTR_PARAM_RECURSIVE_IDX = 0
+	REMOVEXATTR_PARAM_FILEPATH_IDX  = 1
+	REMOVEXATTR_PARAM_NAME_IDX      = 2
+
+	//namespaces policy.xattr_namespaces may open up. user is the only one by default
+	XATTR_NAMESPACE_USER     = "user"
+	XATTR_NAMESPACE_TRUSTED  = "trusted"
+	XATTR_NAMESPACE_SECURITY = "security"
+)
+
+//doGetxattr returns the value of one extended attribute: getxattr|path|name. The value may contain the delimiter
+// and so runs to the end of the reply
+func (worker *Worker) doGetxattr(params []string) (reply []string, err error) {
+	if len(params) != GETXATTR_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to getxattr. Expected " +
+			strconv.Itoa(GETXATTR_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	filePath := params[GETXATTR_PARAM_FILEPATH_IDX]
+	name := params[GETXATTR_PARAM_NAME_IDX]
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	if err = worker.checkXattr(name); err != nil {
+		return
+	}
+	value, err := readXattr(filePath, name, false)
+	if err != nil {
+		return
+	}
+
+	return []string{string(value)}, nil
+}
+
+//doSetxattr sets an extended attribute: setxattr|recursive|path|name|value. Recursive sets it on everything under a
+// directory as well, skipping symlinks, which can't carry user attributes
+func (worker *Worker) doSetxattr(params []string) (reply []string, err error) {
+	if len(params) < SETXATTR_PARAM_COUNT_MIN {
+		err = errors.New("Incorrect number of parameters to setxattr. Expected at least " +
+			strconv.Itoa(SETXATTR_PARAM_COUNT_MIN) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	recursive, err := strconv.ParseBool(params[SETXATTR_PARAM_RECURSIVE_IDX])
+	if err != nil {
+		return
+	}
+	filePath := params[SETXATTR_PARAM_FILEPATH_IDX]
+	name := params[SETXATTR_PARAM_NAME_IDX]
+	value := ""
+	if len(params) > SETXATTR_PARAM_VALUE_IDX {
+		value = strings.Join(params[SETXATTR_PARAM_VALUE_IDX:], worker.Server.CurrentConfig().MessageDelimiter)
+	}
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	if err = worker.checkXattr(name); err != nil {
+		return
+	}
+
+	err = worker.walkXattr("setxattr", filePath, recursive, func(subFilePath string) error {
+		return unix.Setxattr(subFilePath, name, []byte(value), 0)
+	})
+
+	return
+}
+
+//doListxattr returns the names of a path's extended attributes, sorted, as JSON: listxattr|path. Only names in
+// namespaces the policy allows are listed
+func (worker *Worker) doListxattr(params []string) (reply []string, err error) {
+	if len(params) != LISTXATTR_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to listxattr. Expected " +
+			strconv.Itoa(LISTXATTR_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	filePath := params[LISTXATTR_PARAM_FILEPATH_IDX]
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	names, err := listXattrs(filePath, false)
+	if err != nil {
+		return
+	}
+	config := worker.Server.CurrentConfig()
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		if config.AllowsXattr(name) {
+			allowed = append(allowed, name)
+		}
+	}
+	sort.Strings(allowed)
+
+	encoded, err := worker.jsonReply(allowed)
+	if err != nil {
+		return
+	}
+
+	return []string{encoded}, nil
+}
+
+//doRemovexattr removes an extended attribute: removexattr|recursive|path|name. Recursively, entries without the
+// attribute are passed over; otherwise a missing attribute is an error
+func (worker *Worker) doRemovexattr(params []string) (reply []string, err error) {
+	if len(params) != REMOVEXATTR_PARAM_COUNT {
+		err = errors.New("Incorrect number of parameters to removexattr. Expected " +
+			strconv.Itoa(REMOVEXATTR_PARAM_COUNT) + " Got " + strconv.Itoa(len(params)))
+		return
+	}
+
+	recursive, err := strconv.ParseBool(params[REMOVEXATTR_PARAM_RECURSIVE_IDX])
+	if err != nil {
+		return
+	}
+	filePath := params[REMOVEXATTR_PARAM_FILEPATH_IDX]
+	name := params[REMOVEXATTR_PARAM_NAME_IDX]
+	if err = worker.checkPaths(filePath); err != nil {
+		return
+	}
+	if err = worker.checkXattr(name); err != nil {
+		return
+	}
+
+	err = worker.walkXattr("removexattr", filePath, recursive, func(subFilePath string) error {
+		removeErr := unix.Removexattr(subFilePath, name)
+		if removeErr == unix.ENODATA && recursive {
+			return nil
+		}
+		return removeErr
+	})
+
+	return
+}
+
+//walkXattr runs fn on filePath, and with recursive on everything beneath it that isn't a symlink
+func (worker *Worker) walkXattr(cmd, filePath string, recursive bool, fn func(subFilePath string) error) error {
+	if !recursive {
+		worker.Server.metrics.addEntriesWalked(cmd, 1)
+		return fn(filePath)
+	}
+
+	count := 0
+	err := godirwalk.Walk(filePath, &godirwalk.Options{
+		Unsorted:          true,
+		AllowNonDirectory: true,
+		Callback: func(subFilePath string, de *godirwalk.Dirent) error {
+			if de.IsSymlink() {
+				return nil
+			}
+			count++
+			return fn(subFilePath)
+		},
+	})
+	worker.Server.metrics.addEntriesWalked(cmd, count)
+
+	return err
+}
+
+//readXattr reads the whole value of an attribute, following a symlink unless noFollow. The size is asked for
+// first, and asked again if the value grows in between
+func readXattr(filePath, name string, noFollow bool) ([]byte, error) {
+	get := unix.Getxattr
+	if noFollow {
+		get = unix.Lgetxattr
+	}
+	for {
+		size, err := get(filePath, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size == 0 {
+			return value, nil
+		}
+		n, err := get(filePath, name, value)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+//listXattrs returns the names of every attribute on filePath, following a symlink unless noFollow
+func listXattrs(filePath string, noFollow bool) ([]string, error) {
+	list := unix.Listxattr
+	if noFollow {
+		list = unix.Llistxattr
+	}
+	for {
+		size, err := list(filePath, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := list(filePath, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		//the names come back NUL terminated, one after another
+		return strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00"), nil
+	}
+}
+
+//copyXattrs gives each entry of a copy the extended attributes of its source that the policy allows, for requests
+// that keep them. cp itself leaves them behind
+func (worker *Worker) copyXattrs(srcPath, dstPath string) error {
+	config := worker.Server.CurrentConfig()
+	return godirwalk.Walk(srcPath, &godirwalk.Options{
+		Unsorted:          true,
+		AllowNonDirectory: true,
+		Callback: func(subSrcPath string, de *godirwalk.Dirent) error {
+			if de.IsSymlink() {
+				return nil
+			}
+			names, err := listXattrs(subSrcPath, true)
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(srcPath, subSrcPath)
+			if err != nil {
+				return err
+			}
+			subDstPath := filepath.Join(dstPath, relPath)
+			for _, name := range names {
+				if !config.AllowsXattr(name) {
+					continue
+				}
+				value, err := readXattr(subSrcPath, name, true)
+				if err != nil {
+					return err
+				}
+				if err = unix.Setxattr(subDstPath, name, value, 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,1181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	server "FileDaemon"
+	"FileDaemon/client"
+	"github.com/pborman/getopt/v2"
+)
+
+//exit codes, so scripts can tell an unreachable daemon from a bad request from a failed operation
+const (
+	EXIT_OK          = 0
+	EXIT_FAILED      = 1 //the daemon ran the operation and it failed, or the daemon is unhealthy
+	EXIT_USAGE       = 2 //bad arguments, nothing was sent
+	EXIT_UNAVAILABLE = 3 //the daemon couldn't be reached or didn't answer in time
+
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+)
+
+//commandOutput is what a subcommand prints: value for --output json, rows for --output table.
+// Commands with nothing to say leave rows empty
+type commandOutput struct {
+	value  interface{}
+	header []string
+	rows   [][]string
+}
+
+//runFunc carries out a subcommand once its flags are parsed and its arguments counted
+type runFunc func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error)
+
+type subcommand struct {
+	name    string
+	summary string
+	params  string
+	minArgs int
+	maxArgs int //-1 for no limit
+	//setup registers the subcommand's flags on set and returns the function that runs it
+	setup func(set *getopt.Set) runFunc
+}
+
+//usageError is a problem with the command line itself
+type usageError struct {
+	message string
+}
+
+func (e *usageError) Error() string {
+	return e.message
+}
+
+var subcommands = []subcommand{
+	{name: "chmod", summary: "apply a chmod profile to a path", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var mode string
+			var recursive bool
+			set.FlagLong(&mode, "mode", 'm', "chmod profile to apply (lock, read, owrite, ogwrite, write, aread or a configured profile)", "PROFILE").Mandatory()
+			set.FlagLong(&recursive, "recursive", 'R', "apply to everything under PATH too")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				result, err := fdClient.Chmod(ctx, args[0], mode, client.ChmodOptions{Recursive: recursive})
+				return journaledOutput("chmod", result, err, args...)
+			}
+		}},
+	{name: "chown", summary: "change the owner, and optionally group, of a path", params: "OWNER[:GROUP] PATH",
+		minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var recursive bool
+			set.FlagLong(&recursive, "recursive", 'R', "apply to everything under PATH too")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				owner, group := args[0], ""
+				if i := strings.Index(owner, ":"); i >= 0 {
+					owner, group = owner[:i], owner[i+1:]
+				}
+				result, err := fdClient.Chown(ctx, args[1], owner, group, client.ChownOptions{Recursive: recursive})
+				return journaledOutput("chown", result, err, args[1])
+			}
+		}},
+	{name: "cp", summary: "copy a file or directory", params: "SRC DST", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.CopyOptions
+			set.FlagLong(&options.Recursive, "recursive", 'R', "copy directories and their contents")
+			set.FlagLong(&options.KeepACL, "keep-acl", 0, "keep the source's ACLs instead of inheriting the destination directory's")
+			set.FlagLong(&options.KeepXattrs, "keep-xattrs", 0, "copy the source's extended attributes too")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				err := fdClient.Copy(ctx, args[0], args[1], options)
+				return operationOutput("cp", err, args...)
+			}
+		}},
+	{name: "mv", summary: "move a file or directory", params: "SRC DST", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.MoveOptions
+			set.FlagLong(&options.KeepACL, "keep-acl", 0, "keep the ACLs of what's moved instead of inheriting the destination directory's")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				err := fdClient.Move(ctx, args[0], args[1], options)
+				return operationOutput("mv", err, args...)
+			}
+		}},
+	{name: "rm", summary: "remove a file or directory", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var recursive, ignoreMissing bool
+			set.FlagLong(&recursive, "recursive", 'R', "remove directories and their contents")
+			set.FlagLong(&ignoreMissing, "ignore-missing", 'f', "succeed if PATH doesn't exist")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				result, err := fdClient.Remove(ctx, args[0], client.RemoveOptions{Recursive: recursive, IgnoreMissing: ignoreMissing})
+				return journaledOutput("rm", result, err, args...)
+			}
+		}},
+	{name: "mkdir", summary: "create a directory and any missing parents", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			options := client.MkdirOptions{Mode: "0755"}
+			var owner string
+			set.FlagLong(&options.Mode, "mode", 'm',
+				"permissions for the new directories, in octal like 0755 or symbolic like u=rwx,go=rx", "MODE")
+			set.FlagLong(&owner, "owner", 0, "owner of the new directories, by name or id", "OWNER[:GROUP]")
+			set.FlagLong(&options.Profile, "profile", 0, "chmod profile to apply to the new directories", "PROFILE")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				options.Owner = owner
+				if i := strings.Index(owner, ":"); i >= 0 {
+					options.Owner, options.Group = owner[:i], owner[i+1:]
+				}
+				result, err := fdClient.Mkdir(ctx, args[0], options)
+				if err != nil {
+					return nil, err
+				}
+				rows := make([][]string, 0, len(result.Paths))
+				for _, created := range result.Paths {
+					rows = append(rows, []string{created})
+				}
+				return &commandOutput{
+					value: struct {
+						Path    string   `json:"path"`
+						Created string   `json:"created"`
+						Paths   []string `json:"paths"`
+					}{args[0], result.Created, result.Paths},
+					header: []string{"CREATED"},
+					rows:   rows,
+				}, nil
+			}
+		}},
+	{name: "touch", summary: "create a file or set its times", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.TouchOptions
+			var atime, mtime, date string
+			set.FlagLong(&date, "date", 'd', "set both times to this RFC 3339 time instead of now", "TIME")
+			set.FlagLong(&atime, "atime", 0, "set just the access time", "TIME")
+			set.FlagLong(&mtime, "mtime", 0, "set just the modification time", "TIME")
+			set.FlagLong(&options.Reference, "reference", 'r', "use this file's times instead of now", "FILE")
+			set.FlagLong(&options.Recursive, "recursive", 'R', "set the times of everything under a directory too")
+			set.FlagLong(&options.NoCreate, "no-create", 'c', "don't create a missing file")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if date != "" {
+					atime, mtime = date, date
+				}
+				for _, when := range []struct {
+					value string
+					into  *time.Time
+				}{{atime, &options.Atime}, {mtime, &options.Mtime}} {
+					if when.value == "" {
+						continue
+					}
+					parsed, err := time.Parse(time.RFC3339, when.value)
+					if err != nil {
+						return nil, &usageError{"invalid time " + when.value + ", expected RFC 3339"}
+					}
+					*when.into = parsed
+				}
+				created, err := fdClient.Touch(ctx, args[0], options)
+				if err != nil {
+					return nil, err
+				}
+				return &commandOutput{value: struct {
+					Path    string `json:"path"`
+					Created bool   `json:"created"`
+				}{args[0], created}}, nil
+			}
+		}},
+	{name: "write", summary: "atomically replace a file's content with FILE or stdin", params: "PATH [FILE]",
+		minArgs: 1, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.WriteOptions
+			var owner string
+			set.FlagLong(&options.Profile, "profile", 'p', "chmod profile to give the file", "PROFILE")
+			set.FlagLong(&owner, "owner", 0, "owner for the file, instead of keeping the replaced file's", "OWNER[:GROUP]")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if options.Profile == "" {
+					return nil, &usageError{"write needs a --profile"}
+				}
+				options.Owner = owner
+				if i := strings.Index(owner, ":"); i >= 0 {
+					options.Owner, options.Group = owner[:i], owner[i+1:]
+				}
+				input := io.Reader(os.Stdin)
+				if len(args) > 1 && args[1] != "-" {
+					file, err := os.Open(args[1])
+					if err != nil {
+						return nil, &usageError{err.Error()}
+					}
+					defer file.Close()
+					input = file
+				}
+				content, err := io.ReadAll(input)
+				if err != nil {
+					return nil, &usageError{err.Error()}
+				}
+				written, err := fdClient.Write(ctx, args[0], content, options)
+				if err != nil {
+					return nil, err
+				}
+				return &commandOutput{value: struct {
+					Path    string `json:"path"`
+					Written int64  `json:"written"`
+				}{args[0], written}}, nil
+			}
+		}},
+	{name: "read", summary: "print a file's content", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var offset, length int64
+			set.FlagLong(&offset, "offset", 0, "read from this byte on", "BYTES")
+			set.FlagLong(&length, "length", 0, "read this many bytes rather than the whole file", "BYTES")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				//without a length, keep reading ranges as big as the daemon returns until the end
+				whole := length == 0
+				var content []byte
+				for {
+					want := length
+					if whole {
+						want = client.MaxReadLength
+					}
+					chunk, size, err := fdClient.Read(ctx, args[0], offset, want)
+					if err != nil {
+						return nil, err
+					}
+					content = append(content, chunk...)
+					offset += int64(len(chunk))
+					if !whole || len(chunk) == 0 || offset >= size {
+						break
+					}
+				}
+				//the content itself is the table output, as it is
+				if outputFormat == OUTPUT_TABLE {
+					os.Stdout.Write(content)
+				}
+				return &commandOutput{value: struct {
+					Path    string `json:"path"`
+					Content []byte `json:"content"`
+				}{args[0], content}}, nil
+			}
+		}},
+	{name: "ln", summary: "create a hard link, or a symlink with -s", params: "TARGET LINK", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.LinkOptions
+			var symbolic bool
+			set.FlagLong(&symbolic, "symbolic", 's', "make a symlink instead of a hard link")
+			set.FlagLong(&options.Replace, "force", 'f', "atomically replace anything already at LINK")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if symbolic {
+					return operationOutput("symlink", fdClient.Symlink(ctx, args[0], args[1], options), args...)
+				}
+				return operationOutput("ln", fdClient.Link(ctx, args[0], args[1], options), args...)
+			}
+		}},
+	{name: "readlink", summary: "show where a symlink points", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				target, err := fdClient.Readlink(ctx, args[0])
+				if err != nil {
+					return nil, err
+				}
+				return &commandOutput{value: struct {
+					Path   string `json:"path"`
+					Target string `json:"target"`
+				}{args[0], target}, rows: [][]string{{target}}}, nil
+			}
+		}},
+	{name: "getxattr", summary: "show the value of an extended attribute", params: "PATH NAME", minArgs: 2,
+		maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				value, err := fdClient.Getxattr(ctx, args[0], args[1])
+				if err != nil {
+					return nil, err
+				}
+				return &commandOutput{value: struct {
+					Path  string `json:"path"`
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				}{args[0], args[1], string(value)}, rows: [][]string{{string(value)}}}, nil
+			}
+		}},
+	{name: "setxattr", summary: "set an extended attribute", params: "PATH NAME VALUE", minArgs: 3, maxArgs: 3,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.XattrOptions
+			set.FlagLong(&options.Recursive, "recursive", 'R', "set it on everything under PATH too")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				err := fdClient.Setxattr(ctx, args[0], args[1], []byte(args[2]), options)
+				return operationOutput("setxattr", err, args[0])
+			}
+		}},
+	{name: "listxattr", summary: "list the extended attributes of a path", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				names, err := fdClient.Listxattr(ctx, args[0])
+				if err != nil {
+					return nil, err
+				}
+				rows := make([][]string, 0, len(names))
+				for _, name := range names {
+					rows = append(rows, []string{name})
+				}
+				return &commandOutput{value: struct {
+					Path  string   `json:"path"`
+					Names []string `json:"names"`
+				}{args[0], names}, rows: rows}, nil
+			}
+		}},
+	{name: "removexattr", summary: "remove an extended attribute", params: "PATH NAME", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.XattrOptions
+			set.FlagLong(&options.Recursive, "recursive", 'R', "remove it from everything under PATH too")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				err := fdClient.Removexattr(ctx, args[0], args[1], options)
+				return operationOutput("removexattr", err, args[0])
+			}
+		}},
+	{name: "archive", summary: "bundle a file or directory into a tar, tar.gz, tar.zst or zip archive",
+		params: "SRC ARCHIVE", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var format string
+			set.FlagLong(&format, "format", 0, "tar, tar.gz, tar.zst or zip; taken from ARCHIVE's name by default", "FORMAT")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if format == "" {
+					if format = archiveFormatOf(args[1]); format == "" {
+						return nil, &usageError{"can't tell the format of " + args[1] + " from its name, give --format"}
+					}
+				}
+				result, err := fdClient.Archive(ctx, format, args[0], args[1])
+				return archiveOutput(result, err)
+			}
+		}},
+	{name: "extract", summary: "unpack an archive into a directory", params: "ARCHIVE DIR", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			var format, owner string
+			var options client.ExtractOptions
+			set.FlagLong(&format, "format", 0, "tar, tar.gz, tar.zst or zip; taken from ARCHIVE's name by default", "FORMAT")
+			set.FlagLong(&owner, "owner", 0, "owner of what's extracted, by name or id", "OWNER[:GROUP]")
+			set.FlagLong(&options.Profile, "profile", 0, "chmod profile to apply to what's extracted", "PROFILE")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if format == "" {
+					if format = archiveFormatOf(args[0]); format == "" {
+						return nil, &usageError{"can't tell the format of " + args[0] + " from its name, give --format"}
+					}
+				}
+				options.Owner = owner
+				if i := strings.Index(owner, ":"); i >= 0 {
+					options.Owner, options.Group = owner[:i], owner[i+1:]
+				}
+				result, err := fdClient.Extract(ctx, format, args[0], args[1], options)
+				return archiveOutput(result, err)
+			}
+		}},
+	{name: "checksum", summary: "hash one or more files", params: "PATH...", minArgs: 1, maxArgs: -1,
+		setup: func(set *getopt.Set) runFunc {
+			algo := "md5"
+			var offset, length int64
+			var force bool
+			set.FlagLong(&algo, "algo", 'a', "hash algorithm: md5, sha1, sha256, sha512, blake2b, blake2b-512, blake3, xxhash64 or crc32c. Separate several with commas to compute them in one read", "ALGO[,ALGO...]")
+			set.FlagLong(&offset, "offset", 0, "hash from this byte on", "BYTES")
+			set.FlagLong(&length, "length", 0, "hash only this many bytes; 0 runs to the end of the file", "BYTES")
+			set.FlagLong(&force, "force", 0, "read the files even if the daemon has their digests cached")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if offset < 0 || length < 0 {
+					return nil, &usageError{"--offset and --length cannot be negative"}
+				}
+				options := client.ChecksumOptions{Algorithms: strings.Split(algo, ","), Offset: offset, Length: length,
+					Force: force}
+				return checksumOutput(ctx, fdClient, options, args)
+			}
+		}},
+	{name: "manifest", summary: "checksum every file under a directory", params: "DIR", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			algo := "sha256"
+			format := client.ManifestSum
+			var write string
+			set.FlagLong(&algo, "algo", 'a', "hash algorithm, as for checksum", "ALGO")
+			set.FlagLong(&format, "format", 0, "sum, for sha256sum -c and friends, or json, which adds sizes and mtimes", "FORMAT")
+			set.FlagLong(&write, "write", 0, "have the daemon write the manifest to this new file instead", "FILE")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if format != client.ManifestSum && format != client.ManifestJSON {
+					return nil, &usageError{"--format must be " + client.ManifestSum + " or " + client.ManifestJSON}
+				}
+				manifest, err := fdClient.Manifest(ctx, args[0], algo, client.ManifestOptions{Format: format, Output: write})
+				if err != nil {
+					return nil, err
+				}
+				return manifestOutput(manifest, format, write)
+			}
+		}},
+	{name: "verify", summary: "check a directory against a manifest", params: "DIR MANIFEST", minArgs: 2, maxArgs: 2,
+		setup: func(set *getopt.Set) runFunc {
+			algo := "sha256"
+			set.FlagLong(&algo, "algo", 'a', "hash algorithm of a sum format manifest", "ALGO")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				//MANIFEST is a file on the daemon's side, or - to send one from stdin
+				options := client.VerifyOptions{Algorithm: algo, ManifestPath: args[1]}
+				if args[1] == "-" {
+					manifest, err := io.ReadAll(os.Stdin)
+					if err != nil {
+						return nil, err
+					}
+					options = client.VerifyOptions{Algorithm: algo, Manifest: string(manifest)}
+				}
+				result, err := fdClient.Verify(ctx, args[0], options)
+				if result.Checked == 0 && len(result.Extra) == 0 && len(result.Errors) == 0 {
+					return nil, err
+				}
+				return verifyOutput(result), err
+			}
+		}},
+	{name: "stat", summary: "show the metadata of one or more paths", params: "PATH...", minArgs: 1, maxArgs: -1,
+		setup: func(set *getopt.Set) runFunc {
+			var dereference bool
+			set.FlagLong(&dereference, "dereference", 'L', "follow symlinks")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				stat := fdClient.Lstat
+				if dereference {
+					stat = fdClient.Stat
+				}
+				results, err := stat(ctx, args...)
+				if results == nil {
+					return nil, err
+				}
+				return statOutput(results), err
+			}
+		}},
+	{name: "ls", summary: "list a directory", params: "DIR", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.ListOptions
+			var types string
+			var onePage bool
+			set.FlagLong(&options.Long, "long", 'l', "include each entry's metadata")
+			set.FlagLong(&options.Sort, "sort", 0, "sort by name, size or mtime", "KEY")
+			set.FlagLong(&options.Reverse, "reverse", 'r', "reverse the sort order")
+			set.FlagLong(&options.Glob, "glob", 0, "only names matching this shell pattern", "PATTERN")
+			set.FlagLong(&types, "type", 't', "only these types: file, directory, symlink or other", "TYPE[,TYPE...]")
+			set.FlagLong(&options.Limit, "limit", 0, "entries fetched per request", "N")
+			set.FlagLong(&options.Cursor, "cursor", 0, "start from the cursor a previous --one-page printed", "CURSOR")
+			set.FlagLong(&onePage, "one-page", 0, "fetch a single page and print the cursor for the next on stderr")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if types != "" {
+					options.Types = strings.Split(types, ",")
+				}
+				var entries []client.ListEntry
+				for {
+					page, err := fdClient.List(ctx, args[0], options)
+					if err != nil {
+						return nil, err
+					}
+					entries = append(entries, page.Entries...)
+					if onePage && page.Next != "" {
+						fmt.Fprintln(os.Stderr, "next: "+page.Next)
+					}
+					if onePage || page.Next == "" {
+						break
+					}
+					options.Cursor = page.Next
+				}
+				return listOutput(entries, options.Long), nil
+			}
+		}},
+	{name: "du", summary: "total the space a tree uses", params: "PATH", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.DiskUsageOptions
+			set.FlagLong(&options.Top, "top", 0, "break the total down by the N largest subdirectories", "N")
+			set.FlagLong(&options.Owners, "owners", 0, "break the total down by owner")
+			set.FlagLong(&options.Extensions, "extensions", 0, "list the N file extensions taking the most space", "N")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				report, err := fdClient.DiskUsage(ctx, args[0], options)
+				if err != nil {
+					return nil, err
+				}
+				return diskUsageOutput(report), nil
+			}
+		}},
+	{name: "find", summary: "find paths in a tree matching predicates", params: "DIR", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var options client.FindOptions
+			var types, newer, older string
+			var minSize, maxSize int64
+			var maxDepth int
+			var onePage bool
+			set.FlagLong(&options.Name, "name", 0, "base name matches this shell pattern", "PATTERN")
+			set.FlagLong(&options.Regex, "regex", 0, "path relative to DIR matches this regular expression", "RE")
+			set.FlagLong(&types, "type", 't', "only these types: file, directory, symlink or other", "TYPE[,TYPE...]")
+			set.FlagLong(&minSize, "min-size", 0, "at least this many bytes", "BYTES")
+			set.FlagLong(&maxSize, "max-size", 0, "at most this many bytes", "BYTES")
+			set.FlagLong(&newer, "newer", 0, "modified after this RFC 3339 time", "TIME")
+			set.FlagLong(&older, "older", 0, "modified before this RFC 3339 time", "TIME")
+			set.FlagLong(&options.Owner, "owner", 0, "owned by this user", "USER")
+			set.FlagLong(&options.Group, "group", 0, "owned by this group", "GROUP")
+			set.FlagLong(&options.ModeNot, "mode-not", 0, "permissions are anything other than these octal bits", "MODE")
+			set.FlagLong(&options.ProfileMismatch, "profile-mismatch", 0, "permissions differ from what chmod with this profile sets", "PROFILE")
+			set.FlagLong(&maxDepth, "maxdepth", 0, "descend at most this many levels below DIR", "N")
+			set.FlagLong(&options.Long, "long", 'l', "include each match's metadata")
+			set.FlagLong(&options.Limit, "limit", 0, "matches fetched per request", "N")
+			set.FlagLong(&options.Cursor, "cursor", 0, "start from the cursor a previous --one-page printed", "CURSOR")
+			set.FlagLong(&onePage, "one-page", 0, "fetch a single chunk and print the cursor for the next on stderr")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				if types != "" {
+					options.Types = strings.Split(types, ",")
+				}
+				if set.IsSet("min-size") {
+					options.MinSize = &minSize
+				}
+				if set.IsSet("max-size") {
+					options.MaxSize = &maxSize
+				}
+				if set.IsSet("maxdepth") {
+					options.MaxDepth = &maxDepth
+				}
+				for _, when := range []struct {
+					value string
+					into  *time.Time
+				}{{newer, &options.Newer}, {older, &options.Older}} {
+					if when.value == "" {
+						continue
+					}
+					parsed, err := time.Parse(time.RFC3339, when.value)
+					if err != nil {
+						return nil, &usageError{message: "invalid time " + when.value + ", expected RFC 3339"}
+					}
+					*when.into = parsed
+				}
+				var matches []client.FindMatch
+				errorCount := 0
+				for {
+					page, err := fdClient.Find(ctx, args[0], options)
+					if err != nil {
+						return nil, err
+					}
+					matches = append(matches, page.Matches...)
+					errorCount += page.ErrorCount
+					if onePage && page.Next != "" {
+						fmt.Fprintln(os.Stderr, "next: "+page.Next)
+					}
+					if onePage || page.Next == "" {
+						break
+					}
+					options.Cursor = page.Next
+				}
+				//on stderr, so the paths on stdout stay usable by scripts
+				if errorCount > 0 {
+					fmt.Fprintln(os.Stderr, strconv.Itoa(errorCount)+" entries could not be read")
+				}
+				return findOutput(matches, options.Long), nil
+			}
+		}},
+	{name: "batch", summary: "run a JSON list of operations in one request", params: "[FILE]", minArgs: 0, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			var keepGoing, rollback bool
+			set.FlagLong(&keepGoing, "continue", 0, "keep going after a failed step")
+			set.FlagLong(&rollback, "rollback", 0, "undo completed steps if any step fails")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				ops, err := readBatch(args)
+				if err != nil {
+					return nil, err
+				}
+				result, err := fdClient.Batch(ctx, ops, client.BatchOptions{ContinueOnError: keepGoing, Rollback: rollback})
+				if result.Steps == nil {
+					return nil, err
+				}
+				return batchOutput(result), err
+			}
+		}},
+	{name: "undo", summary: "reverse a journaled chmod, chown or rm", params: "REQUEST-ID", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				return operationOutput("undo", fdClient.Undo(ctx, args[0]))
+			}
+		}},
+	{name: "trash-purge", summary: "empty the trash of requests past their retention", minArgs: 0, maxArgs: 0,
+		setup: func(set *getopt.Set) runFunc {
+			hours := -1
+			set.FlagLong(&hours, "older-than", 0, "purge requests older than this many hours instead of the configured retention; 0 purges everything", "HOURS")
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				olderThan := time.Duration(hours) * time.Hour
+				if hours < 0 {
+					olderThan = -1
+				}
+				result, err := fdClient.PurgeTrash(ctx, olderThan)
+				if err != nil {
+					return nil, err
+				}
+				return &commandOutput{value: map[string]string{"result": result}, rows: [][]string{{result}}}, nil
+			}
+		}},
+	{name: "jobs", summary: "list long-running jobs in progress or interrupted", minArgs: 0, maxArgs: 0,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				jobs, err := fdClient.Jobs(ctx)
+				if err != nil {
+					return nil, err
+				}
+				output := &commandOutput{value: jobs, header: []string{"ID", "STATE", "COMMAND", "PROCESSED", "CHECKPOINT"}}
+				for _, job := range jobs {
+					state := job.State
+					if !job.Resumable {
+						state += " (not resumable)"
+					}
+					output.rows = append(output.rows, []string{job.ID, state,
+						strings.Join(append([]string{job.Command}, job.Params...), " "), strconv.Itoa(job.Processed),
+						job.Checkpoint})
+				}
+				return output, nil
+			}
+		}},
+	{name: "job-resume", summary: "carry on with an interrupted job", params: "JOB-ID", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				return operationOutput("job-resume", fdClient.ResumeJob(ctx, args[0]))
+			}
+		}},
+	{name: "job-forget", summary: "drop the record of an interrupted job", params: "JOB-ID", minArgs: 1, maxArgs: 1,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				return operationOutput("job-forget", fdClient.ForgetJob(ctx, args[0]))
+			}
+		}},
+	{name: "status", summary: "show the daemon's health and activity", minArgs: 0, maxArgs: 0,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				report, err := fdClient.Status(ctx)
+				//an unhealthy daemon still sends its report, as the error message
+				var serverErr *client.ServerError
+				if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, "{") {
+					report = serverErr.Message
+				} else if err != nil {
+					return nil, err
+				}
+				output, decodeErr := statusOutput(report)
+				if decodeErr != nil {
+					return nil, &client.ProtocolError{Command: "status", Reply: []string{report}, Message: decodeErr.Error()}
+				}
+				return output, err
+			}
+		}},
+	{name: "reload", summary: "re-read the daemon's configuration file", minArgs: 0, maxArgs: 0,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				changes, err := fdClient.Reload(ctx)
+				if err != nil {
+					return nil, err
+				}
+				output := &commandOutput{value: map[string][]string{"changes": changes}, header: []string{"CHANGE"}}
+				for _, change := range changes {
+					output.rows = append(output.rows, []string{change})
+				}
+				return output, nil
+			}
+		}},
+	{name: "shutdown", summary: "stop the daemon once in-flight requests finish", minArgs: 0, maxArgs: 0,
+		setup: func(set *getopt.Set) runFunc {
+			return func(ctx context.Context, fdClient *client.Client, args []string) (*commandOutput, error) {
+				return operationOutput("shutdown", fdClient.Shutdown(ctx))
+			}
+		}},
+}
+
+func findSubcommand(name string) *subcommand {
+	for i := range subcommands {
+		if subcommands[i].name == name {
+			return &subcommands[i]
+		}
+	}
+	return nil
+}
+
+//newSubcommandSet builds the flag set for cmd, with the flags every subcommand shares
+func newSubcommandSet(cmd *subcommand) (*getopt.Set, runFunc, *bool) {
+	set := getopt.New()
+	set.SetProgram(programName + " " + cmd.name)
+	set.SetParameters(cmd.params)
+	help := false
+	set.FlagLong(&help, "help", 'h', "show this help")
+	set.FlagLong(&outputFormat, "output", 'o', "output format, table or json", "FORMAT")
+	run := cmd.setup(set)
+
+	return set, run, &help
+}
+
+//runSubcommand parses args, args[0] being the subcommand name, runs it against the daemon and prints the result.
+// It returns the process exit code
+func runSubcommand(args []string, config *server.Config) int {
+	cmd := findSubcommand(args[0])
+	if cmd == nil {
+		fmt.Fprintln(os.Stderr, "unknown command "+args[0])
+		printUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+
+	set, run, help := newSubcommandSet(cmd)
+	//a missing mandatory flag is an error even with --help, so look for it first
+	for _, arg := range args[1:] {
+		if arg == "--" {
+			break
+		}
+		if arg == "-h" || arg == "--help" {
+			*help = true
+		}
+	}
+	if *help {
+		set.PrintUsage(os.Stdout)
+		return EXIT_OK
+	}
+	if err := set.Getopt(args, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		set.PrintUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	params := set.Args()
+	if len(params) < cmd.minArgs || (cmd.maxArgs >= 0 && len(params) > cmd.maxArgs) {
+		fmt.Fprintln(os.Stderr, "wrong number of arguments to "+cmd.name)
+		set.PrintUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	if outputFormat != OUTPUT_TABLE && outputFormat != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "unknown output format "+outputFormat+", expected table or json")
+		return EXIT_USAGE
+	}
+
+	options := client.Options{
+		Delimiter: config.MessageDelimiter,
+		Timeout:   time.Duration(executeTimeout) * time.Second,
+	}
+	//commands aren't all safe to repeat, so only resend when asked to
+	if getopt.IsSet("retries") {
+		options.Retries = executeRetries
+	}
+	fdClient, err := client.New(config.RequestSocketFileName, options)
+	if err != nil {
+		return reportError(err)
+	}
+	defer fdClient.Close()
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "I: sending %s to %s\n", cmd.name, config.RequestSocketFileName)
+	}
+	output, err := run(context.Background(), fdClient, params)
+	if output != nil {
+		if printErr := printOutput(os.Stdout, output); printErr != nil {
+			fmt.Fprintln(os.Stderr, printErr)
+			return EXIT_FAILED
+		}
+	}
+	if err != nil {
+		return reportError(err)
+	}
+	if verbose && outputFormat == OUTPUT_TABLE && (output == nil || len(output.rows) == 0) {
+		fmt.Println("Success!")
+	}
+
+	return EXIT_OK
+}
+
+//reportError prints err and picks the exit code for it
+func reportError(err error) int {
+	var usageErr *usageError
+	var validationErr *client.ValidationError
+	var connectionErr *client.ConnectionError
+	switch {
+	case errors.As(err, &usageErr), errors.As(err, &validationErr):
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	case errors.As(err, &connectionErr), errors.Is(err, client.ErrClosed):
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_UNAVAILABLE
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+}
+
+//archiveFormatOf picks the archive format from a file name, or returns "" when the name doesn't say
+func archiveFormatOf(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return client.ArchiveTarGz
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return client.ArchiveTarZst
+	case strings.HasSuffix(path, ".tar"):
+		return client.ArchiveTar
+	case strings.HasSuffix(path, ".zip"):
+		return client.ArchiveZip
+	}
+	return ""
+}
+
+func archiveOutput(result client.ArchiveResult, err error) (*commandOutput, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &commandOutput{
+		value:  result,
+		header: []string{"ENTRIES", "BYTES", "SKIPPED"},
+		rows: [][]string{{strconv.FormatInt(result.Entries, 10), strconv.FormatInt(result.Bytes, 10),
+			strconv.FormatInt(result.Skipped, 10)}},
+	}, nil
+}
+
+//operationOutput reports commands that only succeed or fail. Table output is silent on success, like the
+// coreutils they stand in for
+func operationOutput(command string, err error, paths ...string) (*commandOutput, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &commandOutput{value: struct {
+		Command string   `json:"command"`
+		Paths   []string `json:"paths,omitempty"`
+		OK      bool     `json:"ok"`
+	}{command, paths, true}}, nil
+}
+
+//journaledOutput is operationOutput for commands that reply with their request id when the daemon journals them.
+// The id is what undo takes
+func journaledOutput(command string, result client.JournaledResult, err error, paths ...string) (*commandOutput, error) {
+	if err != nil || result.RequestID == "" {
+		return operationOutput(command, err, paths...)
+	}
+	return &commandOutput{
+		value: struct {
+			Command   string   `json:"command"`
+			Paths     []string `json:"paths,omitempty"`
+			OK        bool     `json:"ok"`
+			RequestID string   `json:"request_id"`
+		}{command, paths, true, result.RequestID},
+		header: []string{"UNDO ID"},
+		rows:   [][]string{{result.RequestID}},
+	}, nil
+}
+
+type checksumEntry struct {
+	Path    string            `json:"path"`
+	Digests map[string]string `json:"digests,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+//checksumOutput hashes each path in turn. Like md5sum it carries on past files that fail and reports them all,
+// but gives up as soon as the daemon is unreachable
+func checksumOutput(ctx context.Context, fdClient *client.Client, options client.ChecksumOptions, paths []string) (*commandOutput, error) {
+	algo := strings.Join(options.Algorithms, ",")
+	var entries []checksumEntry
+	output := &commandOutput{header: []string{"DIGEST", "ALGORITHM", "PATH"}}
+	failed := 0
+	for _, path := range paths {
+		results, err := fdClient.Checksums(ctx, path, options)
+		entry := checksumEntry{Path: path}
+		if err != nil {
+			var serverErr *client.ServerError
+			if !errors.As(err, &serverErr) {
+				return nil, err
+			}
+			entry.Error = serverErr.Message
+			failed++
+			output.rows = append(output.rows, []string{"FAILED: " + serverErr.Message, algo, path})
+		} else {
+			entry.Digests = make(map[string]string, len(results))
+			for _, result := range results {
+				entry.Digests[result.Algorithm] = result.Digest
+				output.rows = append(output.rows, []string{result.Digest, result.Algorithm, path})
+			}
+		}
+		entries = append(entries, entry)
+	}
+	output.value = entries
+
+	if failed > 0 {
+		return output, &client.ServerError{Command: "checksum", Message: strconv.Itoa(failed) + " of " +
+			strconv.Itoa(len(paths)) + " files could not be hashed"}
+	}
+	return output, nil
+}
+
+//readBatch reads operations from FILE, or stdin, as a JSON list of ["command", "param", ...] lists
+func readBatch(args []string) (ops []client.Operation, err error) {
+	input := io.Reader(os.Stdin)
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return nil, &usageError{err.Error()}
+		}
+		defer file.Close()
+		input = file
+	}
+
+	var operations [][]string
+	if err = json.NewDecoder(input).Decode(&operations); err != nil {
+		return nil, &usageError{"invalid batch: " + err.Error()}
+	}
+	for i, operation := range operations {
+		if len(operation) == 0 {
+			return nil, &usageError{"invalid batch: operation " + strconv.Itoa(i) + " is empty"}
+		}
+		ops = append(ops, client.Operation{Command: operation[0], Params: operation[1:]})
+	}
+
+	return
+}
+
+//manifestOutput prints a sum manifest line by line, so the output can be fed to sha256sum -c and friends
+func manifestOutput(manifest, format, written string) (*commandOutput, error) {
+	if written != "" {
+		return &commandOutput{value: map[string]string{"path": written, "files": manifest},
+			header: []string{"PATH", "FILES"}, rows: [][]string{{written, manifest}}}, nil
+	}
+	if format == client.ManifestJSON {
+		return &commandOutput{value: json.RawMessage(manifest), rows: [][]string{{manifest}}}, nil
+	}
+	output := &commandOutput{value: map[string]string{"manifest": manifest}}
+	for _, line := range strings.Split(strings.TrimSuffix(manifest, "\n"), "\n") {
+		if line != "" {
+			output.rows = append(output.rows, []string{line})
+		}
+	}
+	return output, nil
+}
+
+func verifyOutput(result client.VerifyResult) *commandOutput {
+	output := &commandOutput{value: result, header: []string{"STATUS", "PATH", "DETAIL"}}
+	for _, path := range result.Missing {
+		output.rows = append(output.rows, []string{"MISSING", path, ""})
+	}
+	for _, path := range result.Extra {
+		output.rows = append(output.rows, []string{"EXTRA", path, ""})
+	}
+	for _, mismatch := range result.Mismatched {
+		detail := mismatch.Reason
+		if detail == "" {
+			detail = "expected " + mismatch.Expected + " got " + mismatch.Actual
+		}
+		output.rows = append(output.rows, []string{"CHANGED", mismatch.Path, detail})
+	}
+	for _, message := range result.Errors {
+		output.rows = append(output.rows, []string{"ERROR", "", message})
+	}
+	output.rows = append(output.rows, []string{"MATCHED", strconv.Itoa(result.Matched) + " of " +
+		strconv.Itoa(result.Checked), ""})
+	return output
+}
+
+func statOutput(results []client.StatResult) *commandOutput {
+	output := &commandOutput{value: results,
+		header: []string{"TYPE", "PERMISSIONS", "OWNER", "GROUP", "SIZE", "MODIFIED", "PATH"}}
+	for _, result := range results {
+		if result.StatInfo == nil {
+			output.rows = append(output.rows, []string{"FAILED: " + result.Error, "", "", "", "", "", result.Path})
+			continue
+		}
+		owner, group := result.User, result.Group
+		if owner == "" {
+			owner = strconv.FormatUint(uint64(result.UID), 10)
+		}
+		if group == "" {
+			group = strconv.FormatUint(uint64(result.GID), 10)
+		}
+		path := result.Path
+		if result.Target != "" {
+			path += " -> " + result.Target
+		}
+		output.rows = append(output.rows, []string{result.Type, result.Permissions, owner, group,
+			strconv.FormatInt(result.Size, 10), result.Mtime.Local().Format(time.RFC3339), path})
+	}
+	return output
+}
+
+func listOutput(entries []client.ListEntry, long bool) *commandOutput {
+	if entries == nil {
+		entries = []client.ListEntry{}
+	}
+	output := &commandOutput{value: entries}
+	if !long {
+		for _, entry := range entries {
+			output.rows = append(output.rows, []string{entry.Name})
+		}
+		return output
+	}
+
+	output.header = []string{"PERMISSIONS", "OWNER", "GROUP", "SIZE", "MODIFIED", "NAME"}
+	for _, entry := range entries {
+		if entry.StatInfo == nil {
+			output.rows = append(output.rows, []string{"FAILED: " + entry.Error, "", "", "", "", entry.Name})
+			continue
+		}
+		row := statOutput([]client.StatResult{{Path: entry.Name, StatInfo: entry.StatInfo}}).rows[0]
+		output.rows = append(output.rows, row[1:])
+	}
+	return output
+}
+
+//diskUsageOutput lists the total first, then each breakdown asked for
+func diskUsageOutput(report client.DiskUsageReport) *commandOutput {
+	output := &commandOutput{value: report, header: []string{"ALLOCATED", "APPARENT", "FILES", "DIRS", "WHAT"}}
+	row := func(usage client.DiskUsage, what string) {
+		output.rows = append(output.rows, []string{strconv.FormatInt(usage.Allocated, 10),
+			strconv.FormatInt(usage.ApparentSize, 10), strconv.FormatInt(usage.Files, 10),
+			strconv.FormatInt(usage.Directories, 10), what})
+	}
+	row(report.DiskUsage, report.Path)
+	for _, subdir := range report.Subdirectories {
+		row(subdir.DiskUsage, "dir "+subdir.Name)
+	}
+	for _, owner := range report.Owners {
+		name := owner.User
+		if name == "" {
+			name = strconv.FormatUint(uint64(owner.UID), 10)
+		}
+		row(owner.DiskUsage, "owner "+name)
+	}
+	for _, extension := range report.Extensions {
+		name := extension.Name
+		if name == "" {
+			name = "(none)"
+		}
+		row(extension.DiskUsage, "extension "+name)
+	}
+	if report.ErrorCount > 0 {
+		output.rows = append(output.rows, []string{"", "", "", "", strconv.Itoa(report.ErrorCount) +
+			" entries could not be read"})
+	}
+	return output
+}
+
+func findOutput(matches []client.FindMatch, long bool) *commandOutput {
+	if matches == nil {
+		matches = []client.FindMatch{}
+	}
+	var output *commandOutput
+	if !long {
+		output = &commandOutput{value: matches}
+		for _, match := range matches {
+			output.rows = append(output.rows, []string{match.Path})
+		}
+	} else {
+		results := make([]client.StatResult, 0, len(matches))
+		for _, match := range matches {
+			results = append(results, client.StatResult{Path: match.Path, Error: match.Error, StatInfo: match.StatInfo})
+		}
+		output = statOutput(results)
+		output.value = matches
+	}
+	return output
+}
+
+func batchOutput(result client.BatchResult) *commandOutput {
+	output := &commandOutput{value: result, header: []string{"STEP", "COMMAND", "RESULT"}}
+	for _, step := range result.Steps {
+		outcome := "ok"
+		switch {
+		case step.Skipped:
+			outcome = "skipped"
+		case !step.OK:
+			outcome = "failed: " + step.Error
+		}
+		if step.RolledBack {
+			outcome += ", rolled back"
+		} else if step.RollbackError != "" {
+			outcome += ", rollback failed: " + step.RollbackError
+		}
+		output.rows = append(output.rows, []string{strconv.Itoa(step.Index), step.Command, outcome})
+	}
+
+	return output
+}
+
+//statusOutput lays the status report out as a table, or passes the JSON through untouched
+func statusOutput(report string) (*commandOutput, error) {
+	var status server.ServerStatus
+	if err := json.Unmarshal([]byte(report), &status); err != nil {
+		return nil, err
+	}
+
+	health := "healthy"
+	if !status.Healthy {
+		health = "unhealthy: " + strings.Join(status.Problems, ", ")
+	}
+	output := &commandOutput{
+		value:  json.RawMessage(report),
+		header: []string{"FIELD", "VALUE"},
+		rows: [][]string{
+			{"version", status.Version},
+			{"health", health},
+			{"started", status.Started.Format(time.RFC3339)},
+			{"uptime", (time.Duration(status.UptimeSeconds) * time.Second).String()},
+			{"config", status.ConfigFile},
+			{"socket", status.Socket.Path + " " + status.Socket.Mode},
+			{"workers", fmt.Sprintf("%d running (%d busy, %d idle) of %d configured, %d restarts",
+				status.Workers.Running, status.Workers.Busy, status.Workers.Idle, status.Workers.Configured,
+				status.Workers.Restarts)},
+			{"requests", fmt.Sprintf("%d in flight, %d queued, %d handled, %d failed, %d rejected",
+				status.Requests.InFlight, status.Requests.Queued, status.Requests.Handled, status.Requests.Failed,
+				status.Requests.Rejected)},
+		},
+	}
+	for _, job := range status.Jobs {
+		output.rows = append(output.rows, []string{"job " + job.ID,
+			fmt.Sprintf("%s %s, %d done", job.State, job.Command, job.Processed)})
+	}
+	for _, worker := range status.Workers.Pool {
+		if worker.State == server.WORKER_STATE_BUSY {
+			busy := fmt.Sprintf("%s %s for %.1fs", worker.Command, worker.RequestID, worker.BusySeconds)
+			if progress := worker.Progress; progress != nil {
+				busy += fmt.Sprintf(", %d entries, %d of %d bytes", progress.Entries, progress.Bytes,
+					progress.TotalBytes)
+			}
+			output.rows = append(output.rows, []string{"worker " + strconv.Itoa(worker.ID), busy})
+		}
+	}
+
+	return output, nil
+}
+
+func printOutput(w io.Writer, output *commandOutput) error {
+	if outputFormat == OUTPUT_JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output.value)
+	}
+	if len(output.rows) == 0 {
+		return nil
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(output.header) > 0 {
+		fmt.Fprintln(table, strings.Join(output.header, "\t"))
+	}
+	for _, row := range output.rows {
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	return table.Flush()
+}
+
+//printHelp shows the overall usage, or one subcommand's options
+func printHelp(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stdout)
+		return EXIT_OK
+	}
+	cmd := findSubcommand(args[0])
+	if cmd == nil {
+		fmt.Fprintln(os.Stderr, "unknown command "+args[0])
+		printUsage(os.Stderr)
+		return EXIT_USAGE
+	}
+	set, _, _ := newSubcommandSet(cmd)
+	set.PrintUsage(os.Stdout)
+
+	return EXIT_OK
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [OPTIONS] COMMAND [COMMAND OPTIONS] ARGS...\n", programName)
+	fmt.Fprintf(w, "       %s [OPTIONS] --server\n", programName)
+	fmt.Fprintf(w, "       %s [OPTIONS] --execute 'COMMAND%sPARAM...'\n\n", programName, "|")
+	fmt.Fprintln(w, "Commands:")
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range subcommands {
+		fmt.Fprintf(table, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	table.Flush()
+	fmt.Fprintf(w, "\nRun '%s help COMMAND' for a command's options.\n\nOptions:\n", programName)
+	getopt.CommandLine.PrintOptions(w)
+	fmt.Fprintf(w, "\nExit status: %d success, %d operation failed, %d usage error, %d daemon unavailable\n",
+		EXIT_OK, EXIT_FAILED, EXIT_USAGE, EXIT_UNAVAILABLE)
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+//formats archive and extract understand
+const (
+	ArchiveTar    = "tar"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarZst = "tar.zst"
+	ArchiveZip    = "zip"
+)
+
+type ExtractOptions struct {
+	//owner and group of everything extracted, by name or id. Empty leaves it owned by the daemon
+	Owner, Group string
+	//chmod profile applied to everything extracted, on top of the ACL it inherits
+	Profile string
+}
+
+type ArchiveResult struct {
+	//entries written
+	Entries int64 `json:"entries"`
+	//bytes of file content in them
+	Bytes int64 `json:"bytes"`
+	//entries passed over because they aren't files, directories or links
+	Skipped int64 `json:"skipped"`
+}
+
+//Archive bundles src into a new archive at dst in format: ArchiveTar, ArchiveTarGz, ArchiveTarZst or ArchiveZip.
+// Large trees take a while, so give ctx and the client's Timeout room; the daemon's status shows the progress
+func (client *Client) Archive(ctx context.Context, format, src, dst string) (result ArchiveResult, err error) {
+	if err = requireParams("archive", format, src, dst); err != nil {
+		return
+	}
+	return client.archiveResult(ctx, "archive", format, src, dst)
+}
+
+//Extract unpacks the archive at src, in format, into the existing directory dst. Entries that would land outside
+// dst, or that already exist, fail the extract; whatever was extracted before then is left in place
+func (client *Client) Extract(ctx context.Context, format, src, dst string, opts ExtractOptions) (result ArchiveResult, err error) {
+	if err = requireParams("extract", format, src, dst); err != nil {
+		return
+	}
+	if opts.Owner == "" && opts.Group != "" {
+		return result, &ValidationError{Command: "extract", Message: "a group needs an owner"}
+	}
+	params := []string{format, src, dst}
+	if opts.Owner != "" {
+		owner := opts.Owner
+		if opts.Group != "" {
+			owner += ":" + opts.Group
+		}
+		params = append(params, "owner="+owner)
+	}
+	if opts.Profile != "" {
+		params = append(params, "profile="+opts.Profile)
+	}
+	return client.archiveResult(ctx, "extract", params...)
+}
+
+func (client *Client) archiveResult(ctx context.Context, command string, params ...string) (result ArchiveResult, err error) {
+	reply, err := client.Do(ctx, command, params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return result, &ProtocolError{Command: command, Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		return result, &ProtocolError{Command: command, Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type BatchOptions struct {
+	//keep going after a failed step instead of skipping the rest
+	ContinueOnError bool
+	//if any step fails, undo the steps that succeeded as far as the daemon can
+	Rollback bool
+}
+
+//BatchStep is the outcome of one operation in a batch
+type BatchStep struct {
+	Index         int      `json:"index"`
+	Command       string   `json:"command"`
+	OK            bool     `json:"ok"`
+	Skipped       bool     `json:"skipped,omitempty"`
+	Reply         []string `json:"reply,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	RolledBack    bool     `json:"rolled_back,omitempty"`
+	RollbackError string   `json:"rollback_error,omitempty"`
+}
+
+type BatchResult struct {
+	OK    bool        `json:"ok"`
+	Steps []BatchStep `json:"steps"`
+}
+
+//Batch runs ops in order on a single worker, saving a round trip per operation. If a step fails the result is
+// returned along with a *ServerError, so callers can see which steps ran, failed, were skipped or were rolled back
+func (client *Client) Batch(ctx context.Context, ops []Operation, opts BatchOptions) (result BatchResult, err error) {
+	if len(ops) == 0 {
+		return result, &ValidationError{Command: "batch", Message: "no operations"}
+	}
+	operations := make([][]string, len(ops))
+	for i, op := range ops {
+		if op.Command == "" {
+			return result, &ValidationError{Command: "batch", Message: "operation " + strconv.Itoa(i) + " has no command"}
+		}
+		operations[i] = append([]string{op.Command}, op.Params...)
+	}
+	encoded, err := json.Marshal(operations)
+	if err != nil {
+		return result, &ValidationError{Command: "batch", Message: err.Error()}
+	}
+
+	mode := "stop"
+	if opts.ContinueOnError {
+		mode = "continue"
+	}
+	reply, err := client.send(ctx, "batch", []string{mode, strconv.FormatBool(opts.Rollback)}, string(encoded))
+
+	//a failed batch still reports its steps, as the error message
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, "{") {
+		if decodeErr := json.Unmarshal([]byte(serverErr.Message), &result); decodeErr == nil {
+			return result, &ServerError{Command: "batch", Message: batchFailure(result)}
+		}
+	}
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return result, &ProtocolError{Command: "batch", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		return result, &ProtocolError{Command: "batch", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//batchFailure summarises the first failed step
+func batchFailure(result BatchResult) string {
+	for _, step := range result.Steps {
+		if !step.OK && !step.Skipped {
+			return "step " + strconv.Itoa(step.Index) + " (" + step.Command + "): " + step.Error
+		}
+	}
+	return "batch failed"
+}
@@ -0,0 +1,229 @@
+//Package client is a Go client for the file daemon. It speaks the daemon's delimited request protocol over the
+// request socket so callers can use typed methods instead of assembling command strings by hand
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+const (
+	DEFAULT_SOCKET_FILE = "/tmp/fd_odc_ws.sock"
+	DEFAULT_DELIMITER   = "|"
+	DEFAULT_TIMEOUT     = 25 * time.Second
+	DEFAULT_POOL_SIZE   = 4
+
+	//how often a waiting request checks whether its context has been cancelled
+	pollInterval = 100 * time.Millisecond
+
+	replySuccess = "true"
+)
+
+type Options struct {
+	//the daemon's request.message_delimiter. Defaults to |
+	Delimiter string
+	//how long to wait for each attempt at a reply, if the context doesn't end sooner. Defaults to 25 seconds
+	Timeout time.Duration
+	//how many times to resend a request that timed out. Defaults to 0, as not every command is safe to repeat
+	Retries int
+	//how many idle connections to keep open for reuse. Defaults to 4
+	PoolSize int
+}
+
+//Client sends requests to a file daemon. It is safe for concurrent use; each request borrows a connection from a
+// pool, as ZMQ sockets may only be used by one goroutine at a time
+type Client struct {
+	endpoint string
+	options  Options
+
+	context *zmq.Context
+	pool    chan *zmq.Socket
+
+	lock   sync.Mutex
+	closed bool
+}
+
+//New creates a client for the daemon listening on socketFile, the daemon's request.socket_file
+func New(socketFile string, options Options) (*Client, error) {
+	if socketFile == "" {
+		socketFile = DEFAULT_SOCKET_FILE
+	}
+	if options.Delimiter == "" {
+		options.Delimiter = DEFAULT_DELIMITER
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = DEFAULT_POOL_SIZE
+	}
+
+	zmqContext, err := zmq.NewContext()
+	if err != nil {
+		return nil, &ConnectionError{Endpoint: socketFile, Err: err}
+	}
+
+	return &Client{
+		endpoint: "ipc://" + socketFile,
+		options:  options,
+		context:  zmqContext,
+		pool:     make(chan *zmq.Socket, options.PoolSize),
+	}, nil
+}
+
+//Close closes pooled connections and releases the client's ZMQ context.
+// Requests still in progress when Close is called will fail
+func (client *Client) Close() error {
+	client.lock.Lock()
+	if client.closed {
+		client.lock.Unlock()
+		return nil
+	}
+	client.closed = true
+	client.lock.Unlock()
+
+	for {
+		select {
+		case socket := <-client.pool:
+			socket.Close()
+		default:
+			return client.context.Term()
+		}
+	}
+}
+
+//Do sends a raw command and returns the reply chunks that followed "true".
+// A "false" reply is returned as a *ServerError. Parameters may not contain the delimiter
+func (client *Client) Do(ctx context.Context, command string, params ...string) ([]string, error) {
+	return client.send(ctx, command, params, "")
+}
+
+//send builds and sends a request. tail, if not empty, is appended after params without the delimiter check, for
+// commands like batch whose last parameter is free-form and read back whole by the daemon. frames are sent as they
+// are after the request, for write's content
+func (client *Client) send(ctx context.Context, command string, params []string, tail string, frames ...string) ([]string, error) {
+	for _, param := range append([]string{command}, params...) {
+		if strings.Contains(param, client.options.Delimiter) {
+			return nil, &ValidationError{Command: command, Message: "parameter contains the delimiter: " + param}
+		}
+	}
+	if tail != "" {
+		params = append(params, tail)
+	}
+	request := strings.Join(append([]string{command}, params...), client.options.Delimiter)
+
+	//each attempt gets Timeout to complete, within whatever deadline the caller's context has
+	var reply string
+	var err error
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, client.options.Timeout)
+		reply, err = client.roundTrip(attemptCtx, append([]string{request}, frames...))
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= client.options.Retries {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(reply, client.options.Delimiter)
+	if parts[0] != replySuccess {
+		return nil, &ServerError{Command: command, Message: strings.Join(parts[1:], client.options.Delimiter)}
+	}
+
+	return parts[1:], nil
+}
+
+//roundTrip sends one request on a pooled connection and waits for the reply
+func (client *Client) roundTrip(ctx context.Context, message []string) (reply string, err error) {
+	socket, err := client.acquire()
+	if err != nil {
+		return
+	}
+
+	if _, err = socket.SendMessage(message); err != nil {
+		socket.Close()
+		return "", &ConnectionError{Endpoint: client.endpoint, Err: err}
+	}
+
+	poller := zmq.NewPoller()
+	poller.Add(socket, zmq.POLLIN)
+	for {
+		wait := pollInterval
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		if err = ctx.Err(); err != nil || wait <= 0 {
+			//a REQ socket still waiting on its reply can't be reused, so drop it
+			socket.Close()
+			if err == nil {
+				err = context.DeadlineExceeded
+			}
+			return "", &ConnectionError{Endpoint: client.endpoint, Err: err}
+		}
+
+		polled, pollErr := poller.Poll(wait)
+		if pollErr != nil {
+			socket.Close()
+			return "", &ConnectionError{Endpoint: client.endpoint, Err: pollErr}
+		}
+		if len(polled) > 0 {
+			break
+		}
+	}
+
+	parts, err := socket.RecvMessage(0)
+	if err != nil {
+		socket.Close()
+		return "", &ConnectionError{Endpoint: client.endpoint, Err: err}
+	}
+	client.release(socket)
+
+	return strings.Join(parts, ""), nil
+}
+
+func (client *Client) acquire() (*zmq.Socket, error) {
+	client.lock.Lock()
+	closed := client.closed
+	client.lock.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	select {
+	case socket := <-client.pool:
+		return socket, nil
+	default:
+	}
+
+	socket, err := client.context.NewSocket(zmq.REQ)
+	if err != nil {
+		return nil, &ConnectionError{Endpoint: client.endpoint, Err: err}
+	}
+	socket.SetLinger(0)
+	if err = socket.Connect(client.endpoint); err != nil {
+		socket.Close()
+		return nil, &ConnectionError{Endpoint: client.endpoint, Err: err}
+	}
+
+	return socket, nil
+}
+
+func (client *Client) release(socket *zmq.Socket) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if !client.closed {
+		select {
+		case client.pool <- socket:
+			return
+		default: //pool is full
+		}
+	}
+	socket.Close()
+}
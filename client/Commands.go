@@ -0,0 +1,402 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ChmodOptions struct {
+	Recursive bool
+}
+
+type ChownOptions struct {
+	Recursive bool
+}
+
+type CopyOptions struct {
+	Recursive bool
+	//keep the source's NFSv4 ACLs rather than inherit those of the directory the copy lands in
+	KeepACL bool
+	//copy the source's extended attributes too, in the namespaces the daemon's policy allows
+	KeepXattrs bool
+}
+
+type MoveOptions struct {
+	//keep the moved tree's NFSv4 ACLs rather than inherit those of the directory it lands in
+	KeepACL bool
+}
+
+type RemoveOptions struct {
+	Recursive bool
+	//succeed when the path is already gone
+	IgnoreMissing bool
+}
+
+type MkdirOptions struct {
+	//permissions for each new directory, in octal like 0755 or symbolic like u=rwx,go=rx. Empty leaves them to
+	// the daemon's umask
+	Mode string
+	//owner and group of each new directory, by name or id. Empty leaves them to the daemon
+	Owner, Group string
+	//chmod profile applied to each new directory, on top of the ACL it inherits
+	Profile string
+}
+
+type MkdirResult struct {
+	//the first directory that had to be created, empty if the path already existed
+	Created string
+	//every directory created, top first
+	Paths []string
+}
+
+//JournaledResult is the reply to chmod, chown and rm
+type JournaledResult struct {
+	//the request id undo takes, empty when the daemon doesn't journal
+	RequestID string
+}
+
+type ChecksumResult struct {
+	Algorithm string
+	Digest    string
+}
+
+//Ping checks that the daemon is up and healthy
+func (client *Client) Ping(ctx context.Context) error {
+	_, err := client.Do(ctx, "status", "brief")
+	return err
+}
+
+//Status returns the daemon's status report as JSON. An unhealthy daemon fails the request with a *ServerError
+// whose Message holds the same JSON report
+func (client *Client) Status(ctx context.Context) (report string, err error) {
+	reply, err := client.Do(ctx, "status")
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return "", &ProtocolError{Command: "status", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+
+	return reply[0], nil
+}
+
+//Reload asks the daemon to re-read its configuration file. It returns one line per changed setting
+func (client *Client) Reload(ctx context.Context) ([]string, error) {
+	return client.Do(ctx, "reload")
+}
+
+//Shutdown asks the daemon to finish the requests it has in hand and exit
+func (client *Client) Shutdown(ctx context.Context) error {
+	_, err := client.Do(ctx, "shutdown")
+	return err
+}
+
+//Undo reverses a chmod, chown or rm the daemon journaled. requestID is the extra reply chunk those commands send
+// when journaling is enabled
+func (client *Client) Undo(ctx context.Context, requestID string) error {
+	if err := requireParams("undo", requestID); err != nil {
+		return err
+	}
+	_, err := client.Do(ctx, "undo", requestID)
+	return err
+}
+
+//PurgeTrash empties the trash of requests older than olderThan, rounded down to whole hours, after which they can't be
+// undone. A negative olderThan uses the daemon's journal.retention_hours
+func (client *Client) PurgeTrash(ctx context.Context, olderThan time.Duration) (string, error) {
+	var params []string
+	if olderThan >= 0 {
+		params = append(params, strconv.Itoa(int(olderThan/time.Hour)))
+	}
+	reply, err := client.Do(ctx, "trash-purge", params...)
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 1 {
+		return "", &ProtocolError{Command: "trash-purge", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+
+	return reply[0], nil
+}
+
+//Job is a long-running operation the daemon has recorded, either still running or cut short by a crash
+type Job struct {
+	ID         string    `json:"id"`
+	RequestID  string    `json:"request_id"`
+	Command    string    `json:"command"`
+	Params     []string  `json:"params"`
+	State      string    `json:"state"`
+	Resumable  bool      `json:"resumable"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+	Checkpoint string    `json:"checkpoint,omitempty"`
+	Processed  int       `json:"processed"`
+	Error      string    `json:"error,omitempty"`
+}
+
+//Jobs lists the jobs the daemon has recorded. It fails unless jobs.state_file is set
+func (client *Client) Jobs(ctx context.Context) (jobs []Job, err error) {
+	reply, err := client.Do(ctx, "jobs")
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return nil, &ProtocolError{Command: "jobs", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &jobs); err != nil {
+		return nil, &ProtocolError{Command: "jobs", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//ResumeJob carries on with an interrupted job from its last checkpoint, returning once it finishes
+func (client *Client) ResumeJob(ctx context.Context, id string) error {
+	if err := requireParams("job-resume", id); err != nil {
+		return err
+	}
+	_, err := client.Do(ctx, "job-resume", id)
+	return err
+}
+
+//ForgetJob drops the record of an interrupted job
+func (client *Client) ForgetJob(ctx context.Context, id string) error {
+	if err := requireParams("job-forget", id); err != nil {
+		return err
+	}
+	_, err := client.Do(ctx, "job-forget", id)
+	return err
+}
+
+//Chmod applies the named chmod profile (lock, read, owrite, ogwrite, write, aread or a configured one) to path
+func (client *Client) Chmod(ctx context.Context, path, mode string, opts ChmodOptions) (result JournaledResult, err error) {
+	if err = requireParams("chmod", path, mode); err != nil {
+		return
+	}
+	return client.runJournaled(ctx, ChmodOp(path, mode, opts))
+}
+
+//Chown changes the owner of path, and its group too when group is not empty
+func (client *Client) Chown(ctx context.Context, path, owner, group string, opts ChownOptions) (result JournaledResult, err error) {
+	if err = requireParams("chown", path, owner); err != nil {
+		return
+	}
+	return client.runJournaled(ctx, ChownOp(path, owner, group, opts))
+}
+
+//Copy copies src to dst, which must not already exist. The copy inherits the ACL of its new directory unless
+// opts.KeepACL is set
+func (client *Client) Copy(ctx context.Context, src, dst string, opts CopyOptions) error {
+	if err := requireParams("cp", src, dst); err != nil {
+		return err
+	}
+	return client.run(ctx, CopyOp(src, dst, opts))
+}
+
+//Move moves src to dst, which must not already exist. What's moved inherits the ACL of its new directory unless
+// opts.KeepACL is set
+func (client *Client) Move(ctx context.Context, src, dst string, opts MoveOptions) error {
+	if err := requireParams("mv", src, dst); err != nil {
+		return err
+	}
+	return client.run(ctx, MoveOp(src, dst, opts))
+}
+
+//Remove deletes path
+func (client *Client) Remove(ctx context.Context, path string, opts RemoveOptions) (result JournaledResult, err error) {
+	if err = requireParams("rm", path); err != nil {
+		return
+	}
+	return client.runJournaled(ctx, RemoveOp(path, opts))
+}
+
+//Mkdir creates path and any missing parents, cloning the ACL of the nearest existing ancestor onto each before
+// the mode, profile and owner in opts are applied
+func (client *Client) Mkdir(ctx context.Context, path string, opts MkdirOptions) (result MkdirResult, err error) {
+	if err = requireParams("mkdir", path); err != nil {
+		return
+	}
+	if opts.Owner == "" && opts.Group != "" {
+		return result, &ValidationError{Command: "mkdir", Message: "a group needs an owner"}
+	}
+	op := MkdirOp(path, opts)
+	reply, err := client.Do(ctx, op.Command, op.Params...)
+	if err != nil {
+		return
+	}
+	if len(reply) == 0 {
+		return result, &ProtocolError{Command: "mkdir", Reply: reply, Message: "expected at least 1 reply chunk"}
+	}
+	result.Created = reply[0]
+	if result.Created != "" {
+		result.Paths = reply
+	}
+
+	return
+}
+
+//Checksum hashes the file at path with algo: md5, sha1, sha256, sha512, blake2b, blake2b-512, blake3, xxhash64 or
+// crc32c
+func (client *Client) Checksum(ctx context.Context, path, algo string) (result ChecksumResult, err error) {
+	results, err := client.Checksums(ctx, path, ChecksumOptions{Algorithms: []string{algo}})
+	if err != nil {
+		return
+	}
+	return results[0], nil
+}
+
+//ChecksumRange hashes length bytes of the file at path starting at offset, or everything from offset on when length
+// is 0. The daemon streams the file, so any size of file or range is fine
+func (client *Client) ChecksumRange(ctx context.Context, path, algo string, offset, length int64) (result ChecksumResult, err error) {
+	results, err := client.Checksums(ctx, path, ChecksumOptions{Algorithms: []string{algo}, Offset: offset, Length: length})
+	if err != nil {
+		return
+	}
+	return results[0], nil
+}
+
+type ChecksumOptions struct {
+	//every algorithm is computed from a single read of the file
+	Algorithms []string
+	//hash Length bytes from Offset. Leave both 0 for the whole file; a Length of 0 runs to the end of the file
+	Offset, Length int64
+	//read the file even if the daemon has the digests cached
+	Force bool
+}
+
+//Checksums hashes the file at path with each of opts.Algorithms, returning the digests in the same order
+func (client *Client) Checksums(ctx context.Context, path string, opts ChecksumOptions) (results []ChecksumResult, err error) {
+	if err = requireParams("checksum", append([]string{path}, opts.Algorithms...)...); err != nil {
+		return
+	}
+	if len(opts.Algorithms) == 0 {
+		return nil, &ValidationError{Command: "checksum", Message: "no algorithms"}
+	}
+	if opts.Offset < 0 || opts.Length < 0 {
+		return nil, &ValidationError{Command: "checksum", Message: "offset and length cannot be negative"}
+	}
+	for _, algo := range opts.Algorithms {
+		if strings.Contains(algo, checksumAlgorithmSep) {
+			return nil, &ValidationError{Command: "checksum", Message: "algorithm names cannot contain " + checksumAlgorithmSep}
+		}
+	}
+
+	op := ChecksumOp(path, strings.Join(opts.Algorithms, checksumAlgorithmSep))
+	if opts.Offset != 0 || opts.Length != 0 {
+		op = ChecksumRangeOp(path, strings.Join(opts.Algorithms, checksumAlgorithmSep), opts.Offset, opts.Length)
+	}
+	if opts.Force {
+		op.Params = append(op.Params, "true")
+	}
+	reply, err := client.Do(ctx, op.Command, op.Params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != len(opts.Algorithms) {
+		return nil, &ProtocolError{Command: "checksum", Reply: reply, Message: "expected one digest per algorithm"}
+	}
+	for i, algo := range opts.Algorithms {
+		results = append(results, ChecksumResult{Algorithm: algo, Digest: reply[i]})
+	}
+
+	return
+}
+
+//Operation is one request to the daemon, as sent on its own or as a step in a batch
+type Operation struct {
+	Command string
+	Params  []string
+}
+
+func ChmodOp(path, mode string, opts ChmodOptions) Operation {
+	return Operation{"chmod", []string{mode, strconv.FormatBool(opts.Recursive), path}}
+}
+
+func ChownOp(path, owner, group string, opts ChownOptions) Operation {
+	if group != "" {
+		owner += ":" + group
+	}
+	return Operation{"chown", []string{owner, strconv.FormatBool(opts.Recursive), path}}
+}
+
+//the keep ACL flag is only sent when set, so requests still suit daemons that predate it
+func CopyOp(src, dst string, opts CopyOptions) Operation {
+	op := Operation{"cp", []string{strconv.FormatBool(opts.Recursive), src, dst}}
+	if opts.KeepACL || opts.KeepXattrs {
+		op.Params = append(op.Params, strconv.FormatBool(opts.KeepACL))
+	}
+	if opts.KeepXattrs {
+		op.Params = append(op.Params, "true")
+	}
+	return op
+}
+
+func MoveOp(src, dst string, opts MoveOptions) Operation {
+	op := Operation{"mv", []string{src, dst}}
+	if opts.KeepACL {
+		op.Params = append(op.Params, "true")
+	}
+	return op
+}
+
+func RemoveOp(path string, opts RemoveOptions) Operation {
+	return Operation{"rm", []string{strconv.FormatBool(opts.Recursive), strconv.FormatBool(opts.IgnoreMissing), path}}
+}
+
+func MkdirOp(path string, opts MkdirOptions) Operation {
+	op := Operation{"mkdir", []string{opts.Mode, path}}
+	if opts.Owner != "" {
+		owner := opts.Owner
+		if opts.Group != "" {
+			owner += ":" + opts.Group
+		}
+		op.Params = append(op.Params, "owner="+owner)
+	}
+	if opts.Profile != "" {
+		op.Params = append(op.Params, "profile="+opts.Profile)
+	}
+	return op
+}
+
+//the daemon takes several algorithms as a comma separated list
+const checksumAlgorithmSep = ","
+
+func ChecksumOp(path, algo string) Operation {
+	return Operation{"checksum", []string{algo, path}}
+}
+
+//run sends op for commands whose reply carries nothing but success
+func (client *Client) run(ctx context.Context, op Operation) error {
+	_, err := client.Do(ctx, op.Command, op.Params...)
+	return err
+}
+
+//runJournaled sends op and picks out the request id a journaling daemon replies with
+func (client *Client) runJournaled(ctx context.Context, op Operation) (result JournaledResult, err error) {
+	reply, err := client.Do(ctx, op.Command, op.Params...)
+	if err != nil {
+		return
+	}
+	if len(reply) > 0 {
+		result.RequestID = reply[0]
+	}
+	return
+}
+
+//ChecksumRangeOp hashes length bytes starting at offset. A length of 0 runs to the end of the file
+func ChecksumRangeOp(path, algo string, offset, length int64) Operation {
+	return Operation{"checksum", []string{algo, path, strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10)}}
+}
+
+//requireParams rejects empty required parameters before they reach the daemon
+func requireParams(command string, params ...string) error {
+	for _, param := range params {
+		if param == "" {
+			return &ValidationError{Command: command, Message: "missing required parameter"}
+		}
+	}
+	return nil
+}
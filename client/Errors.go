@@ -0,0 +1,52 @@
+package client
+
+import "errors"
+
+//ErrClosed is returned for requests made after Close
+var ErrClosed = errors.New("client is closed")
+
+//ConnectionError means the request never got an answer: the daemon couldn't be reached or didn't reply in time.
+// The operation may or may not have been carried out
+type ConnectionError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *ConnectionError) Error() string {
+	return "file daemon at " + e.Endpoint + " unavailable: " + e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+//ValidationError means the request was rejected before it was sent
+type ValidationError struct {
+	Command string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid " + e.Command + " request: " + e.Message
+}
+
+//ServerError means the daemon replied that the operation failed
+type ServerError struct {
+	Command string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Command + " failed: " + e.Message
+}
+
+//ProtocolError means the daemon's reply wasn't in the form expected for the command
+type ProtocolError struct {
+	Command string
+	Reply   []string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return "unexpected reply to " + e.Command + ": " + e.Message
+}
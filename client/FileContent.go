@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+type WriteOptions struct {
+	//chmod profile the file is given: lock, read, owrite, ogwrite, write, aread or a configured one
+	Profile string
+	//owner and group by name or id. Leave Owner empty to keep those of the file being replaced
+	Owner, Group string
+}
+
+//MaxReadLength is the most Read returns at once
+const MaxReadLength = 16 << 20
+
+//writeFrameSize keeps any one frame of a large write to a reasonable size
+const writeFrameSize = 1 << 20
+
+//Write replaces the content of the file at path atomically: readers see either the old file or all of content.
+// It returns the number of bytes written
+func (client *Client) Write(ctx context.Context, path string, content []byte, opts WriteOptions) (written int64, err error) {
+	if err = requireParams("write", path, opts.Profile); err != nil {
+		return
+	}
+	if opts.Owner == "" && opts.Group != "" {
+		return 0, &ValidationError{Command: "write", Message: "a group needs an owner"}
+	}
+	owner := opts.Owner
+	if opts.Group != "" {
+		owner += ":" + opts.Group
+	}
+	var frames []string
+	for start := 0; start < len(content); start += writeFrameSize {
+		end := start + writeFrameSize
+		if end > len(content) {
+			end = len(content)
+		}
+		frames = append(frames, string(content[start:end]))
+	}
+
+	reply, err := client.send(ctx, "write", []string{opts.Profile, owner, path}, "", frames...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return 0, &ProtocolError{Command: "write", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if written, err = strconv.ParseInt(reply[0], 10, 64); err != nil {
+		return 0, &ProtocolError{Command: "write", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//Read returns length bytes of the file at path from offset, fewer at the end of the file, along with the file's
+// size. A length of 0 reads to the end. At most MaxReadLength comes back at a time, so read larger files in ranges
+func (client *Client) Read(ctx context.Context, path string, offset, length int64) (content []byte, size int64, err error) {
+	if err = requireParams("read", path); err != nil {
+		return
+	}
+	if offset < 0 || length < 0 {
+		return nil, 0, &ValidationError{Command: "read", Message: "offset and length cannot be negative"}
+	}
+
+	reply, err := client.Do(ctx, "read", path, strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10))
+	if err != nil {
+		return
+	}
+	if len(reply) < 2 {
+		return nil, 0, &ProtocolError{Command: "read", Reply: reply, Message: "expected the size and content"}
+	}
+	if size, err = strconv.ParseInt(reply[0], 10, 64); err != nil {
+		return nil, 0, &ProtocolError{Command: "read", Reply: reply, Message: err.Error()}
+	}
+	//the content isn't escaped, so any delimiters in it split it up
+	content = []byte(strings.Join(reply[1:], client.options.Delimiter))
+
+	return
+}
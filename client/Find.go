@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FindOptions struct {
+	//base name matches this shell pattern
+	Name string
+	//path relative to the starting directory matches this regular expression
+	Regex string
+	//only these types: file, directory, symlink or other
+	Types []string
+	//size bounds in bytes, when set
+	MinSize, MaxSize *int64
+	//modified after Newer and before Older, when set
+	Newer, Older time.Time
+	//user and group, by name or id
+	Owner, Group string
+	//permission bits in octal; only paths with any other permissions match
+	ModeNot string
+	//only paths whose permissions or NFSv4 ACL differ from what chmod with this profile sets
+	ProfileMismatch string
+	//levels below the starting directory to descend, when set. 0 only checks the directory itself
+	MaxDepth *int
+	//include each match's metadata
+	Long bool
+	//matches per chunk, the daemon's default of 1000 when 0
+	Limit int
+	//carry on from the Next of a previous chunk, which must have used the same directory
+	Cursor string
+}
+
+type FindMatch struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+	*StatInfo
+}
+
+type FindPage struct {
+	Matches []FindMatch `json:"matches"`
+	//cursor for the next chunk, empty once the walk is done
+	Next string `json:"next,omitempty"`
+	//entries that couldn't be read in this chunk, and the first few of their errors
+	ErrorCount int      `json:"error_count"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+//Find returns one chunk of the paths under dir matching every option set. Pass the chunk's Next as opts.Cursor to
+// get the one after, or use FindEach to walk them all
+func (client *Client) Find(ctx context.Context, dir string, opts FindOptions) (page FindPage, err error) {
+	if err = requireParams("find", dir); err != nil {
+		return
+	}
+	params := []string{dir}
+	add := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+value)
+		}
+	}
+	add("name", opts.Name)
+	add("regex", opts.Regex)
+	add("type", strings.Join(opts.Types, ","))
+	if opts.MinSize != nil {
+		add("min_size", strconv.FormatInt(*opts.MinSize, 10))
+	}
+	if opts.MaxSize != nil {
+		add("max_size", strconv.FormatInt(*opts.MaxSize, 10))
+	}
+	if !opts.Newer.IsZero() {
+		add("newer", opts.Newer.Format(time.RFC3339))
+	}
+	if !opts.Older.IsZero() {
+		add("older", opts.Older.Format(time.RFC3339))
+	}
+	add("owner", opts.Owner)
+	add("group", opts.Group)
+	add("mode_not", opts.ModeNot)
+	add("profile_mismatch", opts.ProfileMismatch)
+	if opts.MaxDepth != nil {
+		add("maxdepth", strconv.Itoa(*opts.MaxDepth))
+	}
+	if opts.Long {
+		add("long", "true")
+	}
+	if opts.Limit != 0 {
+		add("limit", strconv.Itoa(opts.Limit))
+	}
+	add("cursor", opts.Cursor)
+
+	reply, err := client.Do(ctx, "find", params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return page, &ProtocolError{Command: "find", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &page); err != nil {
+		return page, &ProtocolError{Command: "find", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//FindEach walks every chunk of a find, starting from opts.Cursor, handing each to fn as it arrives. An error
+// from fn stops the walk and is returned
+func (client *Client) FindEach(ctx context.Context, dir string, opts FindOptions, fn func(FindPage) error) error {
+	for {
+		page, err := client.Find(ctx, dir, opts)
+		if err != nil {
+			return err
+		}
+		if err = fn(page); err != nil {
+			return err
+		}
+		if page.Next == "" {
+			return nil
+		}
+		opts.Cursor = page.Next
+	}
+}
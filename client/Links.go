@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"strconv"
+)
+
+type LinkOptions struct {
+	//swap out whatever is already at the link path, atomically, rather than failing
+	Replace bool
+}
+
+//Link creates a hard link at linkPath to target
+func (client *Client) Link(ctx context.Context, target, linkPath string, opts LinkOptions) error {
+	if err := requireParams("ln", target, linkPath); err != nil {
+		return err
+	}
+	return client.run(ctx, LinkOp(target, linkPath, opts))
+}
+
+//Symlink creates a symlink at linkPath pointing to target. A relative target is resolved from linkPath's directory
+func (client *Client) Symlink(ctx context.Context, target, linkPath string, opts LinkOptions) error {
+	if err := requireParams("symlink", target, linkPath); err != nil {
+		return err
+	}
+	return client.run(ctx, SymlinkOp(target, linkPath, opts))
+}
+
+//Readlink returns the target of the symlink at path, as it is stored
+func (client *Client) Readlink(ctx context.Context, path string) (target string, err error) {
+	if err = requireParams("readlink", path); err != nil {
+		return
+	}
+	reply, err := client.Do(ctx, "readlink", path)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return "", &ProtocolError{Command: "readlink", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+
+	return reply[0], nil
+}
+
+func LinkOp(target, linkPath string, opts LinkOptions) Operation {
+	return Operation{"ln", []string{strconv.FormatBool(opts.Replace), target, linkPath}}
+}
+
+func SymlinkOp(target, linkPath string, opts LinkOptions) Operation {
+	return Operation{"symlink", []string{strconv.FormatBool(opts.Replace), target, linkPath}}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type ListOptions struct {
+	//entries per page, the daemon's default of 1000 when 0
+	Limit int
+	//carry on from the Next of a previous page, which must have used the same Sort and Reverse
+	Cursor string
+	//name, the default, size or mtime
+	Sort    string
+	Reverse bool
+	//include each entry's metadata
+	Long bool
+	//only names matching this shell pattern
+	Glob string
+	//only these types: file, directory, symlink or other
+	Types []string
+}
+
+type ListEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+	*StatInfo
+}
+
+type ListPage struct {
+	Entries []ListEntry `json:"entries"`
+	//entries matching the filters, across every page
+	Total int `json:"total"`
+	//cursor for the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+//List returns one page of the entries in dir. Pass the page's Next as opts.Cursor to get the one after
+func (client *Client) List(ctx context.Context, dir string, opts ListOptions) (page ListPage, err error) {
+	if err = requireParams("ls", dir); err != nil {
+		return
+	}
+	params := []string{dir}
+	if opts.Limit != 0 {
+		params = append(params, "limit="+strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		params = append(params, "cursor="+opts.Cursor)
+	}
+	if opts.Sort != "" {
+		params = append(params, "sort="+opts.Sort)
+	}
+	if opts.Reverse {
+		params = append(params, "reverse=true")
+	}
+	if opts.Long {
+		params = append(params, "long=true")
+	}
+	if opts.Glob != "" {
+		params = append(params, "glob="+opts.Glob)
+	}
+	if len(opts.Types) > 0 {
+		params = append(params, "type="+strings.Join(opts.Types, ","))
+	}
+
+	reply, err := client.Do(ctx, "ls", params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return page, &ProtocolError{Command: "ls", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &page); err != nil {
+		return page, &ProtocolError{Command: "ls", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
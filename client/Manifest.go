@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//ManifestSum is the text format of sha256sum and friends
+	ManifestSum = "sum"
+	//ManifestJSON adds each file's size and mtime
+	ManifestJSON = "json"
+)
+
+type Manifest struct {
+	Algorithm string          `json:"algorithm"`
+	Root      string          `json:"root"`
+	Created   time.Time       `json:"created"`
+	Files     []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Digest string    `json:"digest"`
+}
+
+type ManifestOptions struct {
+	//ManifestSum or ManifestJSON. Defaults to ManifestSum
+	Format string
+	//write the manifest to this file on the daemon's side instead of returning it. The file must not exist
+	Output string
+}
+
+//Manifest hashes every regular file under dir with algo. It returns the manifest in opts.Format, or, when opts.Output
+// is set, the number of files written to it
+func (client *Client) Manifest(ctx context.Context, dir, algo string, opts ManifestOptions) (string, error) {
+	if err := requireParams("manifest", dir, algo); err != nil {
+		return "", err
+	}
+	format := opts.Format
+	if format == "" {
+		format = ManifestSum
+	}
+	params := []string{algo, dir, format}
+	if opts.Output != "" {
+		params = append(params, opts.Output)
+	}
+	reply, err := client.Do(ctx, "manifest", params...)
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 1 {
+		return "", &ProtocolError{Command: "manifest", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+
+	return reply[0], nil
+}
+
+type VerifyResult struct {
+	OK         bool             `json:"ok"`
+	Checked    int              `json:"checked"`
+	Matched    int              `json:"matched"`
+	Missing    []string         `json:"missing"`
+	Extra      []string         `json:"extra"`
+	Mismatched []VerifyMismatch `json:"mismatched"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type VerifyMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type VerifyOptions struct {
+	//the algorithm of a sum format manifest; JSON manifests name their own
+	Algorithm string
+	//an absolute path to a manifest file on the daemon's side
+	ManifestPath string
+	//or the manifest itself, in either format
+	Manifest string
+}
+
+//Verify checks dir against a manifest. If anything is missing, extra or changed the result is returned along with
+// a *ServerError
+func (client *Client) Verify(ctx context.Context, dir string, opts VerifyOptions) (result VerifyResult, err error) {
+	if err = requireParams("verify", dir); err != nil {
+		return
+	}
+	if (opts.ManifestPath == "") == (opts.Manifest == "") {
+		return result, &ValidationError{Command: "verify", Message: "give exactly one of a manifest path or a manifest"}
+	}
+	if opts.ManifestPath != "" && !filepath.IsAbs(opts.ManifestPath) {
+		return result, &ValidationError{Command: "verify", Message: "the manifest path must be absolute"}
+	}
+	if opts.Manifest != "" && filepath.IsAbs(opts.Manifest) {
+		return result, &ValidationError{Command: "verify", Message: "the manifest looks like a path"}
+	}
+	algo := opts.Algorithm
+	if algo == "" {
+		algo = "sha256"
+	}
+
+	var reply []string
+	if opts.ManifestPath != "" {
+		reply, err = client.Do(ctx, "verify", algo, dir, opts.ManifestPath)
+	} else {
+		reply, err = client.send(ctx, "verify", []string{algo, dir}, opts.Manifest)
+	}
+
+	//a failed verify still reports what differed, as the error message
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, "{") {
+		if decodeErr := json.Unmarshal([]byte(serverErr.Message), &result); decodeErr == nil {
+			return result, &ServerError{Command: "verify", Message: verifyFailure(result)}
+		}
+	}
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return result, &ProtocolError{Command: "verify", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &result); err != nil {
+		return result, &ProtocolError{Command: "verify", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//verifyFailure summarises how a tree differed from its manifest
+func verifyFailure(result VerifyResult) string {
+	return strconv.Itoa(len(result.Missing)) + " missing, " + strconv.Itoa(len(result.Extra)) + " extra, " +
+		strconv.Itoa(len(result.Mismatched)) + " mismatched, " + strconv.Itoa(len(result.Errors)) + " errors"
+}
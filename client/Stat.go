@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//StatResult is the daemon's report on one path. StatInfo is nil when Error says why the path couldn't be read
+type StatResult struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+	*StatInfo
+}
+
+type StatInfo struct {
+	//file, directory, symlink, fifo, socket, char-device or block-device
+	Type        string     `json:"type"`
+	Size        int64      `json:"size"`
+	Mode        string     `json:"mode"`
+	Permissions string     `json:"permissions"`
+	UID         uint32     `json:"uid"`
+	GID         uint32     `json:"gid"`
+	User        string     `json:"user,omitempty"`
+	Group       string     `json:"group,omitempty"`
+	Atime       time.Time  `json:"atime"`
+	Mtime       time.Time  `json:"mtime"`
+	Ctime       time.Time  `json:"ctime"`
+	Btime       *time.Time `json:"btime,omitempty"`
+	Inode       uint64     `json:"inode"`
+	Device      uint64     `json:"device"`
+	Links       uint64     `json:"links"`
+	Target      string     `json:"target,omitempty"`
+	//NFSv4 ACL entries in nfs4_getfacl form, such as A:fd:OWNER@:rwaxtcy
+	ACL []string `json:"acl,omitempty"`
+}
+
+//Stat reports on each path, following symlinks. If any path can't be read, every result is still returned,
+// along with a *ServerError
+func (client *Client) Stat(ctx context.Context, paths ...string) ([]StatResult, error) {
+	return client.stat(ctx, "stat", paths)
+}
+
+//Lstat is Stat without following symlinks, so a symlink is reported as itself, with its Target
+func (client *Client) Lstat(ctx context.Context, paths ...string) ([]StatResult, error) {
+	return client.stat(ctx, "lstat", paths)
+}
+
+func (client *Client) stat(ctx context.Context, command string, paths []string) (results []StatResult, err error) {
+	if len(paths) == 0 {
+		return nil, &ValidationError{Command: command, Message: "no paths"}
+	}
+	if err = requireParams(command, paths...); err != nil {
+		return
+	}
+
+	reply, err := client.Do(ctx, command, paths...)
+	//when some paths fail, the results come back as the error message
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) && strings.HasPrefix(serverErr.Message, "[") {
+		if decodeErr := json.Unmarshal([]byte(serverErr.Message), &results); decodeErr == nil {
+			return results, &ServerError{Command: command, Message: statFailure(results)}
+		}
+	}
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return nil, &ProtocolError{Command: command, Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &results); err != nil {
+		return nil, &ProtocolError{Command: command, Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//statFailure summarises the paths that couldn't be read
+func statFailure(results []StatResult) string {
+	failed := 0
+	first := ""
+	for _, result := range results {
+		if result.Error != "" {
+			if failed == 0 {
+				first = result.Error
+			}
+			failed++
+		}
+	}
+	if failed == 1 {
+		return first
+	}
+	return strconv.Itoa(failed) + " of " + strconv.Itoa(len(results)) + " paths failed, first: " + first
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+type TouchOptions struct {
+	//set just these times. With neither, nor a Reference, both are set to now
+	Atime, Mtime time.Time
+	//take both times from this file, before Atime and Mtime are applied
+	Reference string
+	//set the times of everything under a directory too
+	Recursive bool
+	//leave a missing file missing rather than creating it
+	NoCreate bool
+}
+
+//Touch sets the times of path, creating it as an empty file if it is missing. It reports whether it was created
+func (client *Client) Touch(ctx context.Context, path string, opts TouchOptions) (created bool, err error) {
+	if err = requireParams("touch", path); err != nil {
+		return
+	}
+	params := []string{path}
+	if !opts.Atime.IsZero() {
+		params = append(params, "atime="+opts.Atime.Format(time.RFC3339Nano))
+	}
+	if !opts.Mtime.IsZero() {
+		params = append(params, "mtime="+opts.Mtime.Format(time.RFC3339Nano))
+	}
+	if opts.Reference != "" {
+		params = append(params, "reference="+opts.Reference)
+	}
+	if opts.Recursive {
+		params = append(params, "recursive=true")
+	}
+	if opts.NoCreate {
+		params = append(params, "create=false")
+	}
+
+	reply, err := client.Do(ctx, "touch", params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return false, &ProtocolError{Command: "touch", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if created, err = strconv.ParseBool(reply[0]); err != nil {
+		return false, &ProtocolError{Command: "touch", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
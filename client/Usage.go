@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+type DiskUsage struct {
+	ApparentSize int64 `json:"apparent_size"`
+	Allocated    int64 `json:"allocated"`
+	Files        int64 `json:"files"`
+	Directories  int64 `json:"directories"`
+	Other        int64 `json:"other"`
+}
+
+type DiskUsageReport struct {
+	Path string `json:"path"`
+	DiskUsage
+	Subdirectories []NamedDiskUsage `json:"subdirectories,omitempty"`
+	Owners         []OwnerDiskUsage `json:"owners,omitempty"`
+	Extensions     []NamedDiskUsage `json:"extensions,omitempty"`
+	//entries that couldn't be read, and the first few of their errors
+	ErrorCount int      `json:"error_count"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+type NamedDiskUsage struct {
+	Name string `json:"name"`
+	DiskUsage
+}
+
+type OwnerDiskUsage struct {
+	UID  uint32 `json:"uid"`
+	User string `json:"user,omitempty"`
+	DiskUsage
+}
+
+type DiskUsageOptions struct {
+	//break the total down by this many of the largest subdirectories
+	Top int
+	//break the total down by owner
+	Owners bool
+	//list this many of the extensions taking the most space
+	Extensions int
+}
+
+//DiskUsage totals the space used by the tree under path. Hard linked files are counted once
+func (client *Client) DiskUsage(ctx context.Context, path string, opts DiskUsageOptions) (report DiskUsageReport, err error) {
+	if err = requireParams("du", path); err != nil {
+		return
+	}
+	if opts.Top < 0 || opts.Extensions < 0 {
+		return report, &ValidationError{Command: "du", Message: "top and extensions cannot be negative"}
+	}
+	params := []string{path}
+	if opts.Top > 0 {
+		params = append(params, "top="+strconv.Itoa(opts.Top))
+	}
+	if opts.Owners {
+		params = append(params, "owners=true")
+	}
+	if opts.Extensions > 0 {
+		params = append(params, "extensions="+strconv.Itoa(opts.Extensions))
+	}
+
+	reply, err := client.Do(ctx, "du", params...)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return report, &ProtocolError{Command: "du", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &report); err != nil {
+		return report, &ProtocolError{Command: "du", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type XattrOptions struct {
+	//apply to everything under a directory as well, skipping symlinks
+	Recursive bool
+}
+
+//Getxattr returns the value of the extended attribute name on path. Names are namespaced, like user.tag, and the
+// daemon's policy decides which namespaces may be used
+func (client *Client) Getxattr(ctx context.Context, path, name string) (value []byte, err error) {
+	if err = requireParams("getxattr", path, name); err != nil {
+		return
+	}
+	reply, err := client.Do(ctx, "getxattr", path, name)
+	if err != nil {
+		return
+	}
+	if len(reply) == 0 {
+		return nil, &ProtocolError{Command: "getxattr", Reply: reply, Message: "expected the value"}
+	}
+	//the value isn't escaped, so any delimiters in it split it up
+	return []byte(strings.Join(reply, client.options.Delimiter)), nil
+}
+
+//Setxattr sets the extended attribute name on path to value, which may hold anything
+func (client *Client) Setxattr(ctx context.Context, path, name string, value []byte, opts XattrOptions) error {
+	if err := requireParams("setxattr", path, name); err != nil {
+		return err
+	}
+	//the value goes last, where the daemon takes the rest of the message as it is
+	_, err := client.send(ctx, "setxattr", []string{strconv.FormatBool(opts.Recursive), path, name}, string(value))
+	return err
+}
+
+//Listxattr returns the names of the extended attributes on path, sorted, in the namespaces the daemon allows
+func (client *Client) Listxattr(ctx context.Context, path string) (names []string, err error) {
+	if err = requireParams("listxattr", path); err != nil {
+		return
+	}
+	reply, err := client.Do(ctx, "listxattr", path)
+	if err != nil {
+		return
+	}
+	if len(reply) != 1 {
+		return nil, &ProtocolError{Command: "listxattr", Reply: reply, Message: "expected 1 reply chunk"}
+	}
+	if err = json.Unmarshal([]byte(reply[0]), &names); err != nil {
+		return nil, &ProtocolError{Command: "listxattr", Reply: reply, Message: err.Error()}
+	}
+
+	return
+}
+
+//Removexattr removes the extended attribute name from path. Recursively, entries without it are passed over
+func (client *Client) Removexattr(ctx context.Context, path, name string, opts XattrOptions) error {
+	if err := requireParams("removexattr", path, name); err != nil {
+		return err
+	}
+	return client.run(ctx, RemovexattrOp(path, name, opts))
+}
+
+func SetxattrOp(path, name, value string, opts XattrOptions) Operation {
+	return Operation{"setxattr", []string{strconv.FormatBool(opts.Recursive), path, name, value}}
+}
+
+func RemovexattrOp(path, name string, opts XattrOptions) Operation {
+	return Operation{"removexattr", []string{strconv.FormatBool(opts.Recursive), path, name}}
+}